@@ -0,0 +1,63 @@
+package smtp
+
+import (
+	"net"
+	"strings"
+)
+
+// addrString returns addr as a string, tolerating nil addresses from custom transports
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// remoteIP extracts the client IP from a connection address, "" if there is none
+func remoteIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case nil:
+		return ""
+	case *net.TCPAddr:
+		if a.IP == nil {
+			return ""
+		}
+		return a.IP.String()
+	default:
+		return ipFromAddr(a.String())
+	}
+}
+
+// ipFromAddr extracts an IP from an address string. It handles "host:port",
+// bare hosts, bracketed IPv6 with or without port, IPv6 zones and unix socket
+// addresses ("@", "@name" or paths), returning "" when no IP is present.
+func ipFromAddr(addr string) string {
+	addr = strings.TrimSpace(addr)
+	if addr == "" || strings.HasPrefix(addr, "@") || strings.HasPrefix(addr, "/") {
+		return ""
+	}
+
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if idx := strings.IndexByte(host, '%'); idx >= 0 {
+		host = host[:idx]
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// addressDomain returns the lowercased domain of an email address, "" if it has none
+func addressDomain(addr string) string {
+	if idx := strings.LastIndex(addr, "@"); idx >= 0 {
+		return strings.ToLower(addr[idx+1:])
+	}
+	return ""
+}
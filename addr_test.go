@@ -0,0 +1,37 @@
+package smtp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPFromAddr(t *testing.T) {
+	for addr, want := range map[string]string{
+		"192.0.2.1:25":             "192.0.2.1",
+		"192.0.2.1":                "192.0.2.1",
+		"[2001:db8::1]:25":         "2001:db8::1",
+		"[2001:db8::1]":            "2001:db8::1",
+		"2001:db8::1":              "2001:db8::1",
+		"[fe80::1%eth0]:25":        "fe80::1",
+		"::ffff:192.0.2.1":         "192.0.2.1",
+		"@":                        "",
+		"@smtp.sock":               "",
+		"/run/smtp.sock":           "",
+		"":                         "",
+		"client.example:25":        "",
+		"  192.0.2.1:25  ":         "192.0.2.1",
+		"not an address at all:xx": "",
+	} {
+		require.Equal(t, want, ipFromAddr(addr), addr)
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	require.Equal(t, "", remoteIP(nil))
+	require.Equal(t, "", remoteIP(&net.TCPAddr{}))
+	require.Equal(t, "192.0.2.1", remoteIP(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}))
+	require.Equal(t, "", remoteIP(&net.UnixAddr{Name: "@", Net: "unix"}))
+	require.Equal(t, "", addrString(nil))
+}
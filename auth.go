@@ -0,0 +1,136 @@
+package smtp
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"go.uber.org/zap"
+)
+
+// errAuthRequired is returned for MAIL FROM before AUTH when allow_anonymous is off
+var errAuthRequired = &smtp.SMTPError{
+	Code:         530,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+	Message:      "Authentication required",
+}
+
+// AuthMechanisms returns the SASL mechanisms advertised after EHLO.
+// go-smtp only asks while answering EHLO, which tells EHLO from HELO.
+func (s *Session) AuthMechanisms() []string {
+	s.markESMTP()
+	return []string{sasl.Plain, sasl.Login, saslXOAuth2, sasl.OAuthBearer}
+}
+
+// Auth starts a SASL exchange. Credentials are captured, not verified.
+func (s *Session) Auth(mech string) (sasl.Server, error) {
+	s.trace("AUTH", mech)
+
+	switch mech {
+	case sasl.Plain:
+		return sasl.NewPlainServer(func(_, username, password string) error {
+			return s.AuthPlain(username, password)
+		}), nil
+	case sasl.Login:
+		// Legacy clients: base64 username and password in two 334 rounds
+		return sasl.NewLoginServer(func(username, password string) error {
+			s.captureAuth("LOGIN", username, password)
+			return nil
+		}), nil
+	case saslXOAuth2:
+		return &xoauth2Server{capture: func(username, token string) {
+			s.captureAuth(saslXOAuth2, username, token)
+		}}, nil
+	case sasl.OAuthBearer:
+		return sasl.NewOAuthBearerServer(func(opts sasl.OAuthBearerOptions) *sasl.OAuthBearerError {
+			s.captureAuth(sasl.OAuthBearer, opts.Username, opts.Token)
+			return nil
+		}), nil
+	}
+
+	return nil, smtp.ErrAuthUnknownMechanism
+}
+
+// AuthPlain captures AUTH PLAIN credentials, every attempt succeeds
+func (s *Session) AuthPlain(username, password string) error {
+	s.captureAuth("PLAIN", username, password)
+	return nil
+}
+
+// saslXOAuth2 is Google's pre-standard OAuth 2.0 mechanism, also used by Microsoft 365
+const saslXOAuth2 = "XOAUTH2"
+
+// xoauth2Server captures the user and bearer token of an XOAUTH2 exchange:
+// a single response "user=<user>\x01auth=Bearer <token>\x01\x01"
+type xoauth2Server struct {
+	capture func(username, token string)
+	done    bool
+}
+
+func (a *xoauth2Server) Next(response []byte) ([]byte, bool, error) {
+	if a.done {
+		return nil, true, sasl.ErrUnexpectedClientResponse
+	}
+
+	// No initial response, ask for it with an empty challenge
+	if response == nil {
+		return []byte{}, false, nil
+	}
+	a.done = true
+
+	var username, token string
+	for _, field := range strings.Split(string(response), "\x01") {
+		key, value, _ := strings.Cut(field, "=")
+		switch strings.ToLower(key) {
+		case "user":
+			username = value
+		case "auth":
+			scheme, credentials, _ := strings.Cut(value, " ")
+			if strings.EqualFold(scheme, "Bearer") {
+				token = strings.TrimSpace(credentials)
+			}
+		}
+	}
+	if username == "" || token == "" {
+		return nil, true, errors.New("invalid XOAUTH2 response")
+	}
+
+	a.capture(username, token)
+	return nil, true, nil
+}
+
+// captureAuth records credentials for the event, the password is never logged
+func (s *Session) captureAuth(mechanism, username, password string) {
+	s.authenticated = true
+	s.authMechanism = mechanism
+
+	// credential_storage none: only the attempt and its mechanism are kept
+	if s.backend.plugin.cfg.CredentialStorage == "none" {
+		s.log.Debug("AUTH captured", zap.String("uuid", s.uuid), zap.String("mechanism", mechanism))
+		return
+	}
+
+	s.authUsername = username
+	s.authPassword = password
+
+	s.log.Debug("AUTH captured",
+		zap.String("uuid", s.uuid),
+		zap.String("mechanism", mechanism),
+		zap.String("username", username),
+	)
+}
+
+// authSenderMatches compares the authenticated username with the envelope sender.
+// A username without a domain is compared with the local part only.
+func authSenderMatches(username, from string) bool {
+	username = strings.TrimSpace(username)
+	if username == "" || from == "" {
+		return false
+	}
+	if !strings.Contains(username, "@") {
+		local, _, _ := strings.Cut(from, "@")
+		return strings.EqualFold(username, local)
+	}
+	return strings.EqualFold(username, from)
+}
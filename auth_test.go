@@ -0,0 +1,191 @@
+package smtp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// b64 encodes a SASL response
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// sendAuthenticated delivers one message on c and returns its authentication data
+func sendAuthenticated(t *testing.T, c *testClient, w *testWorker) map[string]any {
+	t.Helper()
+
+	code, msg := c.send("user@example.com", []string{"b@example.com"}, "Subject: hi\r\n\r\nbody")
+	require.Equal(t, 250, code, msg)
+
+	auth, _ := w.waitEvent(t, "EMAIL_RECEIVED")["authentication"].(map[string]any)
+	return auth
+}
+
+func TestAuthLoginExchange(t *testing.T) {
+	p, w := newTestPlugin(t, nil)
+	addr := startTestServer(t, p)
+
+	c, _, _ := dialTest(t, addr)
+	_, msg := c.cmd("EHLO client.example")
+	require.Contains(t, msg, "AUTH PLAIN LOGIN XOAUTH2 OAUTHBEARER")
+
+	code, msg := c.cmd("AUTH LOGIN")
+	require.Equal(t, 334, code)
+	require.Equal(t, b64("Username:"), msg)
+	code, msg = c.cmd("%s", b64("user@example.com"))
+	require.Equal(t, 334, code)
+	require.Equal(t, b64("Password:"), msg)
+	code, _ = c.cmd("%s", b64("s3cret"))
+	require.Equal(t, 235, code)
+
+	auth := sendAuthenticated(t, c, w)
+	require.Equal(t, map[string]any{
+		"attempted": true,
+		"mechanism": "LOGIN",
+		"username":  "user@example.com",
+		"password":  "s3cret",
+	}, auth)
+	require.Equal(t, true, w.eventsOf("EMAIL_RECEIVED")[0]["authSenderMatch"])
+}
+
+func TestAuthLoginWithInitialResponse(t *testing.T) {
+	p, w := newTestPlugin(t, nil)
+	addr := startTestServer(t, p)
+
+	c, _, _ := dialTest(t, addr)
+	c.cmd("EHLO client.example")
+
+	code, msg := c.cmd("AUTH LOGIN %s", b64("other@example.com"))
+	require.Equal(t, 334, code)
+	require.Equal(t, b64("Password:"), msg)
+	code, _ = c.cmd("%s", b64("s3cret"))
+	require.Equal(t, 235, code)
+
+	auth := sendAuthenticated(t, c, w)
+	require.Equal(t, "other@example.com", auth["username"])
+	require.Equal(t, false, w.eventsOf("EMAIL_RECEIVED")[0]["authSenderMatch"])
+}
+
+func TestAuthLoginCancelled(t *testing.T) {
+	p, w := newTestPlugin(t, nil)
+	addr := startTestServer(t, p)
+
+	c, _, _ := dialTest(t, addr)
+	c.cmd("EHLO client.example")
+
+	code, _ := c.cmd("AUTH LOGIN")
+	require.Equal(t, 334, code)
+	code, _ = c.cmd("*")
+	require.Equal(t, 501, code)
+
+	require.Nil(t, sendAuthenticated(t, c, w))
+}
+
+func TestXOAuth2InitialResponse(t *testing.T) {
+	var user, token string
+	server := &xoauth2Server{capture: func(u, t string) { user, token = u, t }}
+
+	challenge, done, err := server.Next([]byte("user=someuser@example.com\x01auth=Bearer ya29.vF9dft4qmTc2Nvb3RlckBhdHRhdmlzdGEuY29tCg\x01\x01"))
+	require.NoError(t, err)
+	require.True(t, done)
+	require.Nil(t, challenge)
+	require.Equal(t, "someuser@example.com", user)
+	require.Equal(t, "ya29.vF9dft4qmTc2Nvb3RlckBhdHRhdmlzdGEuY29tCg", token)
+
+	// The exchange is over after the response
+	_, done, err = server.Next([]byte("again"))
+	require.True(t, done)
+	require.Error(t, err)
+}
+
+func TestXOAuth2WithoutInitialResponse(t *testing.T) {
+	var user string
+	server := &xoauth2Server{capture: func(u, _ string) { user = u }}
+
+	challenge, done, err := server.Next(nil)
+	require.NoError(t, err)
+	require.False(t, done)
+	require.Equal(t, []byte{}, challenge)
+
+	_, done, err = server.Next([]byte("user=a@example.com\x01auth=bearer token\x01\x01"))
+	require.NoError(t, err)
+	require.True(t, done)
+	require.Equal(t, "a@example.com", user)
+}
+
+func TestXOAuth2InvalidResponse(t *testing.T) {
+	for _, response := range []string{
+		"",
+		"user=a@example.com\x01\x01",
+		"auth=Bearer token\x01\x01",
+		"user=a@example.com\x01auth=Basic dXNlcjpwYXNz\x01\x01",
+	} {
+		server := &xoauth2Server{capture: func(string, string) { t.Fatal("captured an invalid response") }}
+		_, done, err := server.Next([]byte(response))
+		require.True(t, done)
+		require.Error(t, err, response)
+	}
+}
+
+func TestAuthXOAuth2OverSMTP(t *testing.T) {
+	p, w := newTestPlugin(t, nil)
+	addr := startTestServer(t, p)
+
+	c, _, _ := dialTest(t, addr)
+	c.cmd("EHLO client.example")
+	code, _ := c.cmd("AUTH XOAUTH2 %s", b64("user=user@example.com\x01auth=Bearer token123\x01\x01"))
+	require.Equal(t, 235, code)
+
+	auth := sendAuthenticated(t, c, w)
+	require.Equal(t, "XOAUTH2", auth["mechanism"])
+	require.Equal(t, "user@example.com", auth["username"])
+	require.Equal(t, "token123", auth["password"])
+}
+
+func TestCredentialStorage(t *testing.T) {
+	mac := hmac.New(sha256.New, []byte("test-key"))
+	mac.Write([]byte("hash\x00s3cret"))
+	hashed := "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil))
+
+	for storage, want := range map[string]map[string]any{
+		"plain":  {"attempted": true, "mechanism": "PLAIN", "username": "user@example.com", "password": "s3cret"},
+		"hashed": {"attempted": true, "mechanism": "PLAIN", "username": "user@example.com", "password": hashed},
+		"none":   {"attempted": true, "mechanism": "PLAIN", "username": "", "password": ""},
+	} {
+		t.Run(storage, func(t *testing.T) {
+			p, w := newTestPlugin(t, func(cfg *Config) {
+				cfg.CredentialStorage = storage
+				cfg.CredentialKey = "test-key"
+			})
+			addr := startTestServer(t, p)
+
+			c, _, _ := dialTest(t, addr)
+			c.cmd("EHLO client.example")
+			code, _ := c.cmd("AUTH PLAIN %s", b64("\x00user@example.com\x00s3cret"))
+			require.Equal(t, 235, code)
+
+			require.Equal(t, want, sendAuthenticated(t, c, w))
+		})
+	}
+}
+
+func TestCredentialStorageStableForKey(t *testing.T) {
+	p, _ := newTestPlugin(t, func(cfg *Config) { cfg.CredentialStorage = "hashed" })
+
+	first := p.protectCredential("s3cret")
+	require.Equal(t, first, p.protectCredential("s3cret"))
+	require.NotEqual(t, first, p.protectCredential("other"))
+	require.Empty(t, p.protectCredential(""))
+
+	// Without credential_key every process gets its own random key
+	other, _ := newTestPlugin(t, func(cfg *Config) { cfg.CredentialStorage = "hashed" })
+	require.NotEqual(t, first, other.protectCredential("s3cret"))
+
+	p.cfg.CredentialStorage = "tokenized"
+	require.Regexp(t, `^tok_[0-9a-f]{16}$`, p.protectCredential("s3cret"))
+}
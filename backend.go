@@ -1,6 +1,8 @@
 package smtp
 
 import (
+	"time"
+
 	"github.com/emersion/go-smtp"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
@@ -21,21 +23,97 @@ func NewBackend(plugin *Plugin) *Backend {
 }
 
 // NewSession is called when new SMTP connection is established
-func (b *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+func (b *Backend) NewSession(c *smtp.Conn) (_ smtp.Session, err error) {
+	client := clientConnOf(c.Conn())
+
 	session := &Session{
 		backend:    b,
 		conn:       c,
+		client:     client,
 		uuid:       uuid.NewString(),
-		remoteAddr: c.Conn().RemoteAddr().String(),
+		remoteAddr: addrString(c.Conn().RemoteAddr()),
+		remoteIP:   remoteIP(c.Conn().RemoteAddr()),
+		localAddr:  addrString(c.Conn().LocalAddr()),
+		heloName:   c.Hostname(),
 		log:        b.log,
+		helloAt:    time.Now(),
+	}
+
+	session.connectedAt = session.helloAt
+	if client != nil {
+		// Every session of the connection reports the same id
+		session.uuid = client.uuid
+		session.connectedAt = client.acceptedAt
+	}
+
+	// Counted first, so clients over max_connections cost no lookups or events
+	if !session.acquireSlot(c.Session()) {
+		b.log.Info("connection limit reached",
+			zap.String("remote_addr", session.remoteAddr),
+			zap.Int("max_connections", b.plugin.cfg.MaxConnections),
+		)
+		session.closeAfterReply()
+		return nil, errTooManyConnections
+	}
+	defer func() {
+		if err != nil {
+			session.returnSlot(c.Session())
+		}
+	}()
+
+	if session.rateLimited() {
+		b.log.Info("connection rate limit exceeded", zap.String("remote_ip", session.remoteIP))
+		session.closeAfterReply()
+		return nil, errConnectionRateLimited
 	}
 
+	if b.plugin.cfg.RDNS {
+		session.remoteHost = b.plugin.dns.remoteHost(session.remoteIP)
+	}
+
+	// Sessions start on HELO/EHLO, so a listed client is refused at greeting
+	var listings []string
+	if client != nil {
+		listings = client.dnsbl()
+	} else {
+		listings = b.plugin.checkDNSBL(session.remoteIP)
+	}
+	if len(listings) > 0 {
+		if b.plugin.cfg.DNSBLPolicy == "reject" {
+			b.log.Info("client rejected by DNSBL",
+				zap.String("remote_ip", session.remoteIP),
+				zap.Strings("zones", listings),
+			)
+			// go-smtp would keep the connection open for another HELO/EHLO
+			session.closeAfterReply()
+			return nil, &smtp.SMTPError{
+				Code:         554,
+				EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+				Message:      "Client host blocked using " + listings[0],
+			}
+		}
+		session.dnsblListings = listings
+	}
+
+	if b.plugin.cfg.ConnectEvent {
+		if reply := session.connectEvent(); reply != nil {
+			// go-smtp would keep the connection open for another HELO/EHLO
+			session.closeAfterReply()
+			return nil, reply
+		}
+	}
+
+	// Session is created on HELO/EHLO, AuthMechanisms relabels it for EHLO
+	session.trace("HELO", c.Hostname())
+
 	// Store connection for management
 	b.plugin.connections.Store(session.uuid, session)
 
 	b.log.Debug("new SMTP connection",
 		zap.String("uuid", session.uuid),
 		zap.String("remote_addr", session.remoteAddr),
+		zap.String("remote_ip", session.remoteIP),
+		zap.String("local_addr", session.localAddr),
 	)
 
 	return session, nil
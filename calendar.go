@@ -0,0 +1,182 @@
+package smtp
+
+import (
+	"strings"
+	"time"
+)
+
+// Calendar is the structured form of a text/calendar part (parse_calendar).
+// Only the first VEVENT is extracted.
+type Calendar struct {
+	Method    string         `json:"method,omitempty"` // e.g. "REQUEST", "CANCEL", "REPLY"
+	UID       string         `json:"uid,omitempty"`
+	Summary   string         `json:"summary,omitempty"`
+	Location  string         `json:"location,omitempty"`
+	Start     string         `json:"start,omitempty"` // RFC 3339 when parseable, raw value otherwise
+	End       string         `json:"end,omitempty"`
+	Organizer *EmailAddress  `json:"organizer,omitempty"`
+	Attendees []EmailAddress `json:"attendees"`
+	Warning   string         `json:"warning,omitempty"` // set for malformed calendars
+}
+
+// parseCalendar extracts the method and first event of an iCalendar document.
+// Malformed input yields a best-effort result with Warning set.
+func parseCalendar(data []byte) *Calendar {
+	cal := &Calendar{Attendees: make([]EmailAddress, 0)}
+
+	var (
+		inCalendar bool
+		inEvent    bool
+		seenEvent  bool
+		depth      int // nesting inside the event, e.g. VALARM
+	)
+
+	for _, line := range unfoldCalendarLines(string(data)) {
+		name, params, value, ok := splitCalendarLine(line)
+		if !ok {
+			continue
+		}
+
+		switch name {
+		case "BEGIN":
+			switch {
+			case strings.EqualFold(value, "VCALENDAR"):
+				inCalendar = true
+			case inEvent:
+				depth++
+			case strings.EqualFold(value, "VEVENT") && !seenEvent:
+				inEvent = true
+			}
+			continue
+		case "END":
+			switch {
+			case inEvent && depth > 0:
+				depth--
+			case inEvent && strings.EqualFold(value, "VEVENT"):
+				inEvent = false
+				seenEvent = true
+			case strings.EqualFold(value, "VCALENDAR"):
+				inCalendar = false
+			}
+			continue
+		}
+
+		if !inEvent {
+			if name == "METHOD" && inCalendar {
+				cal.Method = strings.ToUpper(value)
+			}
+			continue
+		}
+		if depth > 0 {
+			continue
+		}
+
+		switch name {
+		case "UID":
+			cal.UID = value
+		case "SUMMARY":
+			cal.Summary = unescapeCalendarText(value)
+		case "LOCATION":
+			cal.Location = unescapeCalendarText(value)
+		case "DTSTART":
+			cal.Start = calendarTime(value, params["TZID"])
+		case "DTEND":
+			cal.End = calendarTime(value, params["TZID"])
+		case "ORGANIZER":
+			cal.Organizer = calendarAddress(value, params)
+		case "ATTENDEE":
+			cal.Attendees = append(cal.Attendees, *calendarAddress(value, params))
+		}
+	}
+
+	switch {
+	case inEvent || inCalendar:
+		cal.Warning = "unterminated calendar"
+	case !seenEvent:
+		cal.Warning = "no VEVENT found"
+	}
+
+	return cal
+}
+
+// unfoldCalendarLines splits content lines, joining folded continuations (RFC 5545 3.1)
+func unfoldCalendarLines(data string) []string {
+	var lines []string
+	for _, raw := range strings.Split(data, "\n") {
+		raw = strings.TrimRight(raw, "\r")
+		if len(raw) > 0 && (raw[0] == ' ' || raw[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += raw[1:]
+			continue
+		}
+		if raw != "" {
+			lines = append(lines, raw)
+		}
+	}
+	return lines
+}
+
+// splitCalendarLine splits "NAME;PARAM=x:value" into its parts, parameter names uppercased
+func splitCalendarLine(line string) (name string, params map[string]string, value string, ok bool) {
+	// The value starts at the first colon outside a quoted parameter value
+	quoted := false
+	colon := -1
+	for i := 0; i < len(line) && colon < 0; i++ {
+		switch line[i] {
+		case '"':
+			quoted = !quoted
+		case ':':
+			if !quoted {
+				colon = i
+			}
+		}
+	}
+	if colon <= 0 {
+		return "", nil, "", false
+	}
+
+	fields := strings.Split(line[:colon], ";")
+	name = strings.ToUpper(strings.TrimSpace(fields[0]))
+	params = make(map[string]string, len(fields)-1)
+	for _, field := range fields[1:] {
+		if key, val, found := strings.Cut(field, "="); found {
+			params[strings.ToUpper(key)] = strings.Trim(val, `"`)
+		}
+	}
+
+	return name, params, strings.TrimSpace(line[colon+1:]), true
+}
+
+// calendarAddress converts an ORGANIZER/ATTENDEE value like "mailto:a@b" with a CN parameter
+func calendarAddress(value string, params map[string]string) *EmailAddress {
+	email := value
+	if len(email) >= 7 && strings.EqualFold(email[:7], "mailto:") {
+		email = email[7:]
+	}
+	return &EmailAddress{Email: email, Name: params["CN"]}
+}
+
+// calendarTime converts DATE-TIME and DATE values to RFC 3339, keeping unknown formats as is
+func calendarTime(value, tzid string) string {
+	loc := time.UTC
+	if tzid != "" {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+
+	if t, err := time.Parse("20060102T150405Z", value); err == nil {
+		return t.Format(time.RFC3339)
+	}
+	if t, err := time.ParseInLocation("20060102T150405", value, loc); err == nil {
+		return t.Format(time.RFC3339)
+	}
+	if t, err := time.ParseInLocation("20060102", value, loc); err == nil {
+		return t.Format(time.DateOnly)
+	}
+	return value
+}
+
+// unescapeCalendarText resolves TEXT value escapes
+func unescapeCalendarText(value string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(value)
+}
@@ -4,15 +4,16 @@ import (
 	"context"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
 	"go.uber.org/zap"
 )
 
-// startCleanupRoutine starts background cleanup of temp files
+// startCleanupRoutine starts background cleanup of temp files and stored .eml files
 func (p *Plugin) startCleanupRoutine(ctx context.Context) {
-	if p.cfg.AttachmentStorage.Mode != "tempfile" {
+	if !p.cfg.usesTempFiles() && p.cfg.StoreEml == "" {
 		return
 	}
 
@@ -25,15 +26,50 @@ func (p *Plugin) startCleanupRoutine(ctx context.Context) {
 				ticker.Stop()
 				return
 			case <-ticker.C:
-				p.cleanupTempFiles()
+				if p.cfg.usesTempFiles() {
+					p.cleanupTempFiles()
+				}
+				if p.cfg.StoreEml != "" {
+					p.cleanupEmlFiles()
+				}
 			}
 		}
 	}()
 }
 
-// cleanupTempFiles removes old temp files
+// cleanupTempFiles removes old temp files and resyncs the temp storage gauges,
+// which writes only ever increase between runs
 func (p *Plugin) cleanupTempFiles() {
-	dir := p.cfg.AttachmentStorage.TempDir
+	usage := p.cleanupDir(p.cfg.AttachmentStorage.TempDir, func(name string) bool {
+		return strings.HasPrefix(name, "smtp-att-")
+	})
+
+	st := &p.stats
+	st.tempFiles.Store(usage.files)
+	st.tempBytes.Store(usage.bytes)
+	st.tempFilesRemoved.Add(uint64(usage.removed))
+	st.tempFilesLastRemoved.Store(int64(usage.removed))
+}
+
+// storedEmlName matches the <uuid>-<n>.eml[.gz] names given by writeEml
+var storedEmlName = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}-[0-9]+\.eml(\.gz)?$`)
+
+// cleanupEmlFiles removes old .eml files stored by the plugin, other files in
+// the store_eml directory are left alone
+func (p *Plugin) cleanupEmlFiles() {
+	p.cleanupDir(p.cfg.StoreEml, storedEmlName.MatchString)
+}
+
+// dirUsage is the result of a cleanup pass over a directory
+type dirUsage struct {
+	removed int
+	files   int64 // matching files left
+	bytes   int64 // size of matching files left
+}
+
+// cleanupDir removes files matching the predicate older than cleanup_after
+func (p *Plugin) cleanupDir(dir string, match func(name string) bool) dirUsage {
+	var usage dirUsage
 	cutoff := time.Now().Add(-p.cfg.AttachmentStorage.CleanupAfter)
 
 	entries, err := os.ReadDir(dir)
@@ -42,12 +78,11 @@ func (p *Plugin) cleanupTempFiles() {
 		if !os.IsNotExist(err) {
 			p.log.Error("cleanup readdir error", zap.Error(err))
 		}
-		return
+		return usage
 	}
 
-	removed := 0
 	for _, entry := range entries {
-		if !strings.HasPrefix(entry.Name(), "smtp-att-") {
+		if !match(entry.Name()) {
 			continue
 		}
 
@@ -63,13 +98,24 @@ func (p *Plugin) cleanupTempFiles() {
 					zap.String("path", path),
 					zap.Error(err),
 				)
+				usage.files++
+				usage.bytes += info.Size()
 			} else {
-				removed++
+				usage.removed++
 			}
+			continue
 		}
+
+		usage.files++
+		usage.bytes += info.Size()
 	}
 
-	if removed > 0 {
-		p.log.Debug("temp file cleanup completed", zap.Int("removed", removed))
+	if usage.removed > 0 {
+		p.log.Debug("temp file cleanup completed",
+			zap.String("dir", dir),
+			zap.Int("removed", usage.removed),
+		)
 	}
+
+	return usage
 }
@@ -0,0 +1,58 @@
+package smtp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCleanupEmlFilesKeepsForeignFiles(t *testing.T) {
+	dir := t.TempDir()
+	p, _ := newTestPlugin(t, func(cfg *Config) { cfg.StoreEml = dir })
+
+	old := time.Now().Add(-2 * p.cfg.AttachmentStorage.CleanupAfter)
+	files := map[string]bool{
+		"3f2a9c1e-5b7d-4e8f-9a0b-1c2d3e4f5a6b-1.eml":     false,
+		"3f2a9c1e-5b7d-4e8f-9a0b-1c2d3e4f5a6b-12.eml.gz": false,
+		"archive.eml":                              true,
+		"2024-01-01-incident.eml.gz":               true,
+		"3f2a9c1e-5b7d-4e8f-9a0b-1c2d3e4f5a6b.eml": true,
+	}
+	for name := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte("x"), 0o600))
+		require.NoError(t, os.Chtimes(path, old, old))
+	}
+	// Plugin files younger than cleanup_after stay
+	fresh := filepath.Join(dir, "3f2a9c1e-5b7d-4e8f-9a0b-1c2d3e4f5a6b-2.eml")
+	require.NoError(t, os.WriteFile(fresh, []byte("x"), 0o600))
+	files[filepath.Base(fresh)] = true
+
+	p.cleanupEmlFiles()
+
+	for name, kept := range files {
+		_, err := os.Stat(filepath.Join(dir, name))
+		require.Equal(t, kept, err == nil, name)
+	}
+}
+
+func TestStoredEmlNameMatchesCleanup(t *testing.T) {
+	dir := t.TempDir()
+	p, _ := newTestPlugin(t, func(cfg *Config) {
+		cfg.StoreEml = dir
+		cfg.StoreEmlCompress = true
+	})
+
+	c, _, _ := dialTest(t, startTestServer(t, p))
+	c.cmd("EHLO client.example")
+	code, _ := c.send("a@example.com", []string{"b@example.com"}, "Subject: hi\r\n\r\nbody")
+	require.Equal(t, 250, code)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Regexp(t, storedEmlName, entries[0].Name())
+}
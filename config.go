@@ -1,10 +1,14 @@
 package smtp
 
 import (
+	"net"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/roadrunner-server/errors"
 	"github.com/roadrunner-server/pool/pool"
+	"golang.org/x/text/encoding/htmlindex"
 )
 
 // Config represents SMTP server configuration
@@ -15,22 +19,328 @@ type Config struct {
 	ReadTimeout    time.Duration `mapstructure:"read_timeout"`
 	WriteTimeout   time.Duration `mapstructure:"write_timeout"`
 	MaxMessageSize int64         `mapstructure:"max_message_size"`
+	MaxRecipients  int           `mapstructure:"max_recipients"`  // unique RCPT TO per message, more get 452 (default: 100)
+	MaxAttachments int           `mapstructure:"max_attachments"` // per message, more reject it with 552, 0 for unlimited, 100 recommended (default: 0)
+	MaxConnections int           `mapstructure:"max_connections"` // concurrent sessions, more get 421, 0 for unlimited (default: 0)
+
+	// Decoded size above which an attachment is delivered without content (default: 0, unlimited)
+	MaxAttachmentSize int64 `mapstructure:"max_attachment_size"`
+
+	// TCP keepalive probes for accepted connections, reaps half-open peers
+	TCPKeepalive         *bool         `mapstructure:"tcp_keepalive"`          // default: true
+	TCPKeepaliveInterval time.Duration `mapstructure:"tcp_keepalive_interval"` // default: 15s
+
+	// What to do with messages over the size limit: "reject" (default) or "truncate"
+	OversizePolicy string `mapstructure:"oversize_policy"`
+
+	// Cap on total decoded body and attachment bytes per message (default: 0, unlimited)
+	MaxDecodedBytes int64 `mapstructure:"max_decoded_bytes"`
+
+	// Per recipient domain max message size, overrides max_message_size
+	DomainLimits map[string]int64 `mapstructure:"domain_limits"`
+
+	// Static labels attached to every event, e.g. a routing tag for this server
+	Labels map[string]string `mapstructure:"labels"`
+
+	// Charset assumed for text parts without a charset parameter (default: utf-8)
+	DefaultCharset string `mapstructure:"default_charset"`
 
 	// Attachment storage
 	AttachmentStorage AttachmentConfig `mapstructure:"attachment_storage"`
 
+	// Reply code for new transactions once shutdown has begun (default: 421)
+	ShutdownCode int `mapstructure:"shutdown_code"`
+
+	// Forward only messages matching all conditions to workers (default: forward everything)
+	DeliveryFilter DeliveryFilterConfig `mapstructure:"delivery_filter"`
+
+	// Honeypot mode: capture the message, then reject it anyway
+	HoneypotReject HoneypotRejectConfig `mapstructure:"honeypot_reject"`
+
+	// STARTTLS, advertised once a certificate is configured
+	TLS TLSConfig `mapstructure:"tls"`
+
+	// Second listener speaking implicit TLS (SMTPS), e.g. ":465", uses the tls certificate (default: disabled)
+	TLSAddr string `mapstructure:"tls_addr"`
+
+	// Reject MAIL FROM with 530 until the connection was upgraded with STARTTLS (default: false)
+	RequireTLS bool `mapstructure:"require_tls"`
+
 	// Worker pool configuration
 	Pool *pool.Config `mapstructure:"pool"`
 
-	// Include full raw RFC822 message in JSON (default: false)
+	// Minimum number of ready workers before accepting connections (default: 0, don't wait)
+	WaitForWorkers     int           `mapstructure:"wait_for_workers"`
+	WorkerReadyTimeout time.Duration `mapstructure:"worker_ready_timeout"`
+
+	// Directory to write every raw message to as <uuid>-<n>.eml (default: "", disabled).
+	// Files written by the plugin are reaped after attachment_storage.cleanup_after,
+	// other files in the directory are left alone.
+	StoreEml string `mapstructure:"store_eml"`
+	// Gzip stored messages as <uuid>-<n>.eml.gz (default: false)
+	StoreEmlCompress bool `mapstructure:"store_eml_compress"`
+
+	// Send only envelope and key headers to the worker for the accept decision (default: false).
+	// With minimal_event_follow_up the full event is delivered asynchronously afterwards.
+	MinimalEvent         bool `mapstructure:"minimal_event"`
+	MinimalEventFollowUp bool `mapstructure:"minimal_event_follow_up"`
+
+	// Send an EMAIL_HEADERS event as soon as the headers are received, before the
+	// body has arrived; the full event then carries event: EMAIL_RECEIVED (default: false)
+	StreamEvents bool `mapstructure:"stream_events"`
+
+	// Rewrite bare CRs (not followed by LF) in message data to CRLF (default: false)
+	NormalizeBareCR bool `mapstructure:"normalize_bare_cr"`
+
+	// Max marshaled event size in bytes sent to a worker (default: 0, unlimited).
+	// Larger events drop raw and move inline attachments to temp files.
+	MaxWorkerPayload int64 `mapstructure:"max_worker_payload"`
+
+	// Include full raw RFC822 message and header values before RFC 2047 decoding in JSON (default: false)
 	IncludeRaw bool `mapstructure:"include_raw"`
+
+	// Include the verbatim header block in JSON (default: false)
+	IncludeRawHeaders bool `mapstructure:"include_raw_headers"`
+
+	// Include headers as ordered [name, value] pairs with duplicates, values unfolded
+	// but not RFC 2047 decoded (default: false)
+	OrderedHeaders bool `mapstructure:"ordered_headers"`
+
+	// Prepend a Received trace header for this server before parsing (default: false)
+	AddReceivedHeader bool `mapstructure:"add_received_header"`
+
+	// Record the sequence of SMTP commands issued by the client, the full trace is
+	// sent with a CONNECTION_CLOSED event when the connection ends (default: false)
+	TraceCommands bool `mapstructure:"trace_commands"`
+
+	// Close the connection with 421 after this many unknown/invalid commands (default: 0, disabled).
+	// go-smtp itself closes after 4 protocol errors, so only lower values take effect.
+	MaxInvalidCommands   int    `mapstructure:"max_invalid_commands"`
+	InvalidCommandsReply string `mapstructure:"invalid_commands_reply"`
+
+	// Record MAIL FROM/RCPT TO lines exactly as sent by the client (default: false)
+	CaptureRawCommands bool `mapstructure:"capture_raw_commands"`
+
+	// Accept duplicate RCPT TO addresses without adding them twice (default: true)
+	DedupeRecipients *bool `mapstructure:"dedupe_recipients"`
+
+	// DNSBL zones to query for the client IP, e.g. "zen.spamhaus.org" (default: none)
+	DNSBLZones []string `mapstructure:"dnsbl_zones"`
+	// "reject" refuses listed clients with 554, "flag" only marks the event (default: flag)
+	DNSBLPolicy string `mapstructure:"dnsbl_policy"`
+	// Timeout for all DNSBL lookups of one client (default: 2s)
+	DNSBLTimeout time.Duration `mapstructure:"dnsbl_timeout"`
+
+	// Max DNS queries in flight across all DNS based checks, 0 for unlimited (default: 32)
+	MaxConcurrentDNS int `mapstructure:"max_concurrent_dns"`
+	// Timeout of a single DNS query (default: 2s)
+	DNSTimeout time.Duration `mapstructure:"dns_timeout"`
+	// How long DNS answers are cached (default: 5m)
+	DNSCacheTTL time.Duration `mapstructure:"dns_cache_ttl"`
+
+	// Resolve the client IP to its PTR host name, sent as remoteHost (default: false)
+	RDNS bool `mapstructure:"rdns"`
+
+	// SPF check of the MAIL FROM domain against the client IP
+	SPF SPFConfig `mapstructure:"spf"`
+
+	// DKIM signature verification of received messages
+	DKIM DKIMConfig `mapstructure:"dkim"`
+
+	// Per client IP connection and message rates
+	RateLimit RateLimitConfig `mapstructure:"rate_limit"`
+
+	// Client networks refused (deny_cidrs) or exclusively accepted (allow_cidrs) with 554
+	// instead of the greeting, deny wins over allow, empty allow_cidrs allows all (default: none)
+	AllowCIDRs []string `mapstructure:"allow_cidrs"`
+	DenyCIDRs  []string `mapstructure:"deny_cidrs"`
+
+	allowNets []*net.IPNet
+	denyNets  []*net.IPNet
+
+	// Log a warning when parsing a message takes longer than this (default: 0, disabled)
+	SlowParseThreshold time.Duration `mapstructure:"slow_parse_threshold"`
+	// Also send a SLOW_PARSE event to workers (default: false)
+	SlowParseEvent bool `mapstructure:"slow_parse_event"`
+
+	// Ask workers about every new connection with a CONNECTION_OPENED event on
+	// its first HELO/EHLO, a CLOSE or REJECT response refuses the client with
+	// 554, a reject or defer decision or a custom reply with its own code, and
+	// closes the connection (default: false)
+	ConnectEvent bool `mapstructure:"connect_event"`
+
+	// Ask workers about every sender with a MAIL_FROM event, REJECT or a custom
+	// reply like "550 5.1.0 Sender rejected" refuses it (default: false)
+	EnableMailCallback bool `mapstructure:"enable_mail_callback"`
+
+	// Ask workers about every recipient with a RCPT_TO event, a refusal rejects
+	// that recipient only (default: false)
+	EnableRcptCallback bool `mapstructure:"enable_rcpt_callback"`
+
+	// Delay the 220 greeting and reject clients talking before it with 554 (default: 0, disabled)
+	BannerDelay time.Duration `mapstructure:"banner_delay"`
+
+	// Use canonical MIME casing for header names in the headers map,
+	// false keeps the casing sent on the wire (default: true)
+	CanonicalizeHeaders *bool `mapstructure:"canonicalize_headers"`
+
+	// Maximum number of messages parsed at once (default: 0, unlimited)
+	ParseConcurrency int `mapstructure:"parse_concurrency"`
+	// How long a message waits for a parse slot before 451 (default: 5s)
+	ParseQueueTimeout time.Duration `mapstructure:"parse_queue_timeout"`
+
+	// Detect the body language and set it on the event (default: false)
+	DetectLanguage bool `mapstructure:"detect_language"`
+
+	// Render HTML-only bodies to plain text in bodyTextExtracted (default: false)
+	HTMLToText bool `mapstructure:"html_to_text"`
+
+	// Reply texts below accept {hostname}, {helo}, {ip} and {date} placeholders.
+	// Text of the 221 reply to QUIT (default: go-smtp's "Bye")
+	QuitMessage string `mapstructure:"quit_message"`
+
+	// Text of the 220 greeting (default: go-smtp's "<hostname> ESMTP Service Ready")
+	Banner string `mapstructure:"banner"`
+	// First line of the EHLO/HELO reply (default: go-smtp's "Hello <helo>")
+	EhloGreeting string `mapstructure:"ehlo_greeting"`
+	// Mimic an MTA: "postfix", "exim", "exchange" or "sendmail" (default: none).
+	// Sets banner, ehlo_greeting, quit_message, honeypot_reject.message and
+	// the advertised extensions unless configured explicitly.
+	Emulate string `mapstructure:"emulate"`
+
+	// Add per-phase durations, including the worker time of the earlier messages
+	// of the connection, to the event (default: false)
+	EmitTiming bool `mapstructure:"emit_timing"`
+
+	// Regex rewrites applied in order to RCPT TO addresses (default: none)
+	RewriteRules []RewriteRule `mapstructure:"rewrite_rules"`
+
+	// Directory to spool asynchronously delivered events to until a worker accepts them,
+	// leftovers are replayed on start (default: "", disabled)
+	SpoolDir string `mapstructure:"spool_dir"`
+	// Maximum number of spooled events, further events are not spooled (default: 0, unlimited)
+	SpoolMaxFiles int `mapstructure:"spool_max_files"`
+
+	// Maximum number of attachment temp files written at once, others queue (default: 0, unlimited)
+	MaxConcurrentAttachmentWrites int `mapstructure:"max_concurrent_attachment_writes"`
+
+	// How captured AUTH passwords are stored in events: "plain", "hashed" (HMAC-SHA256),
+	// "tokenized" (short opaque token) or "none" (no username or password) (default: plain)
+	CredentialStorage string `mapstructure:"credential_storage"`
+	// HMAC key for hashed/tokenized storage, keeps values stable across restarts
+	// (default: random per process)
+	CredentialKey string `mapstructure:"credential_key"`
+
+	// Reply 421 and close after this many messages on one connection (default: 0, unlimited)
+	MaxMessagesPerConnection int `mapstructure:"max_messages_per_connection"`
+
+	// Directory for messages the worker answered with QUARANTINE, kept until removed
+	// externally (default: "", quarantined messages are only counted and logged)
+	QuarantineDir string `mapstructure:"quarantine_dir"`
+
+	// Gzip and base64 encode textBody and htmlBody when together larger than this
+	// many bytes, setting bodyEncoding (default: 0, disabled)
+	CompressBodyOver int64 `mapstructure:"compress_body_over"`
+
+	// Accept MAIL FROM without AUTH, false replies 530 until the client
+	// authenticates (default: true)
+	AllowAnonymous *bool `mapstructure:"allow_anonymous"`
+
+	// Bytes a message may exceed its declared SIZE before it is flagged (default: 0)
+	SizeMismatchTolerance int64 `mapstructure:"size_mismatch_tolerance"`
+	// Reject flagged messages with 552 instead of only flagging them (default: false)
+	SizeMismatchReject bool `mapstructure:"size_mismatch_reject"`
+
+	// Parse text/calendar parts into a structured calendar object (default: false)
+	ParseCalendar bool `mapstructure:"parse_calendar"`
+
+	// Replace Date headers further than clamp_future_date_skew in the future with the receive time (default: false)
+	ClampFutureDate bool `mapstructure:"clamp_future_date"`
+	// Allowed clock skew before a Date counts as in the future (default: 24h)
+	ClampFutureDateSkew time.Duration `mapstructure:"clamp_future_date_skew"`
 }
 
 // AttachmentConfig configures how attachments are stored
 type AttachmentConfig struct {
-	Mode         string        `mapstructure:"mode"`          // "memory" or "tempfile"
+	Mode         string        `mapstructure:"mode"`          // "memory", "tempfile", "s3" or "none"
 	TempDir      string        `mapstructure:"temp_dir"`      // for tempfile mode
 	CleanupAfter time.Duration `mapstructure:"cleanup_after"` // auto-cleanup temp files
+
+	// Keep a metadata entry with dropped: true for attachments that could not be delivered
+	DroppedStubs bool `mapstructure:"dropped_stubs"`
+
+	// Object store for s3 mode
+	S3 S3Config `mapstructure:"s3"`
+}
+
+// S3Config configures uploads to S3 or an S3 compatible store (attachment_storage.mode: s3)
+type S3Config struct {
+	Bucket         string        `mapstructure:"bucket"`
+	Region         string        `mapstructure:"region"`           // default: us-east-1
+	Prefix         string        `mapstructure:"prefix"`           // prepended to object keys
+	Endpoint       string        `mapstructure:"endpoint"`         // e.g. "http://minio:9000", default: AWS
+	ForcePathStyle bool          `mapstructure:"force_path_style"` // bucket in the path instead of the host name, for MinIO
+	AccessKey      string        `mapstructure:"access_key"`       // default: AWS_ACCESS_KEY_ID
+	SecretKey      string        `mapstructure:"secret_key"`       // default: AWS_SECRET_ACCESS_KEY
+	Timeout        time.Duration `mapstructure:"timeout"`          // per upload (default: 30s)
+}
+
+// DeliveryFilterConfig selects which messages are forwarded to workers.
+// Non-matching messages are still accepted with 250.
+type DeliveryFilterConfig struct {
+	HasAttachments bool     `mapstructure:"has_attachments"`
+	AuthAttempted  bool     `mapstructure:"auth_attempted"`
+	Recipients     []string `mapstructure:"recipients"` // addresses or "@domain"
+}
+
+// HoneypotRejectConfig configures the final response in honeypot mode
+type HoneypotRejectConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Code    int    `mapstructure:"code"`    // SMTP reply code, e.g. 550
+	Message string `mapstructure:"message"` // SMTP reply text
+}
+
+// TLSConfig configures the STARTTLS certificate
+type TLSConfig struct {
+	CertFile   string `mapstructure:"cert_file"`
+	KeyFile    string `mapstructure:"key_file"`
+	MinVersion string `mapstructure:"min_version"` // "1.0" to "1.3" (default: "1.2")
+
+	// Client certificates: "none", "request" or "require". Certificates are
+	// not verified, the worker decides on clientCert (default: "none")
+	ClientAuth string `mapstructure:"client_auth"`
+}
+
+// SPFConfig configures the SPF check, the result is sent as spfResult
+type SPFConfig struct {
+	Enabled bool          `mapstructure:"enabled"`
+	Timeout time.Duration `mapstructure:"timeout"`  // whole evaluation, started at MAIL FROM (default: 5s)
+	MaxWait time.Duration `mapstructure:"max_wait"` // DATA waits at most this long for a running check, temperror after (default: 1s)
+
+	// Refuse MAIL FROM with 550 5.7.23 when the result is fail, MAIL FROM then
+	// waits for the check. softfail and neutral are only reported (default: false)
+	Reject bool `mapstructure:"reject"`
+}
+
+// DKIMConfig configures DKIM verification, results are sent as dkim
+type DKIMConfig struct {
+	Enabled bool          `mapstructure:"enabled"`
+	Timeout time.Duration `mapstructure:"timeout"` // key lookups of one message (default: 5s)
+}
+
+// RateLimitConfig configures the per client IP token buckets, 0 disables a limit
+type RateLimitConfig struct {
+	ConnectionsPerMinute int `mapstructure:"connections_per_minute"` // one token per connection, over the limit: 421 at HELO/EHLO (default: 0)
+	MessagesPerMinute    int `mapstructure:"messages_per_minute"`    // over the limit: 451 at DATA (default: 0)
+}
+
+// RewriteRule replaces recipient addresses matching a regular expression.
+// Replace may reference groups, e.g. match `^(.+)\+.*@(.+)$`, replace `$1@$2`.
+type RewriteRule struct {
+	Match   string `mapstructure:"match"`
+	Replace string `mapstructure:"replace"`
+
+	re *regexp.Regexp
 }
 
 // InitDefaults sets default values for configuration
@@ -55,6 +365,55 @@ func (c *Config) InitDefaults() error {
 		c.MaxMessageSize = 10 * 1024 * 1024 // 10MB
 	}
 
+	if c.MaxRecipients == 0 {
+		c.MaxRecipients = 100
+	}
+
+	if c.InvalidCommandsReply == "" {
+		c.InvalidCommandsReply = "Too many invalid commands, closing connection"
+	}
+
+	if c.DefaultCharset == "" {
+		c.DefaultCharset = "utf-8"
+	}
+
+	if c.OversizePolicy == "" {
+		c.OversizePolicy = "reject"
+	}
+
+	if c.TCPKeepalive == nil {
+		keepalive := true
+		c.TCPKeepalive = &keepalive
+	}
+
+	if c.TCPKeepaliveInterval == 0 {
+		c.TCPKeepaliveInterval = 15 * time.Second
+	}
+
+	// Domain names are matched case-insensitively
+	if len(c.DomainLimits) > 0 {
+		limits := make(map[string]int64, len(c.DomainLimits))
+		for domain, limit := range c.DomainLimits {
+			limits[strings.ToLower(domain)] = limit
+		}
+		c.DomainLimits = limits
+	}
+
+	if c.DedupeRecipients == nil {
+		dedupe := true
+		c.DedupeRecipients = &dedupe
+	}
+
+	if c.AllowAnonymous == nil {
+		anonymous := true
+		c.AllowAnonymous = &anonymous
+	}
+
+	if c.CanonicalizeHeaders == nil {
+		canonical := true
+		c.CanonicalizeHeaders = &canonical
+	}
+
 	// Attachment defaults
 	if c.AttachmentStorage.Mode == "" {
 		c.AttachmentStorage.Mode = "memory"
@@ -68,12 +427,92 @@ func (c *Config) InitDefaults() error {
 		c.AttachmentStorage.CleanupAfter = 1 * time.Hour
 	}
 
+	if c.AttachmentStorage.S3.Region == "" {
+		c.AttachmentStorage.S3.Region = "us-east-1"
+	}
+
+	if c.AttachmentStorage.S3.Timeout == 0 {
+		c.AttachmentStorage.S3.Timeout = 30 * time.Second
+	}
+
+	if c.ShutdownCode == 0 {
+		c.ShutdownCode = 421
+	}
+
+	// Honeypot defaults
+	if c.HoneypotReject.Code == 0 {
+		c.HoneypotReject.Code = 550
+	}
+
+	// Emulation presets go before the remaining response defaults
+	c.applyEmulation()
+
+	if c.HoneypotReject.Message == "" {
+		c.HoneypotReject.Message = "Requested action not taken: mailbox unavailable"
+	}
+
 	// Pool defaults
 	if c.Pool == nil {
 		c.Pool = &pool.Config{}
 	}
 	c.Pool.InitDefaults()
 
+	if c.WorkerReadyTimeout == 0 {
+		c.WorkerReadyTimeout = 30 * time.Second
+	}
+
+	if c.CredentialStorage == "" {
+		c.CredentialStorage = "plain"
+	}
+
+	if c.ParseQueueTimeout == 0 {
+		c.ParseQueueTimeout = 5 * time.Second
+	}
+
+	if c.TLS.MinVersion == "" {
+		c.TLS.MinVersion = "1.2"
+	}
+
+	if c.TLS.ClientAuth == "" {
+		c.TLS.ClientAuth = "none"
+	}
+
+	if c.DNSBLPolicy == "" {
+		c.DNSBLPolicy = "flag"
+	}
+
+	if c.DNSBLTimeout == 0 {
+		c.DNSBLTimeout = 2 * time.Second
+	}
+
+	if c.ClampFutureDateSkew == 0 {
+		c.ClampFutureDateSkew = 24 * time.Hour
+	}
+
+	if c.MaxConcurrentDNS == 0 {
+		c.MaxConcurrentDNS = 32
+	}
+
+	if c.DNSTimeout == 0 {
+		c.DNSTimeout = 2 * time.Second
+	}
+
+	if c.DNSCacheTTL == 0 {
+		c.DNSCacheTTL = 5 * time.Minute
+	}
+
+	if c.SPF.Timeout == 0 {
+		c.SPF.Timeout = 5 * time.Second
+	}
+
+	if c.SPF.MaxWait == 0 {
+		c.SPF.MaxWait = time.Second
+	}
+
+	if c.DKIM.Timeout == 0 {
+		c.DKIM.Timeout = 5 * time.Second
+	}
+
 	return c.validate()
 }
 
@@ -89,9 +528,315 @@ func (c *Config) validate() error {
 		return errors.E(op, errors.Str("max_message_size cannot be negative"))
 	}
 
-	if c.AttachmentStorage.Mode != "memory" && c.AttachmentStorage.Mode != "tempfile" {
-		return errors.E(op, errors.Str("attachment_storage.mode must be 'memory' or 'tempfile'"))
+	if c.MaxRecipients <= 0 {
+		return errors.E(op, errors.Str("max_recipients must be positive"))
+	}
+
+	if c.MaxConnections < 0 {
+		return errors.E(op, errors.Str("max_connections cannot be negative"))
+	}
+
+	if c.MaxAttachmentSize < 0 {
+		return errors.E(op, errors.Str("max_attachment_size cannot be negative"))
+	}
+
+	if c.MaxAttachments < 0 {
+		return errors.E(op, errors.Str("max_attachments cannot be negative"))
+	}
+
+	switch c.AttachmentStorage.Mode {
+	case "memory", "tempfile", "none":
+	case "s3":
+		if c.AttachmentStorage.S3.Bucket == "" {
+			return errors.E(op, errors.Str("attachment_storage.s3.bucket is required in s3 mode"))
+		}
+		if c.AttachmentStorage.S3.Timeout < 0 {
+			return errors.E(op, errors.Str("attachment_storage.s3.timeout cannot be negative"))
+		}
+	default:
+		return errors.E(op, errors.Str("attachment_storage.mode must be 'memory', 'tempfile', 's3' or 'none'"))
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return errors.E(op, errors.Str("tls.cert_file and tls.key_file must be set together"))
+	}
+
+	if _, ok := tlsVersions[c.TLS.MinVersion]; !ok {
+		return errors.E(op, errors.Errorf("unknown tls.min_version %q", c.TLS.MinVersion))
+	}
+
+	if _, ok := tlsClientAuth[c.TLS.ClientAuth]; !ok {
+		return errors.E(op, errors.Str("tls.client_auth must be 'none', 'request' or 'require'"))
+	}
+
+	if c.RequireTLS && !c.TLS.enabled() {
+		return errors.E(op, errors.Str("require_tls needs tls.cert_file and tls.key_file"))
+	}
+
+	if c.TLSAddr != "" && !c.TLS.enabled() {
+		return errors.E(op, errors.Str("tls_addr needs tls.cert_file and tls.key_file"))
+	}
+
+	if c.MaxInvalidCommands < 0 {
+		return errors.E(op, errors.Str("max_invalid_commands cannot be negative"))
+	}
+
+	if !isUTF8Compatible(c.DefaultCharset) {
+		if _, err := htmlindex.Get(c.DefaultCharset); err != nil {
+			return errors.E(op, errors.Errorf("unknown default_charset %q", c.DefaultCharset))
+		}
+	}
+
+	if c.MaxWorkerPayload < 0 {
+		return errors.E(op, errors.Str("max_worker_payload cannot be negative"))
+	}
+
+	if c.MaxDecodedBytes < 0 {
+		return errors.E(op, errors.Str("max_decoded_bytes cannot be negative"))
+	}
+
+	if c.OversizePolicy != "reject" && c.OversizePolicy != "truncate" {
+		return errors.E(op, errors.Str("oversize_policy must be 'reject' or 'truncate'"))
+	}
+
+	if c.DNSBLPolicy != "reject" && c.DNSBLPolicy != "flag" {
+		return errors.E(op, errors.Str("dnsbl_policy must be 'reject' or 'flag'"))
+	}
+
+	if c.DNSBLTimeout < 0 {
+		return errors.E(op, errors.Str("dnsbl_timeout cannot be negative"))
+	}
+
+	if c.ClampFutureDateSkew < 0 {
+		return errors.E(op, errors.Str("clamp_future_date_skew cannot be negative"))
+	}
+
+	if c.MaxConcurrentDNS < 0 {
+		return errors.E(op, errors.Str("max_concurrent_dns cannot be negative"))
+	}
+
+	if c.DNSTimeout < 0 {
+		return errors.E(op, errors.Str("dns_timeout cannot be negative"))
+	}
+
+	if c.DNSCacheTTL < 0 {
+		return errors.E(op, errors.Str("dns_cache_ttl cannot be negative"))
+	}
+
+	if c.SPF.Timeout < 0 || c.SPF.MaxWait < 0 {
+		return errors.E(op, errors.Str("spf.timeout and spf.max_wait cannot be negative"))
+	}
+
+	if c.DKIM.Timeout < 0 {
+		return errors.E(op, errors.Str("dkim.timeout cannot be negative"))
+	}
+
+	if c.RateLimit.ConnectionsPerMinute < 0 || c.RateLimit.MessagesPerMinute < 0 {
+		return errors.E(op, errors.Str("rate_limit values cannot be negative"))
+	}
+
+	if _, ok := mtaPresets[c.Emulate]; c.Emulate != "" && !ok {
+		return errors.E(op, errors.Str("emulate must be 'postfix', 'exim', 'exchange' or 'sendmail'"))
+	}
+
+	var err error
+	if c.allowNets, err = parseCIDRs(c.AllowCIDRs); err != nil {
+		return errors.E(op, errors.Errorf("allow_cidrs: %v", err))
+	}
+	if c.denyNets, err = parseCIDRs(c.DenyCIDRs); err != nil {
+		return errors.E(op, errors.Errorf("deny_cidrs: %v", err))
+	}
+
+	for i := range c.RewriteRules {
+		re, err := regexp.Compile(c.RewriteRules[i].Match)
+		if err != nil {
+			return errors.E(op, errors.Errorf("rewrite_rules[%d].match: %v", i, err))
+		}
+		c.RewriteRules[i].re = re
+	}
+
+	switch c.CredentialStorage {
+	case "plain", "hashed", "tokenized", "none":
+	default:
+		return errors.E(op, errors.Str("credential_storage must be 'plain', 'hashed', 'tokenized' or 'none'"))
+	}
+
+	if c.SizeMismatchTolerance < 0 {
+		return errors.E(op, errors.Str("size_mismatch_tolerance cannot be negative"))
+	}
+
+	if c.CompressBodyOver < 0 {
+		return errors.E(op, errors.Str("compress_body_over cannot be negative"))
+	}
+
+	if c.MaxMessagesPerConnection < 0 {
+		return errors.E(op, errors.Str("max_messages_per_connection cannot be negative"))
+	}
+
+	if c.MaxConcurrentAttachmentWrites < 0 {
+		return errors.E(op, errors.Str("max_concurrent_attachment_writes cannot be negative"))
+	}
+
+	if c.SpoolMaxFiles < 0 {
+		return errors.E(op, errors.Str("spool_max_files cannot be negative"))
+	}
+
+	if c.ParseConcurrency < 0 {
+		return errors.E(op, errors.Str("parse_concurrency cannot be negative"))
+	}
+
+	if c.BannerDelay < 0 {
+		return errors.E(op, errors.Str("banner_delay cannot be negative"))
+	}
+
+	if c.SlowParseThreshold < 0 {
+		return errors.E(op, errors.Str("slow_parse_threshold cannot be negative"))
+	}
+
+	if c.TCPKeepaliveInterval < 0 {
+		return errors.E(op, errors.Str("tcp_keepalive_interval cannot be negative"))
+	}
+
+	for domain, limit := range c.DomainLimits {
+		if limit <= 0 {
+			return errors.E(op, errors.Errorf("domain_limits.%s must be positive", domain))
+		}
+	}
+
+	if c.WaitForWorkers < 0 {
+		return errors.E(op, errors.Str("wait_for_workers cannot be negative"))
+	}
+
+	if uint64(c.WaitForWorkers) > c.Pool.NumWorkers {
+		return errors.E(op, errors.Str("wait_for_workers cannot exceed pool.num_workers"))
+	}
+
+	if c.ShutdownCode < 400 || c.ShutdownCode > 599 {
+		return errors.E(op, errors.Str("shutdown_code must be a 4xx or 5xx SMTP code"))
+	}
+
+	if c.HoneypotReject.Code < 400 || c.HoneypotReject.Code > 599 {
+		return errors.E(op, errors.Str("honeypot_reject.code must be a 4xx or 5xx SMTP code"))
 	}
 
 	return nil
 }
+
+// maxAcceptedMessageSize returns the largest message size any recipient may receive,
+// used as the hard protocol-level limit. Truncation needs the whole stream, so no limit then.
+func (c *Config) maxAcceptedMessageSize() int64 {
+	if c.OversizePolicy == "truncate" {
+		return 0
+	}
+
+	size := c.MaxMessageSize
+	for _, limit := range c.DomainLimits {
+		if limit > size {
+			size = limit
+		}
+	}
+	return size
+}
+
+// parseCIDRs parses networks in CIDR notation, plain addresses match only themselves
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errors.Errorf("invalid address %q", cidr)
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, network)
+	}
+	return nets, nil
+}
+
+// clientAllowed applies deny_cidrs and allow_cidrs to a client IP. Clients
+// without an IP (unix sockets) match no network, allow_cidrs refuses them.
+func (c *Config) clientAllowed(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return len(c.allowNets) == 0
+	}
+
+	for _, network := range c.denyNets {
+		if network.Contains(addr) {
+			return false
+		}
+	}
+
+	if len(c.allowNets) == 0 {
+		return true
+	}
+	for _, network := range c.allowNets {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteRecipient applies rewrite_rules to a recipient address in order
+func (c *Config) rewriteRecipient(rcpt string) string {
+	for _, rule := range c.RewriteRules {
+		rcpt = rule.re.ReplaceAllString(rcpt, rule.Replace)
+	}
+	return rcpt
+}
+
+// messageSizeLimit returns the size limit applicable to a single recipient
+func (c *Config) messageSizeLimit(rcpt string) int64 {
+	if limit, ok := c.DomainLimits[addressDomain(rcpt)]; ok {
+		return limit
+	}
+	return c.MaxMessageSize
+}
+
+// messageSizeLimitFor returns the most restrictive size limit for a set of recipients
+func (c *Config) messageSizeLimitFor(rcpts []string) int64 {
+	if len(rcpts) == 0 {
+		return c.MaxMessageSize
+	}
+
+	size := c.messageSizeLimit(rcpts[0])
+	for _, rcpt := range rcpts[1:] {
+		if limit := c.messageSizeLimit(rcpt); limit < size {
+			size = limit
+		}
+	}
+	return size
+}
+
+// guardsConnections reports whether connections are wrapped in a guardedConn,
+// which watches and rewrites the SMTP dialog on the wire
+func (c *Config) guardsConnections() bool {
+	return c.MaxInvalidCommands > 0 || c.CaptureRawCommands || c.BannerDelay > 0 ||
+		c.Banner != "" || c.EhloGreeting != "" || c.QuitMessage != "" || c.Emulate != ""
+}
+
+// keepAlivePeriod returns the net.ListenConfig KeepAlive value, negative disables probes
+func (c *Config) keepAlivePeriod() time.Duration {
+	if !*c.TCPKeepalive {
+		return -1
+	}
+	return c.TCPKeepaliveInterval
+}
+
+// usesTempFiles reports whether attachments may be written to temp_dir
+func (c *Config) usesTempFiles() bool {
+	// Oversized events move attachments to temp files in any mode
+	return c.AttachmentStorage.Mode == "tempfile" || c.MaxWorkerPayload > 0
+}
@@ -0,0 +1,51 @@
+package smtp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSConfigValidation(t *testing.T) {
+	for name, tc := range map[string]struct {
+		configure func(cfg *Config)
+		err       string
+	}{
+		"cert without key": {
+			func(cfg *Config) { cfg.TLS.CertFile = "cert.pem" },
+			"tls.cert_file and tls.key_file must be set together",
+		},
+		"key without cert": {
+			func(cfg *Config) { cfg.TLS.KeyFile = "key.pem" },
+			"tls.cert_file and tls.key_file must be set together",
+		},
+		"require_tls without certificate": {
+			func(cfg *Config) { cfg.RequireTLS = true },
+			"require_tls needs tls.cert_file and tls.key_file",
+		},
+		"unknown min_version": {
+			func(cfg *Config) { cfg.TLS.MinVersion = "1.4" },
+			`unknown tls.min_version "1.4"`,
+		},
+		"unknown client_auth": {
+			func(cfg *Config) { cfg.TLS.ClientAuth = "verify" },
+			"tls.client_auth must be",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := &Config{}
+			tc.configure(cfg)
+			err := cfg.InitDefaults()
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.err)
+		})
+	}
+
+	certFile, keyFile := testCertificate(t)
+	cfg := &Config{TLS: TLSConfig{CertFile: certFile, KeyFile: keyFile}, RequireTLS: true}
+	require.NoError(t, cfg.InitDefaults())
+
+	tlsConfig, err := cfg.TLS.build()
+	require.NoError(t, err)
+	require.Len(t, tlsConfig.Certificates, 1)
+}
@@ -0,0 +1,50 @@
+package smtp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// credentialKey returns the HMAC key for credential_storage,
+// a random per-process key when credential_key is not configured
+func credentialKey(configured string) ([]byte, error) {
+	if configured != "" {
+		return []byte(configured), nil
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// protectCredential transforms a captured password according to credential_storage:
+// "plain" keeps it, "hashed" stores its HMAC-SHA256 and "tokenized" a short opaque
+// token. Both derived forms are stable for the same key, so reuse stays detectable.
+// With "none" no password is captured in the first place.
+func (p *Plugin) protectCredential(password string) string {
+	if password == "" {
+		return ""
+	}
+
+	switch p.cfg.CredentialStorage {
+	case "hashed":
+		return "hmac-sha256:" + hex.EncodeToString(p.credentialMAC("hash", password))
+	case "tokenized":
+		return "tok_" + hex.EncodeToString(p.credentialMAC("token", password)[:8])
+	default:
+		return password
+	}
+}
+
+// credentialMAC computes a domain-separated HMAC of a credential
+func (p *Plugin) credentialMAC(purpose, password string) []byte {
+	mac := hmac.New(sha256.New, p.credentialKey)
+	mac.Write([]byte(purpose))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
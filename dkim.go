@@ -0,0 +1,357 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1" //nolint:gosec // rsa-sha1 signatures are still verified
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"hash"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DKIM verification statuses
+const (
+	dkimPass      = "pass"
+	dkimFail      = "fail"
+	dkimTempError = "temperror"
+)
+
+// dkimMaxSignatures bounds the signatures verified per message
+const dkimMaxSignatures = 5
+
+// DKIMResult is the outcome of verifying one DKIM-Signature header
+type DKIMResult struct {
+	Domain   string `json:"domain"`          // d= tag
+	Selector string `json:"selector"`        // s= tag
+	Status   string `json:"status"`          // pass, fail or temperror
+	Error    string `json:"error,omitempty"` // why the signature did not pass
+}
+
+// verifyDKIM checks the DKIM signatures of a raw message, nil when unsigned.
+// It must see the message exactly as received, before any rewriting.
+func (s *Session) verifyDKIM(raw []byte) []DKIMResult {
+	rawHeader, body := splitRawMessage(raw)
+	fields := splitRawHeaderLines(rawHeader)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.backend.plugin.cfg.DKIM.Timeout)
+	defer cancel()
+
+	var results []DKIMResult
+	for i, field := range fields {
+		name, _, _ := strings.Cut(field, ":")
+		if !strings.EqualFold(strings.TrimSpace(name), "DKIM-Signature") {
+			continue
+		}
+		if len(results) == dkimMaxSignatures {
+			break
+		}
+		results = append(results, s.verifyDKIMSignature(ctx, fields, i, body))
+	}
+	return results
+}
+
+// verifyDKIMSignature verifies the signature in fields[idx]
+func (s *Session) verifyDKIMSignature(ctx context.Context, fields []string, idx int, body []byte) DKIMResult {
+	_, value, _ := strings.Cut(fields[idx], ":")
+	tags := parseDKIMTags(value)
+
+	result := DKIMResult{Domain: tags["d"], Selector: tags["s"], Status: dkimFail}
+	fail := func(reason string) DKIMResult {
+		result.Error = reason
+		return result
+	}
+
+	if tags["v"] != "1" {
+		return fail("unsupported version")
+	}
+	if result.Domain == "" || result.Selector == "" || tags["h"] == "" || tags["b"] == "" || tags["bh"] == "" {
+		return fail("missing required tag")
+	}
+	if !dkimListHas(tags["h"], "from") {
+		return fail("From not signed")
+	}
+	identity, hasIdentity := tags["i"]
+	if hasIdentity && !dkimIdentityInDomain(identity, result.Domain, false) {
+		return fail("identity outside signing domain")
+	}
+	if x, ok := tags["x"]; ok {
+		expires, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return fail("invalid expiration")
+		}
+		if signed, err := strconv.ParseInt(tags["t"], 10, 64); err == nil && expires <= signed {
+			return fail("invalid expiration")
+		}
+		if time.Now().Unix() > expires {
+			return fail("signature expired")
+		}
+	}
+
+	var (
+		hashAlg  crypto.Hash
+		hashName string
+		newHash  func() hash.Hash
+		keyType  string
+	)
+	switch strings.ToLower(tags["a"]) {
+	case "rsa-sha256":
+		hashAlg, hashName, newHash, keyType = crypto.SHA256, "sha256", sha256.New, "rsa"
+	case "rsa-sha1":
+		hashAlg, hashName, newHash, keyType = crypto.SHA1, "sha1", sha1.New, "rsa"
+	case "ed25519-sha256":
+		hashAlg, hashName, newHash, keyType = crypto.SHA256, "sha256", sha256.New, "ed25519"
+	default:
+		return fail("unsupported algorithm")
+	}
+
+	headerCanon, bodyCanon := "simple", "simple"
+	if c := strings.ToLower(tags["c"]); c != "" {
+		h, b, ok := strings.Cut(c, "/")
+		headerCanon = h
+		if ok {
+			bodyCanon = b
+		}
+	}
+	if (headerCanon != "simple" && headerCanon != "relaxed") || (bodyCanon != "simple" && bodyCanon != "relaxed") {
+		return fail("unsupported canonicalization")
+	}
+
+	// Body hash
+	canonBody := canonicalizeDKIMBody(body, bodyCanon == "relaxed")
+	if l, ok := tags["l"]; ok {
+		n, err := strconv.ParseInt(l, 10, 64)
+		if err != nil || n < 0 || n > int64(len(canonBody)) {
+			return fail("invalid body length")
+		}
+		canonBody = canonBody[:n]
+	}
+	bh := newHash()
+	bh.Write(canonBody)
+	if base64.StdEncoding.EncodeToString(bh.Sum(nil)) != stripDKIMSpace(tags["bh"]) {
+		return fail("body hash mismatch")
+	}
+
+	// Header hash: signed fields bottom-up, then the signature with an empty b=
+	hh := newHash()
+	used := make(map[int]bool)
+	for _, name := range strings.Split(tags["h"], ":") {
+		name = strings.TrimSpace(name)
+		for i := len(fields) - 1; i >= 0; i-- {
+			fieldName, _, _ := strings.Cut(fields[i], ":")
+			if used[i] || i == idx || !strings.EqualFold(strings.TrimRight(fieldName, " \t"), name) {
+				continue
+			}
+			used[i] = true
+			hh.Write([]byte(canonicalizeDKIMHeader(fields[i], headerCanon == "relaxed") + "\r\n"))
+			break
+		}
+	}
+	hh.Write([]byte(canonicalizeDKIMHeader(removeDKIMSignatureValue(fields[idx]), headerCanon == "relaxed")))
+	digest := hh.Sum(nil)
+
+	sig, err := base64.StdEncoding.DecodeString(stripDKIMSpace(tags["b"]))
+	if err != nil {
+		return fail("invalid signature encoding")
+	}
+
+	// Public key from <selector>._domainkey.<domain>
+	txts, err := s.backend.plugin.dns.lookupTXT(ctx, result.Selector+"._domainkey."+result.Domain)
+	if err != nil {
+		result.Status = dkimTempError
+		return fail("key lookup failed")
+	}
+	if len(txts) == 0 {
+		return fail("no key for signature")
+	}
+	keyTags := parseDKIMTags(strings.Join(txts, ""))
+	if k := keyTags["k"]; k != "" && k != keyType {
+		return fail("key type mismatch")
+	}
+	if h := keyTags["h"]; h != "" && !dkimListHas(h, hashName) {
+		return fail("hash not allowed by key")
+	}
+	// t=s forbids identities in subdomains of d=
+	if hasIdentity && dkimListHas(keyTags["t"], "s") && !dkimIdentityInDomain(identity, result.Domain, true) {
+		return fail("subdomain identity not allowed by key")
+	}
+	keyData := stripDKIMSpace(keyTags["p"])
+	if keyData == "" {
+		return fail("key revoked")
+	}
+	keyBytes, err := base64.StdEncoding.DecodeString(keyData)
+	if err != nil {
+		return fail("invalid key encoding")
+	}
+
+	switch keyType {
+	case "ed25519":
+		if len(keyBytes) != ed25519.PublicKeySize {
+			return fail("invalid key")
+		}
+		if !ed25519.Verify(keyBytes, digest, sig) {
+			return fail("signature mismatch")
+		}
+	default:
+		pub, err := parseDKIMRSAKey(keyBytes)
+		if err != nil {
+			return fail("invalid key")
+		}
+		if rsa.VerifyPKCS1v15(pub, hashAlg, digest, sig) != nil {
+			return fail("signature mismatch")
+		}
+	}
+
+	result.Status = dkimPass
+	return result
+}
+
+// parseDKIMRSAKey parses a SubjectPublicKeyInfo or PKCS#1 RSA public key
+func parseDKIMRSAKey(der []byte) (*rsa.PublicKey, error) {
+	if pub, err := x509.ParsePKIXPublicKey(der); err == nil {
+		if rsaPub, ok := pub.(*rsa.PublicKey); ok {
+			return rsaPub, nil
+		}
+	}
+	return x509.ParsePKCS1PublicKey(der)
+}
+
+// dkimListHas reports whether a colon separated tag value contains item,
+// ignoring case and whitespace
+func dkimListHas(list, item string) bool {
+	for _, v := range strings.Split(list, ":") {
+		if strings.EqualFold(strings.TrimSpace(v), item) {
+			return true
+		}
+	}
+	return false
+}
+
+// dkimIdentityInDomain reports whether the domain of an i= identity is domain
+// or, unless exact, one of its subdomains
+func dkimIdentityInDomain(identity, domain string, exact bool) bool {
+	at := strings.LastIndexByte(identity, '@')
+	if at < 0 {
+		return false
+	}
+	idDomain := strings.ToLower(strings.TrimSpace(identity[at+1:]))
+	domain = strings.ToLower(domain)
+	return idDomain == domain || (!exact && strings.HasSuffix(idDomain, "."+domain))
+}
+
+// parseDKIMTags parses a "tag=value; tag=value" list
+func parseDKIMTags(value string) map[string]string {
+	tags := make(map[string]string)
+	for _, pair := range strings.Split(value, ";") {
+		name, val, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		tags[strings.TrimSpace(name)] = strings.TrimSpace(val)
+	}
+	return tags
+}
+
+// stripDKIMSpace removes folding whitespace from base64 tag values
+func stripDKIMSpace(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, value)
+}
+
+// removeDKIMSignatureValue empties the b= tag of a DKIM-Signature field,
+// keeping everything else byte for byte
+func removeDKIMSignatureValue(field string) string {
+	colon := strings.IndexByte(field, ':')
+	pos := colon + 1
+	for pos < len(field) {
+		end := strings.IndexByte(field[pos:], ';')
+		if end < 0 {
+			end = len(field)
+		} else {
+			end += pos
+		}
+
+		tag := field[pos:end]
+		if name, _, ok := strings.Cut(tag, "="); ok && strings.TrimSpace(name) == "b" {
+			eq := pos + strings.IndexByte(tag, '=') + 1
+			return field[:eq] + field[end:]
+		}
+		pos = end + 1
+	}
+	return field
+}
+
+// splitRawHeaderLines splits a raw header section into fields, keeping the
+// folding of each field with CRLF line breaks
+func splitRawHeaderLines(raw []byte) []string {
+	var fields []string
+	for _, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += "\r\n" + line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+// canonicalizeDKIMHeader applies the simple or relaxed header canonicalization
+// (RFC 6376 section 3.4) to one field, without the trailing CRLF
+func canonicalizeDKIMHeader(field string, relaxed bool) string {
+	if !relaxed {
+		return field
+	}
+
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = strings.Join(strings.FieldsFunc(value, func(r rune) bool {
+		return r == ' ' || r == '\t'
+	}), " ")
+	return strings.ToLower(strings.TrimRight(name, " \t")) + ":" + value
+}
+
+// canonicalizeDKIMBody applies the simple or relaxed body canonicalization
+// (RFC 6376 section 3.4)
+func canonicalizeDKIMBody(body []byte, relaxed bool) []byte {
+	lines := strings.Split(strings.ReplaceAll(string(body), "\r\n", "\n"), "\n")
+
+	var b bytes.Buffer
+	for _, line := range lines {
+		if relaxed {
+			fields := strings.FieldsFunc(line, func(r rune) bool {
+				return r == ' ' || r == '\t'
+			})
+			trailing := strings.TrimRight(line, " \t")
+			line = strings.Join(fields, " ")
+			if trailing != "" && (trailing[0] == ' ' || trailing[0] == '\t') {
+				line = " " + line
+			}
+		}
+		b.WriteString(line)
+		b.WriteString("\r\n")
+	}
+
+	// Trailing empty lines are ignored, simple keeps one CRLF for an empty body
+	canon := b.Bytes()
+	for bytes.HasSuffix(canon, []byte("\r\n\r\n")) {
+		canon = canon[:len(canon)-2]
+	}
+	if bytes.Equal(canon, []byte("\r\n")) && relaxed {
+		return nil
+	}
+	return canon
+}
@@ -0,0 +1,237 @@
+package smtp
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// rfc8463Message is the ed25519 and rsa signed example of RFC 8463 appendix A
+var rfc8463Message = crlf(
+	"DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;",
+	" d=football.example.com; i=@football.example.com;",
+	" q=dns/txt; s=brisbane; t=1528637909; h=from : to :",
+	" subject : date : message-id : from : subject : date;",
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;",
+	" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus",
+	" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==",
+	"DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed;",
+	" d=football.example.com; i=@football.example.com;",
+	" q=dns/txt; s=test; t=1528637909; h=from : to : subject :",
+	" date : message-id : from : subject : date;",
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;",
+	" b=F45dVWDfMbQDGHJFlXUNB2HKfbCeLRyhDXgFpEL8GwpsRe0IeIixNTe3",
+	" DhCVlUrSjV4BwcVcOF6+FF3Zo9Rpo1tFOeS9mPYQTnGdaSGsgeefOsk2Jz",
+	" dA+L10TeYt9BgDfQNZtKdN1WO//KgIqXP7OdEFE4LjFYNcUxZQ4FADY+8=",
+	"From: Joe SixPack <joe@football.example.com>",
+	"To: Suzie Q <suzie@shopping.example.net>",
+	"Subject: Is dinner ready?",
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)",
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>",
+	"",
+	"Hi.",
+	"",
+	"We lost the game.  Are you hungry yet?",
+	"",
+	"Joe.",
+	"",
+)
+
+// rfc8463Seed is the ed25519 private key of RFC 8463 appendix A
+const rfc8463Seed = "nWGxne/9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A="
+
+// dkimPlugin returns a plugin verifying DKIM with the RFC 8463 keys published,
+// the ed25519 key also under the selectors sha1 (h=sha1) and strict (t=s)
+func dkimPlugin(t *testing.T, configure func(cfg *Config)) (*Plugin, *testWorker) {
+	p, w := newTestPlugin(t, func(cfg *Config) {
+		cfg.DKIM.Enabled = true
+		if configure != nil {
+			configure(cfg)
+		}
+	})
+	dns := &fakeDNS{txt: map[string][]string{
+		"brisbane._domainkey.football.example.com": {"v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="},
+		"sha1._domainkey.football.example.com":     {"v=DKIM1; k=ed25519; h=sha1; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="},
+		"strict._domainkey.football.example.com":   {"v=DKIM1; k=ed25519; t=s; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="},
+		"test._domainkey.football.example.com":     {"v=DKIM1; k=rsa; p=MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQDkHlOQoBTzWRiGs5V6NpP3idY6Wk08a5qhdR6wy5bdOKb2jLQiY/J16JYi0Qvx/byYzCNb3W91y3FutACDfzwQ/BC/e/8uBsCR+yz1Lxj+PL6lHvqMKrM3rG4hstT5QjvHO9PzoxZyVYLzBfO2EeC3Ip3G+2kryOTIKT+l/K4w3QIDAQAB"},
+	}}
+	dns.install(p)
+	return p, w
+}
+
+// signSimple signs the From and Subject fields of header and body with
+// c=simple/simple using the RFC 8463 key, l < 0 signs the whole body. Tags
+// ("name=value") are added to the signature, replacing a default of that name.
+func signSimple(t *testing.T, header []string, body string, l int, tags ...string) string {
+	t.Helper()
+
+	seed, err := base64.StdEncoding.DecodeString(rfc8463Seed)
+	require.NoError(t, err)
+	key := ed25519.NewKeyFromSeed(seed)
+
+	canon := strings.TrimRight(body, "\r\n") + "\r\n"
+	names := []string{"v", "a", "c", "d", "s", "h"}
+	values := map[string]string{
+		"v": "1", "a": "ed25519-sha256", "c": "simple/simple",
+		"d": "football.example.com", "s": "brisbane", "h": "From:Subject",
+	}
+	if l >= 0 {
+		canon = canon[:l]
+		tags = append([]string{"l=" + strconv.Itoa(l)}, tags...)
+	}
+	for _, tag := range tags {
+		name, value, _ := strings.Cut(tag, "=")
+		if _, ok := values[name]; !ok {
+			names = append(names, name)
+		}
+		values[name] = value
+	}
+	bh := sha256.Sum256([]byte(canon))
+
+	field := "DKIM-Signature:"
+	for _, name := range names {
+		field += " " + name + "=" + values[name] + ";"
+	}
+	field += " bh=" + base64.StdEncoding.EncodeToString(bh[:]) + "; b="
+
+	var signed strings.Builder
+	for _, name := range strings.Split(values["h"], ":") {
+		for _, line := range header {
+			if strings.HasPrefix(line, name+":") {
+				signed.WriteString(line + "\r\n")
+			}
+		}
+	}
+	signed.WriteString(field)
+	digest := sha256.Sum256([]byte(signed.String()))
+
+	return crlf(append([]string{field + base64.StdEncoding.EncodeToString(ed25519.Sign(key, digest[:]))}, header...)...) +
+		"\r\n\r\n" + body
+}
+
+func dkimStatuses(results []DKIMResult) []string {
+	var out []string
+	for _, r := range results {
+		out = append(out, r.Status+" "+r.Error)
+	}
+	return out
+}
+
+func TestDKIMRelaxedKnownGood(t *testing.T) {
+	p, _ := dkimPlugin(t, nil)
+	s := newTestSession(p)
+
+	results := s.verifyDKIM([]byte(rfc8463Message))
+	require.Equal(t, []string{"pass ", "pass "}, dkimStatuses(results))
+	require.Equal(t, "brisbane", results[0].Selector)
+	require.Equal(t, "test", results[1].Selector)
+
+	// Relaxed canonicalization tolerates whitespace and folding changes
+	loose := strings.Replace(rfc8463Message, "Subject: Is dinner ready?", "subject:   Is dinner\r\n\tready?  ", 1)
+	loose = strings.Replace(loose, "the game.  Are", "the game. \t Are", 1)
+	loose = strings.Replace(loose, "Joe.\r\n", "Joe.  \r\n\r\n\r\n", 1)
+	require.Equal(t, []string{"pass ", "pass "}, dkimStatuses(s.verifyDKIM([]byte(loose))))
+}
+
+func TestDKIMRelaxedTampered(t *testing.T) {
+	p, _ := dkimPlugin(t, nil)
+	s := newTestSession(p)
+
+	body := strings.Replace(rfc8463Message, "hungry", "angry", 1)
+	require.Equal(t, []string{"fail body hash mismatch", "fail body hash mismatch"}, dkimStatuses(s.verifyDKIM([]byte(body))))
+
+	header := strings.Replace(rfc8463Message, "Is dinner ready?", "Is lunch ready?", 1)
+	require.Equal(t, []string{"fail signature mismatch", "fail signature mismatch"}, dkimStatuses(s.verifyDKIM([]byte(header))))
+}
+
+func TestDKIMSimple(t *testing.T) {
+	p, _ := dkimPlugin(t, nil)
+	s := newTestSession(p)
+
+	header := []string{"From: Joe <joe@football.example.com>", "Subject: Is dinner ready?"}
+	body := "Hi.\r\n\r\nWe lost the game.  Are you hungry yet?\r\n"
+	signed := signSimple(t, header, body, -1)
+
+	require.Equal(t, []string{"pass "}, dkimStatuses(s.verifyDKIM([]byte(signed))))
+	// Trailing empty lines are ignored
+	require.Equal(t, []string{"pass "}, dkimStatuses(s.verifyDKIM([]byte(signed+"\r\n\r\n"))))
+
+	// Simple canonicalization keeps whitespace exactly
+	tampered := strings.Replace(signed, "Subject: Is dinner", "Subject:  Is dinner", 1)
+	require.Equal(t, []string{"fail signature mismatch"}, dkimStatuses(s.verifyDKIM([]byte(tampered))))
+	tampered = strings.Replace(signed, "game.  Are", "game. Are", 1)
+	require.Equal(t, []string{"fail body hash mismatch"}, dkimStatuses(s.verifyDKIM([]byte(tampered))))
+}
+
+func TestDKIMBodyLength(t *testing.T) {
+	p, _ := dkimPlugin(t, nil)
+	s := newTestSession(p)
+
+	header := []string{"From: Joe <joe@football.example.com>", "Subject: Is dinner ready?"}
+	body := "Hi.\r\n"
+	signed := signSimple(t, header, body, len(body))
+
+	// Content appended after the signed length is not covered
+	require.Equal(t, []string{"pass "}, dkimStatuses(s.verifyDKIM([]byte(signed+"Appended.\r\n"))))
+
+	tampered := strings.Replace(signed, "Hi.", "Ho.", 1)
+	require.Equal(t, []string{"fail body hash mismatch"}, dkimStatuses(s.verifyDKIM([]byte(tampered))))
+
+	short := signSimple(t, header, "Hi.\r\nThere.\r\n", 12)
+	require.Equal(t, []string{"fail invalid body length"},
+		dkimStatuses(s.verifyDKIM([]byte(strings.Replace(short, "There.\r\n", "", 1)))))
+}
+
+func TestDKIMSignatureConstraints(t *testing.T) {
+	p, _ := dkimPlugin(t, nil)
+	s := newTestSession(p)
+
+	header := []string{"From: Joe <joe@football.example.com>", "Subject: Is dinner ready?"}
+	hour := int64(time.Hour / time.Second)
+	now := time.Now().Unix()
+
+	for name, tc := range map[string]struct {
+		tags []string
+		want string
+	}{
+		"expired":                 {[]string{"t=" + strconv.FormatInt(now-2*hour, 10), "x=" + strconv.FormatInt(now-hour, 10)}, "fail signature expired"},
+		"not expired":             {[]string{"t=" + strconv.FormatInt(now-hour, 10), "x=" + strconv.FormatInt(now+hour, 10)}, "pass "},
+		"expires before signed":   {[]string{"t=" + strconv.FormatInt(now+2*hour, 10), "x=" + strconv.FormatInt(now+hour, 10)}, "fail invalid expiration"},
+		"From not signed":         {[]string{"h=Subject"}, "fail From not signed"},
+		"identity in domain":      {[]string{"i=joe@football.example.com"}, "pass "},
+		"identity in subdomain":   {[]string{"i=@mail.football.example.com"}, "pass "},
+		"identity outside domain": {[]string{"i=joe@example.org"}, "fail identity outside signing domain"},
+		"identity lookalike":      {[]string{"i=@evilfootball.example.com"}, "fail identity outside signing domain"},
+		"key hash not allowed":    {[]string{"s=sha1"}, "fail hash not allowed by key"},
+		"strict key subdomain":    {[]string{"s=strict", "i=@mail.football.example.com"}, "fail subdomain identity not allowed by key"},
+		"strict key same domain":  {[]string{"s=strict", "i=@football.example.com"}, "pass "},
+	} {
+		t.Run(name, func(t *testing.T) {
+			signed := signSimple(t, header, "Hi.\r\n", -1, tc.tags...)
+			require.Equal(t, []string{tc.want}, dkimStatuses(s.verifyDKIM([]byte(signed))))
+		})
+	}
+}
+
+func TestDKIMSeesMessageBeforeBareCRNormalization(t *testing.T) {
+	p, w := dkimPlugin(t, func(cfg *Config) { cfg.NormalizeBareCR = true })
+	addr := startTestServer(t, p)
+
+	header := []string{"From: Joe <joe@football.example.com>", "Subject: bare"}
+	signed := signSimple(t, header, "bare\rcr\r\n", -1)
+
+	c, _, _ := dialTest(t, addr)
+	c.cmd("EHLO client.example")
+	code, _ := c.send("joe@football.example.com", []string{"b@example.com"}, strings.TrimSuffix(signed, "\r\n"))
+	require.Equal(t, 250, code)
+
+	event := w.waitEvent(t, "EMAIL_RECEIVED")
+	require.Equal(t, "pass", event["dkim"].([]any)[0].(map[string]any)["status"])
+	require.Contains(t, event["textBody"], "bare\r\ncr")
+}
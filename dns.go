@@ -0,0 +1,176 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dnsCache is a small TTL cache for DNS based lookups keyed by name or IP
+type dnsCache struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	entries   map[string]dnsCacheEntry
+	lastPrune time.Time
+}
+
+type dnsCacheEntry struct {
+	value   []string
+	expires time.Time
+}
+
+// newDNSCache creates a cache keeping entries for ttl
+func newDNSCache(ttl time.Duration) *dnsCache {
+	return &dnsCache{
+		ttl:       ttl,
+		entries:   make(map[string]dnsCacheEntry),
+		lastPrune: time.Now(),
+	}
+}
+
+// get returns a cached, non-expired value
+func (c *dnsCache) get(key string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.value, true
+}
+
+// set stores a value, pruning expired entries at most once per ttl
+func (c *dnsCache) set(key string, value []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.lastPrune) > c.ttl {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.lastPrune = now
+	}
+
+	c.entries[key] = dnsCacheEntry{value: value, expires: now.Add(c.ttl)}
+}
+
+// dnsResolver is the lookup path shared by all DNS based checks: answers are
+// cached, every lookup is bounded by dns_timeout and at most max_concurrent_dns
+// queries are in flight at once.
+type dnsResolver struct {
+	resolver *net.Resolver
+	cache    *dnsCache
+	timeout  time.Duration
+	stats    *stats
+
+	// nil when unlimited
+	sem chan struct{}
+}
+
+// newDNSResolver creates the shared resolver from the plugin configuration
+func newDNSResolver(cfg *Config, st *stats) *dnsResolver {
+	r := &dnsResolver{
+		resolver: net.DefaultResolver,
+		cache:    newDNSCache(cfg.DNSCacheTTL),
+		timeout:  cfg.DNSTimeout,
+		stats:    st,
+	}
+	if cfg.MaxConcurrentDNS > 0 {
+		r.sem = make(chan struct{}, cfg.MaxConcurrentDNS)
+	}
+	return r
+}
+
+// lookupHost returns the addresses of host
+func (r *dnsResolver) lookupHost(ctx context.Context, host string) ([]string, error) {
+	return r.lookup(ctx, "A:"+host, func(ctx context.Context) ([]string, error) {
+		return r.resolver.LookupHost(ctx, host)
+	})
+}
+
+// lookupTXT returns the TXT records of name
+func (r *dnsResolver) lookupTXT(ctx context.Context, name string) ([]string, error) {
+	return r.lookup(ctx, "TXT:"+name, func(ctx context.Context) ([]string, error) {
+		return r.resolver.LookupTXT(ctx, name)
+	})
+}
+
+// lookupAddr returns the PTR host names of ip
+func (r *dnsResolver) lookupAddr(ctx context.Context, ip string) ([]string, error) {
+	return r.lookup(ctx, "PTR:"+ip, func(ctx context.Context) ([]string, error) {
+		return r.resolver.LookupAddr(ctx, ip)
+	})
+}
+
+// remoteHost returns the first PTR name of ip without the trailing dot,
+// "" when there is none or the lookup failed
+func (r *dnsResolver) remoteHost(ip string) string {
+	if ip == "" {
+		return ""
+	}
+
+	names, err := r.lookupAddr(context.Background(), ip)
+	if err != nil || len(names) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(names[0], ".")
+}
+
+// lookupMX returns the mail exchanger host names of domain, by preference
+func (r *dnsResolver) lookupMX(ctx context.Context, domain string) ([]string, error) {
+	return r.lookup(ctx, "MX:"+domain, func(ctx context.Context) ([]string, error) {
+		mxs, err := r.resolver.LookupMX(ctx, domain)
+		if err != nil {
+			return nil, err
+		}
+		hosts := make([]string, 0, len(mxs))
+		for _, mx := range mxs {
+			hosts = append(hosts, mx.Host)
+		}
+		return hosts, nil
+	})
+}
+
+// lookup answers from the cache or runs fn within the concurrency and time bounds.
+// Not found answers are cached as an empty result; other failures are not cached.
+func (r *dnsResolver) lookup(ctx context.Context, key string, fn func(context.Context) ([]string, error)) ([]string, error) {
+	if value, ok := r.cache.get(key); ok {
+		r.stats.dnsCacheHits.Add(1)
+		return value, nil
+	}
+	r.stats.dnsCacheMisses.Add(1)
+
+	if r.sem != nil {
+		select {
+		case r.sem <- struct{}{}:
+			defer func() { <-r.sem }()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	r.stats.dnsLookups.Add(1)
+	defer r.stats.dnsLookups.Add(-1)
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	value, err := fn(ctx)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return nil, err
+		}
+		value = []string{}
+	}
+
+	r.cache.set(key, value)
+	return value, nil
+}
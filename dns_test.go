@@ -0,0 +1,49 @@
+package smtp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteHostCached(t *testing.T) {
+	p, w := newTestPlugin(t, func(cfg *Config) { cfg.RDNS = true })
+	// 127.0.0.1 is answered from /etc/hosts, the clients connect from 127.0.0.2
+	dns := &fakeDNS{ptr: map[string][]string{"2.0.0.127.in-addr.arpa": {"client.example"}}}
+	dns.install(p)
+	addr := startTestServer(t, p)
+
+	for i := 0; i < 2; i++ {
+		c, _, _ := dialTestFrom(t, addr, "127.0.0.2")
+		c.cmd("EHLO client.example")
+		code, _ := c.send("a@example.com", []string{"b@example.com"}, "Subject: hi\r\n\r\nbody")
+		require.Equal(t, 250, code)
+	}
+
+	require.Eventually(t, func() bool { return len(w.eventsOf("EMAIL_RECEIVED")) == 2 }, 5*time.Second, 10*time.Millisecond)
+	for _, event := range w.eventsOf("EMAIL_RECEIVED") {
+		require.Equal(t, "client.example", event["remoteHost"])
+	}
+	require.Equal(t, 1, dns.queryCount())
+	require.Equal(t, uint64(1), p.stats.snapshot().DNSCacheHits)
+}
+
+func TestRemoteHostTimeout(t *testing.T) {
+	p, w := newTestPlugin(t, func(cfg *Config) {
+		cfg.RDNS = true
+		cfg.DNSTimeout = 200 * time.Millisecond
+	})
+	dns := &fakeDNS{silent: map[string]bool{"2.0.0.127.in-addr.arpa": true}}
+	dns.install(p)
+
+	c, _, _ := dialTestFrom(t, startTestServer(t, p), "127.0.0.2")
+	start := time.Now()
+	code, _ := c.cmd("EHLO client.example")
+	require.Equal(t, 250, code)
+	require.Less(t, time.Since(start), time.Second)
+
+	code, _ = c.send("a@example.com", []string{"b@example.com"}, "Subject: hi\r\n\r\nbody")
+	require.Equal(t, 250, code)
+	require.NotContains(t, w.waitEvent(t, "EMAIL_RECEIVED"), "remoteHost")
+}
@@ -0,0 +1,82 @@
+package smtp
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// checkDNSBL returns the configured zones listing ip.
+// Lookup failures and timeouts are treated as not listed.
+func (p *Plugin) checkDNSBL(ip string) []string {
+	if ip == "" || len(p.cfg.DNSBLZones) == 0 {
+		return nil
+	}
+
+	rev := reverseIP(ip)
+	if rev == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.cfg.DNSBLTimeout)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		listings []string
+	)
+
+	for _, zone := range p.cfg.DNSBLZones {
+		wg.Add(1)
+		go func(zone string) {
+			defer wg.Done()
+
+			addrs, err := p.dns.lookupHost(ctx, rev+"."+zone)
+			if err != nil {
+				p.log.Debug("DNSBL lookup failed", zap.String("zone", zone), zap.Error(err))
+				return
+			}
+
+			// Listings are answered with 127.0.0.0/8 addresses
+			for _, addr := range addrs {
+				if strings.HasPrefix(addr, "127.") {
+					mu.Lock()
+					listings = append(listings, zone)
+					mu.Unlock()
+					return
+				}
+			}
+		}(zone)
+	}
+
+	wg.Wait()
+
+	return listings
+}
+
+// reverseIP returns the DNSBL query label for ip: reversed octets for IPv4,
+// reversed nibbles for IPv6
+func reverseIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+
+	if v4 := parsed.To4(); v4 != nil {
+		return strconv.Itoa(int(v4[3])) + "." + strconv.Itoa(int(v4[2])) + "." +
+			strconv.Itoa(int(v4[1])) + "." + strconv.Itoa(int(v4[0]))
+	}
+
+	const hex = "0123456789abcdef"
+	v6 := parsed.To16()
+	labels := make([]string, 0, 32)
+	for i := len(v6) - 1; i >= 0; i-- {
+		labels = append(labels, string(hex[v6[i]&0x0f]), string(hex[v6[i]>>4]))
+	}
+	return strings.Join(labels, ".")
+}
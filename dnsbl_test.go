@@ -0,0 +1,46 @@
+package smtp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// dnsblPlugin serves a plugin with 127.0.0.1 listed in bl.example
+func dnsblPlugin(t *testing.T, policy string) (*Plugin, *testWorker, string) {
+	p, w := newTestPlugin(t, func(cfg *Config) {
+		cfg.DNSBLZones = []string{"bl.example"}
+		cfg.DNSBLPolicy = policy
+	})
+	dns := &fakeDNS{a: map[string][]string{"1.0.0.127.bl.example": {"127.0.0.2"}}}
+	dns.install(p)
+	return p, w, startTestServer(t, p)
+}
+
+func TestDNSBLRejectClosesConnection(t *testing.T) {
+	_, _, addr := dnsblPlugin(t, "reject")
+
+	c, _, _ := dialTest(t, addr)
+	code, msg := c.cmd("EHLO client.example")
+	require.Equal(t, 554, code)
+	require.Contains(t, msg, "bl.example")
+	require.True(t, c.closed())
+}
+
+func TestDNSBLCheckedOncePerConnection(t *testing.T) {
+	p, w, addr := dnsblPlugin(t, "flag")
+
+	c, _, _ := dialTest(t, addr)
+	c.cmd("HELO client.example")
+	c.cmd("EHLO client.example")
+	c.cmd("EHLO client.example")
+	c.cmd("MAIL FROM:<a@example.com>")
+	c.cmd("RCPT TO:<b@example.com>")
+	c.cmd("DATA")
+	code, _ := c.cmd("Subject: hi\r\n\r\nbody\r\n.")
+	require.Equal(t, 250, code)
+
+	stats := p.stats.snapshot()
+	require.Equal(t, uint64(1), stats.DNSCacheHits+stats.DNSCacheMisses)
+	require.Equal(t, []any{"bl.example"}, w.waitEvent(t, "EMAIL_RECEIVED")["dnsbl"])
+}
@@ -0,0 +1,161 @@
+package smtp
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+// mtaPreset describes how a well known MTA greets and replies
+type mtaPreset struct {
+	banner          string // 220 greeting text
+	ehloGreeting    string // first line of the EHLO/HELO reply
+	quitMessage     string // 221 reply text
+	honeypotMessage string // final rejection text in honeypot mode
+
+	// Extensions advertised in addition to the go-smtp base set
+	smtputf8   bool
+	dsn        bool
+	binarymime bool
+
+	// Whole reply lines replacing go-smtp's success replies. {addr} is the
+	// MAIL FROM/RCPT TO address, {queueid} a random queue id.
+	mailReply   string
+	rcptReply   string
+	dataReply   string // 354 go ahead
+	queuedReply string // message accepted
+	resetReply  string
+	noopReply   string
+}
+
+// mtaPresets are the emulate profiles. Texts accept the {hostname}, {helo},
+// {ip} and {date} placeholders, expanded per connection.
+var mtaPresets = map[string]mtaPreset{
+	"postfix": {
+		banner:          "{hostname} ESMTP Postfix",
+		ehloGreeting:    "{hostname}",
+		quitMessage:     "Bye",
+		honeypotMessage: "Recipient address rejected: User unknown in local recipient table",
+		smtputf8:        true,
+		dsn:             true,
+		mailReply:       "250 2.1.0 Ok",
+		rcptReply:       "250 2.1.5 Ok",
+		dataReply:       "354 End data with <CR><LF>.<CR><LF>",
+		queuedReply:     "250 2.0.0 Ok: queued as {queueid}",
+		resetReply:      "250 2.0.0 Ok",
+		noopReply:       "250 2.0.0 Ok",
+	},
+	"exim": {
+		banner:          "{hostname} ESMTP Exim 4.96 {date}",
+		ehloGreeting:    "{hostname} Hello {helo} [{ip}]",
+		quitMessage:     "{hostname} closing connection",
+		honeypotMessage: "Unrouteable address",
+		mailReply:       "250 OK",
+		rcptReply:       "250 Accepted",
+		dataReply:       `354 Enter message, ending with "." on a line by itself`,
+		queuedReply:     "250 OK id={queueid}",
+		resetReply:      "250 Reset OK",
+		noopReply:       "250 OK",
+	},
+	"exchange": {
+		banner:          "{hostname} Microsoft ESMTP MAIL Service ready at {date}",
+		ehloGreeting:    "{hostname} Hello [{ip}]",
+		quitMessage:     "Service closing transmission channel",
+		honeypotMessage: "RESOLVER.ADR.RecipNotFound; not found",
+		dsn:             true,
+		binarymime:      true,
+		mailReply:       "250 2.1.0 Sender OK",
+		rcptReply:       "250 2.1.5 Recipient OK",
+		dataReply:       "354 Start mail input; end with <CRLF>.<CRLF>",
+		queuedReply:     "250 2.6.0 Queued mail for delivery [InternalId={queueid}]",
+		resetReply:      "250 2.0.0 Resetting",
+		noopReply:       "250 2.0.0 OK",
+	},
+	"sendmail": {
+		banner:          "{hostname} ESMTP Sendmail 8.17.1/8.17.1; {date}",
+		ehloGreeting:    "{hostname} Hello {helo} [{ip}], pleased to meet you",
+		quitMessage:     "{hostname} closing connection",
+		honeypotMessage: "User unknown",
+		dsn:             true,
+		mailReply:       "250 2.1.0 <{addr}>... Sender ok",
+		rcptReply:       "250 2.1.5 <{addr}>... Recipient ok",
+		dataReply:       `354 Enter mail, end with "." on a line by itself`,
+		queuedReply:     "250 2.0.0 {queueid} Message accepted for delivery",
+		resetReply:      "250 2.0.0 Reset state",
+		noopReply:       "250 2.0.0 OK",
+	},
+}
+
+// go-smtp success replies replaced by the emulate presets
+var (
+	goSMTPMailPrefix  = []byte("250 2.0.0 Roger, accepting mail from <")
+	goSMTPRcptPrefix  = []byte("250 2.0.0 I'll make sure <")
+	goSMTPDataReply   = []byte("354 Go ahead. End your data with <CR><LF>.<CR><LF>\r\n")
+	goSMTPQueuedReply = []byte("250 2.0.0 OK: queued\r\n")
+	goSMTPResetReply  = []byte("250 2.0.0 Session reset\r\n")
+	goSMTPNoopReply   = []byte("250 2.0.0 I have successfully done nothing\r\n")
+)
+
+// rewrite returns the preset wording of a go-smtp success reply or nil
+func (p *mtaPreset) rewrite(b []byte) []byte {
+	var reply, addr string
+	switch {
+	case bytes.HasPrefix(b, goSMTPMailPrefix):
+		reply = p.mailReply
+		addr, _, _ = strings.Cut(string(b[len(goSMTPMailPrefix):]), ">")
+	case bytes.HasPrefix(b, goSMTPRcptPrefix):
+		reply = p.rcptReply
+		addr, _, _ = strings.Cut(string(b[len(goSMTPRcptPrefix):]), ">")
+	case bytes.Equal(b, goSMTPDataReply):
+		reply = p.dataReply
+	case bytes.Equal(b, goSMTPQueuedReply):
+		reply = p.queuedReply
+	case bytes.Equal(b, goSMTPResetReply):
+		reply = p.resetReply
+	case bytes.Equal(b, goSMTPNoopReply):
+		reply = p.noopReply
+	}
+	if reply == "" {
+		return nil
+	}
+
+	queueID := fmt.Sprintf("%010X", rand.Uint64()&0xFFFFFFFFFF)
+	return []byte(strings.NewReplacer("{addr}", addr, "{queueid}", queueID).Replace(reply) + "\r\n")
+}
+
+// applyEmulation fills response texts from the emulate preset,
+// explicitly configured values take precedence
+func (c *Config) applyEmulation() {
+	preset, ok := mtaPresets[c.Emulate]
+	if !ok {
+		return
+	}
+
+	if c.Banner == "" {
+		c.Banner = preset.banner
+	}
+
+	if c.EhloGreeting == "" {
+		c.EhloGreeting = preset.ehloGreeting
+	}
+
+	if c.QuitMessage == "" {
+		c.QuitMessage = preset.quitMessage
+	}
+
+	if c.HoneypotReject.Message == "" {
+		c.HoneypotReject.Message = preset.honeypotMessage
+	}
+}
+
+// expandResponse replaces the response text placeholders
+func expandResponse(text, hostname, helo, ip string) string {
+	return strings.NewReplacer(
+		"{hostname}", hostname,
+		"{helo}", helo,
+		"{ip}", ip,
+		"{date}", time.Now().Format(time.RFC1123Z),
+	).Replace(text)
+}
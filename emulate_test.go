@@ -0,0 +1,63 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmulateRepliesAfterStartTLS(t *testing.T) {
+	certFile, keyFile := testCertificate(t)
+	p, _ := newTestPlugin(t, func(cfg *Config) {
+		cfg.Emulate = "postfix"
+		cfg.Hostname = "mx.example"
+		cfg.TLS.CertFile, cfg.TLS.KeyFile = certFile, keyFile
+	})
+	addr := startTestServer(t, p)
+
+	c, code, msg := dialTest(t, addr)
+	require.Equal(t, 220, code)
+	require.Equal(t, "mx.example ESMTP Postfix", msg)
+
+	c.cmd("EHLO client.example")
+	c.startTLS(&tls.Config{InsecureSkipVerify: true})
+
+	code, msg = c.cmd("EHLO client.example")
+	require.Equal(t, 250, code)
+	require.Regexp(t, `^mx\.example\n`, msg)
+
+	for _, step := range []struct {
+		command string
+		code    int
+		reply   string
+	}{
+		{"MAIL FROM:<a@example.com>", 250, "2.1.0 Ok"},
+		{"RCPT TO:<b@example.com>", 250, "2.1.5 Ok"},
+		{"DATA", 354, "End data with <CR><LF>.<CR><LF>"},
+		{"Subject: hi\r\n\r\nbody\r\n.", 250, ""},
+		{"RSET", 250, "2.0.0 Ok"},
+		{"NOOP", 250, "2.0.0 Ok"},
+		{"QUIT", 221, "2.0.0 Bye"},
+	} {
+		code, msg = c.cmd("%s", step.command)
+		require.Equal(t, step.code, code, step.command)
+		if step.reply != "" {
+			require.Equal(t, step.reply, msg, step.command)
+		} else {
+			require.Regexp(t, `^2\.0\.0 Ok: queued as [0-9A-F]{10}$`, msg)
+		}
+	}
+}
+
+func TestEmulateRepliesWithAddress(t *testing.T) {
+	p, _ := newTestPlugin(t, func(cfg *Config) { cfg.Emulate = "sendmail" })
+	addr := startTestServer(t, p)
+
+	c, _, _ := dialTest(t, addr)
+	c.cmd("EHLO client.example")
+	_, msg := c.cmd("MAIL FROM:<a@example.com>")
+	require.Equal(t, "2.1.0 <a@example.com>... Sender ok", msg)
+	_, msg = c.cmd("RCPT TO:<b@example.com>")
+	require.Equal(t, "2.1.5 <b@example.com>... Recipient ok", msg)
+}
@@ -0,0 +1,80 @@
+package smtp
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// filterReportInterval is how often the filtered-out message count is logged
+const filterReportInterval = time.Minute
+
+// enabled reports whether any filter condition is configured
+func (f *DeliveryFilterConfig) enabled() bool {
+	return f.HasAttachments || f.AuthAttempted || len(f.Recipients) > 0
+}
+
+// matches reports whether the message satisfies all configured conditions
+func (f *DeliveryFilterConfig) matches(s *Session, msg *ParsedMessage) bool {
+	if f.HasAttachments && len(msg.Attachments) == 0 {
+		return false
+	}
+
+	if f.AuthAttempted && !s.authenticated {
+		return false
+	}
+
+	if len(f.Recipients) > 0 && !f.matchesRecipient(s.to) {
+		return false
+	}
+
+	return true
+}
+
+// matchesRecipient checks envelope recipients against the filter list.
+// Entries starting with "@" match a whole domain.
+func (f *DeliveryFilterConfig) matchesRecipient(rcpts []string) bool {
+	for _, rcpt := range rcpts {
+		for _, want := range f.Recipients {
+			if strings.HasPrefix(want, "@") {
+				if strings.HasSuffix(strings.ToLower(rcpt), strings.ToLower(want)) {
+					return true
+				}
+				continue
+			}
+
+			if strings.EqualFold(rcpt, want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// startFilterReportRoutine periodically logs how many messages were filtered out
+func (p *Plugin) startFilterReportRoutine(ctx context.Context) {
+	if !p.cfg.DeliveryFilter.enabled() {
+		return
+	}
+
+	ticker := time.NewTicker(filterReportInterval)
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				if n := p.filteredCount.Swap(0); n > 0 {
+					p.log.Info("messages filtered out by delivery_filter",
+						zap.Uint64("count", n),
+						zap.Duration("interval", filterReportInterval),
+					)
+				}
+			}
+		}
+	}()
+}
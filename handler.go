@@ -1,9 +1,17 @@
 package smtp
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/emersion/go-smtp"
 	"github.com/goccy/go-json"
 	"github.com/roadrunner-server/errors"
 	"github.com/roadrunner-server/pool/payload"
@@ -12,12 +20,369 @@ import (
 
 // sendToWorker sends email data to PHP worker and waits for response
 func (s *Session) sendToWorker(message *ParsedMessage) (string, error) {
+	jsonData, err := s.marshalEvent(message)
+	if err != nil {
+		return "", err
+	}
+
+	return s.execWorker(jsonData)
+}
+
+// marshalEvent marshals the full event, shrinking it to max_worker_payload
+func (s *Session) marshalEvent(message *ParsedMessage) ([]byte, error) {
+	if limit := s.backend.plugin.cfg.CompressBodyOver; limit > 0 {
+		if err := compressBodies(message, limit); err != nil {
+			return nil, errors.E(errors.Op("smtp_compress_body"), err)
+		}
+	}
+
 	// 1. Marshal email data to JSON
+	jsonData, err := json.Marshal(message)
+	if err != nil {
+		return nil, errors.E(errors.Op("smtp_marshal_email"), err)
+	}
+
+	if limit := s.backend.plugin.cfg.MaxWorkerPayload; limit > 0 && int64(len(jsonData)) > limit {
+		jsonData, err = s.shrinkPayload(message, jsonData, limit)
+		if err != nil {
+			return nil, errors.E(errors.Op("smtp_shrink_payload"), err)
+		}
+	}
+
+	return jsonData, nil
+}
+
+// sendMinimalToWorker sends the stripped minimal_event to PHP worker and waits for response
+func (s *Session) sendMinimalToWorker(message *MinimalEvent) (string, error) {
 	jsonData, err := json.Marshal(message)
 	if err != nil {
 		return "", errors.E(errors.Op("smtp_marshal_email"), err)
 	}
 
+	return s.execWorker(jsonData)
+}
+
+// deliverFullEvent sends the full event after a minimal_event decision,
+// the worker response is only logged. With spool_dir the event is written
+// to disk first and removed once delivered.
+func (s *Session) deliverFullEvent(message *ParsedMessage, seq int) {
+	jsonData, err := s.marshalEvent(message)
+	if err != nil {
+		s.log.Error("full event delivery failed", zap.String("uuid", s.uuid), zap.Error(err))
+		return
+	}
+
+	spoolPath := s.backend.plugin.spoolEvent(fmt.Sprintf("%s-%d", s.uuid, seq), jsonData)
+
+	response, err := s.execWorker(jsonData)
+	if err != nil {
+		// Spooled events are retried on the next start
+		s.log.Error("full event delivery failed",
+			zap.String("uuid", s.uuid),
+			zap.String("spool_path", spoolPath),
+			zap.Error(err),
+		)
+		return
+	}
+
+	s.backend.plugin.unspool(spoolPath)
+
+	s.log.Debug("full event delivered",
+		zap.String("uuid", s.uuid),
+		zap.String("response", response),
+	)
+}
+
+// reportSlowParse logs a message that exceeded slow_parse_threshold and
+// optionally notifies workers, the worker response is only logged
+func (s *Session) reportSlowParse(elapsed time.Duration, parts int) {
+	s.log.Warn("slow message parse",
+		zap.String("uuid", s.uuid),
+		zap.Duration("duration", elapsed),
+		zap.Int("size", s.emailData.Len()),
+		zap.Int("parts", parts),
+	)
+
+	if !s.backend.plugin.cfg.SlowParseEvent {
+		return
+	}
+
+	jsonData, err := json.Marshal(&SlowParseEvent{
+		Event:      "SLOW_PARSE",
+		UUID:       s.uuid,
+		DurationMs: elapsed.Milliseconds(),
+		Size:       s.emailData.Len(),
+		Parts:      parts,
+		RemoteAddr: s.remoteAddr,
+	})
+	if err != nil {
+		s.log.Error("failed to marshal slow parse event", zap.Error(err))
+		return
+	}
+
+	go func() {
+		if _, err := s.execWorker(jsonData); err != nil {
+			s.log.Error("slow parse event delivery failed", zap.String("uuid", s.uuid), zap.Error(err))
+		}
+	}()
+}
+
+// mailCallback asks workers about the envelope sender with a MAIL_FROM event
+// (enable_mail_callback) and returns the reply refusing it, if any
+func (s *Session) mailCallback(from string, opts *smtp.MailOptions) error {
+	event := &MailFromEvent{
+		Event:      "MAIL_FROM",
+		UUID:       s.uuid,
+		From:       from,
+		RemoteAddr: s.remoteAddr,
+		Helo:       s.heloName,
+	}
+	if opts != nil {
+		event.Size = opts.Size
+		event.Body = string(opts.Body)
+		event.UTF8 = opts.UTF8
+		event.EnvelopeID = opts.EnvelopeID
+	}
+
+	return s.policyCallback(event, from)
+}
+
+// rcptCallback asks workers about a recipient with a RCPT_TO event
+// (enable_rcpt_callback), a refusal only affects this recipient
+func (s *Session) rcptCallback(to string) error {
+	return s.policyCallback(&RcptToEvent{
+		Event:      "RCPT_TO",
+		UUID:       s.uuid,
+		From:       s.from,
+		To:         to,
+		Accepted:   s.to,
+		RemoteAddr: s.remoteAddr,
+		Helo:       s.heloName,
+	}, to)
+}
+
+// policyCallback delivers an envelope event and maps a rejecting response to
+// its SMTP reply. Failed deliveries answer 451.
+func (s *Session) policyCallback(event any, address string) error {
+	jsonData, err := json.Marshal(event)
+	if err != nil {
+		return errors.E(errors.Op("smtp_marshal_policy_event"), err)
+	}
+
+	response, err := s.execWorker(jsonData)
+	if err != nil {
+		s.log.Error("policy callback failed", zap.String("uuid", s.uuid), zap.Error(err))
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Temporary failure",
+		}
+	}
+
+	if _, reply := parseWorkerResponse(response); reply != nil {
+		s.log.Info("address rejected by worker",
+			zap.String("uuid", s.uuid),
+			zap.String("address", address),
+			zap.Int("code", reply.Code),
+		)
+		return reply
+	}
+	return nil
+}
+
+// workerDecision is the JSON form of a worker response, e.g.
+// {"action":"reject","code":550,"message":"Spam detected"}
+type workerDecision struct {
+	Action       string `json:"action"` // accept, continue, close, quarantine, reject or defer
+	Code         int    `json:"code"`
+	EnhancedCode string `json:"enhancedCode"` // e.g. "5.7.1"
+	Message      string `json:"message"`
+}
+
+// parseWorkerResponse splits a worker response into its keyword (CONTINUE,
+// CLOSE, QUARANTINE) and, for rejections, the SMTP reply. JSON responses are
+// decoded first, anything else falls back to the plain string protocol.
+func parseWorkerResponse(response string) (string, *smtp.SMTPError) {
+	trimmed := strings.TrimSpace(response)
+	if !strings.HasPrefix(trimmed, "{") {
+		return response, workerReplyError(response)
+	}
+
+	var d workerDecision
+	if err := json.Unmarshal([]byte(trimmed), &d); err != nil {
+		return response, nil
+	}
+
+	switch strings.ToLower(d.Action) {
+	case "accept", "continue":
+		return "CONTINUE", nil
+	case "close":
+		return "CLOSE", nil
+	case "quarantine":
+		return "QUARANTINE", nil
+	case "reject":
+		return "REJECT", d.reply(5, 550, smtp.EnhancedCode{5, 7, 1}, "Rejected by policy")
+	case "defer":
+		return "DEFER", d.reply(4, 451, smtp.EnhancedCode{4, 7, 1}, "Try again later")
+	default:
+		return response, nil
+	}
+}
+
+// reply builds the SMTP reply for a reject or defer decision. Codes outside
+// the action's class (5xx for reject, 4xx for defer) are replaced by the default.
+func (d *workerDecision) reply(class, code int, enhanced smtp.EnhancedCode, message string) *smtp.SMTPError {
+	r := &smtp.SMTPError{Code: code, EnhancedCode: enhanced, Message: message}
+	if d.Code/100 == class {
+		r.Code = d.Code
+		r.EnhancedCode = smtp.EnhancedCode{class, 0, 0}
+	}
+	if e, _, ok := parseEnhancedCode(d.EnhancedCode); ok && e[0] == class {
+		r.EnhancedCode = e
+	}
+	if msg := strings.TrimSpace(d.Message); msg != "" {
+		r.Message = strings.ReplaceAll(strings.ReplaceAll(msg, "\r", " "), "\n", " ")
+	}
+	return r
+}
+
+// workerReplyError maps a rejecting worker response to the SMTP reply: "REJECT"
+// or a custom reply such as "550 5.1.1 Unknown user". Other responses give nil.
+func workerReplyError(response string) *smtp.SMTPError {
+	if response == "REJECT" {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Rejected by policy",
+		}
+	}
+
+	fields := strings.SplitN(strings.TrimSpace(response), " ", 2)
+	code, err := strconv.Atoi(fields[0])
+	if err != nil || len(fields[0]) != 3 || code < 400 || code > 599 {
+		return nil
+	}
+
+	reply := &smtp.SMTPError{Code: code, Message: "Rejected by policy"}
+	if len(fields) == 2 {
+		text := strings.TrimSpace(fields[1])
+		if enhanced, rest, ok := parseEnhancedCode(text); ok {
+			reply.EnhancedCode = enhanced
+			text = rest
+		}
+		if text != "" {
+			reply.Message = text
+		}
+	}
+	return reply
+}
+
+// parseEnhancedCode splits a leading "X.Y.Z" enhanced status code off text
+func parseEnhancedCode(text string) (smtp.EnhancedCode, string, bool) {
+	token, rest, _ := strings.Cut(text, " ")
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return smtp.EnhancedCode{}, text, false
+	}
+
+	var code smtp.EnhancedCode
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || n > 999 {
+			return smtp.EnhancedCode{}, text, false
+		}
+		code[i] = n
+	}
+	return code, strings.TrimSpace(rest), true
+}
+
+// connectRefused sends the CONNECTION_OPENED event and returns the reply
+// refusing the client, nil when it may proceed. CLOSE and REJECT refuse with
+// 554, decisions and custom replies are used as parsed by parseWorkerResponse.
+// Delivery failures let the client in.
+func (s *Session) connectRefused() *smtp.SMTPError {
+	jsonData, err := json.Marshal(&ConnectEvent{
+		Event:      "CONNECTION_OPENED",
+		UUID:       s.uuid,
+		RemoteAddr: s.remoteAddr,
+		RemoteIP:   s.remoteIP,
+		RemoteHost: s.remoteHost,
+		LocalAddr:  s.localAddr,
+		Helo:       s.heloName,
+		Server:     s.backend.plugin.cfg.Hostname,
+	})
+	if err != nil {
+		s.log.Error("failed to marshal connect event", zap.Error(err))
+		return nil
+	}
+
+	response, err := s.execWorker(jsonData)
+	if err != nil {
+		s.log.Error("connect event delivery failed", zap.String("uuid", s.uuid), zap.Error(err))
+		return nil
+	}
+
+	action, reply := parseWorkerResponse(response)
+	switch {
+	case action == "CLOSE" || response == "REJECT":
+		reply = &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Connection refused",
+		}
+	case reply == nil:
+		return nil
+	}
+
+	s.log.Info("client refused by worker",
+		zap.String("uuid", s.uuid),
+		zap.String("remote_addr", s.remoteAddr),
+		zap.Int("code", reply.Code),
+	)
+	return reply
+}
+
+// sendCloseEvent delivers the command trace of a finished connection with a
+// CONNECTION_CLOSED event, the worker response is ignored
+func (p *Plugin) sendCloseEvent(c *clientConn) {
+	jsonData, err := json.Marshal(&ConnectionClosedEvent{
+		Event:        "CONNECTION_CLOSED",
+		UUID:         c.uuid,
+		RemoteAddr:   addrString(c.RemoteAddr()),
+		DurationMs:   time.Since(c.acceptedAt).Milliseconds(),
+		CommandTrace: c.commandTrace(),
+	})
+	if err != nil {
+		p.log.Error("failed to marshal close event", zap.Error(err))
+		return
+	}
+
+	if _, err := p.execWorker(jsonData); err != nil {
+		p.log.Error("close event delivery failed", zap.String("uuid", c.uuid), zap.Error(err))
+	}
+}
+
+// execWorker executes a marshaled event on the worker pool and returns the worker response
+func (s *Session) execWorker(jsonData []byte) (string, error) {
+	response, err := s.backend.plugin.execWorker(jsonData)
+	if err != nil {
+		return "", err
+	}
+
+	s.log.Debug("worker response",
+		zap.String("uuid", s.uuid),
+		zap.String("response", response),
+	)
+
+	return response, nil
+}
+
+// execWorker executes a marshaled event on the worker pool outside of a session
+func (p *Plugin) execWorker(jsonData []byte) (string, error) {
+	if p.exec != nil {
+		return p.exec(jsonData)
+	}
+
 	// 2. Create payload
 	pld := &payload.Payload{
 		Context: jsonData, // Email data in context
@@ -28,9 +393,9 @@ func (s *Session) sendToWorker(message *ParsedMessage) (string, error) {
 	ctx := context.Background()
 	stopCh := make(chan struct{}, 1)
 
-	s.backend.plugin.mu.RLock()
-	pool := s.backend.plugin.wPool
-	s.backend.plugin.mu.RUnlock()
+	p.mu.RLock()
+	pool := p.wPool
+	p.mu.RUnlock()
 
 	if pool == nil {
 		return "", errors.Str("worker pool not initialized")
@@ -43,22 +408,117 @@ func (s *Session) sendToWorker(message *ParsedMessage) (string, error) {
 
 	// 4. Read response from worker
 	select {
-	case resp := <-result:
+	case resp, ok := <-result:
+		// Worker may die mid-response leaving no result or payload
+		if !ok || resp == nil {
+			return "", errors.Str("worker returned no response")
+		}
+
 		if resp.Error() != nil {
 			return "", resp.Error()
 		}
 
-		// Get response from context
-		response := string(resp.Payload().Context)
-
-		s.log.Debug("worker response",
-			zap.String("uuid", s.uuid),
-			zap.String("response", response),
-		)
+		respPld := resp.Payload()
+		if respPld == nil {
+			return "", errors.Str("worker returned nil payload")
+		}
 
-		return response, nil
+		// Get response from context
+		return string(respPld.Context), nil
 
 	case <-time.After(30 * time.Second):
 		return "", errors.Str("worker timeout")
 	}
 }
+
+// bodyEncodingGzip marks textBody and htmlBody as gzipped and base64 encoded
+const bodyEncodingGzip = "gzip+base64"
+
+// compressBodies gzips and base64 encodes both bodies when together they exceed limit bytes
+func compressBodies(message *ParsedMessage, limit int64) error {
+	if message.BodyEncoding != "" || int64(len(message.TextBody)+len(message.HTMLBody)) <= limit {
+		return nil
+	}
+
+	for _, body := range []*string{&message.TextBody, &message.HTMLBody} {
+		if *body == "" {
+			continue
+		}
+
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write([]byte(*body)); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		*body = base64.StdEncoding.EncodeToString(buf.Bytes())
+	}
+
+	message.BodyEncoding = bodyEncodingGzip
+	return nil
+}
+
+// shrinkPayload downgrades an event exceeding max_worker_payload: first the raw
+// message is dropped, then inline attachments are moved to temp files one by one.
+// The event is sent as is if it still doesn't fit.
+func (s *Session) shrinkPayload(message *ParsedMessage, jsonData []byte, limit int64) ([]byte, error) {
+	originalSize := len(jsonData)
+	var err error
+
+	if message.Raw != "" {
+		message.Raw = ""
+		message.PayloadDowngraded = true
+		jsonData, err = json.Marshal(message)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range message.Attachments {
+		if int64(len(jsonData)) <= limit {
+			break
+		}
+
+		att := &message.Attachments[i]
+		if att.StoredFilename != "" || att.Content == "" {
+			continue
+		}
+
+		content, err := base64.StdEncoding.DecodeString(att.Content)
+		if err != nil {
+			return nil, err
+		}
+
+		path, err := s.saveTempFile(content, att.Filename)
+		if err != nil {
+			return nil, err
+		}
+
+		att.Content = path
+		att.StoredFilename = filepath.Base(path)
+		message.PayloadDowngraded = true
+
+		jsonData, err = json.Marshal(message)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if int64(len(jsonData)) > limit {
+		s.log.Warn("event still exceeds max_worker_payload after downgrade",
+			zap.String("uuid", s.uuid),
+			zap.Int("size", len(jsonData)),
+			zap.Int64("limit", limit),
+		)
+	} else {
+		s.log.Debug("event downgraded to fit max_worker_payload",
+			zap.String("uuid", s.uuid),
+			zap.Int("original_size", originalSize),
+			zap.Int("size", len(jsonData)),
+		)
+	}
+
+	return jsonData, nil
+}
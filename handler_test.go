@@ -0,0 +1,188 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/roadrunner-server/pool/payload"
+	staticPool "github.com/roadrunner-server/pool/pool/static_pool"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePool answers Exec with the channel built by result
+type fakePool struct {
+	Pool
+	result func() chan *staticPool.PExec
+}
+
+func (f *fakePool) Exec(context.Context, *payload.Payload, chan struct{}) (chan *staticPool.PExec, error) {
+	return f.result(), nil
+}
+
+func TestWorkerWithoutPayload(t *testing.T) {
+	for name, result := range map[string]func() chan *staticPool.PExec{
+		"closed": func() chan *staticPool.PExec {
+			ch := make(chan *staticPool.PExec)
+			close(ch)
+			return ch
+		},
+		"nil result": func() chan *staticPool.PExec {
+			ch := make(chan *staticPool.PExec, 1)
+			ch <- nil
+			return ch
+		},
+		"nil payload": func() chan *staticPool.PExec {
+			ch := make(chan *staticPool.PExec, 1)
+			ch <- &staticPool.PExec{}
+			return ch
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p, _ := newTestPlugin(t, nil)
+			p.exec = nil
+			p.wPool = &fakePool{result: result}
+
+			_, err := p.execWorker([]byte("{}"))
+			require.Error(t, err)
+
+			c, _, _ := dialTest(t, startTestServer(t, p))
+			c.cmd("EHLO client.example")
+			code, _ := c.send("a@example.com", []string{"b@example.com"}, "Subject: hi\r\n\r\nbody")
+			require.Equal(t, 451, code)
+		})
+	}
+}
+
+func TestMailCallback(t *testing.T) {
+	p, w := newTestPlugin(t, func(cfg *Config) { cfg.EnableMailCallback = true })
+	w.respond = func(event map[string]any) string {
+		if event["event"] == "MAIL_FROM" && event["from"] == "spammer@example.com" {
+			return "550 5.7.1 Sender blocked"
+		}
+		return "CONTINUE"
+	}
+
+	c, _, _ := dialTest(t, startTestServer(t, p))
+	c.cmd("EHLO client.example")
+
+	code, msg := c.cmd("MAIL FROM:<spammer@example.com> SIZE=100")
+	require.Equal(t, 550, code)
+	require.Equal(t, "5.7.1 Sender blocked", msg)
+
+	code, _ = c.cmd("MAIL FROM:<a@example.com> SIZE=100")
+	require.Equal(t, 250, code)
+
+	events := w.eventsOf("MAIL_FROM")
+	require.Len(t, events, 2)
+	require.Equal(t, float64(100), events[1]["size"])
+
+	// A failed delivery defers the sender
+	w.fail(errors.New("worker timeout"))
+	c.cmd("RSET")
+	code, _ = c.cmd("MAIL FROM:<a@example.com>")
+	require.Equal(t, 451, code)
+}
+
+func TestRcptCallback(t *testing.T) {
+	p, w := newTestPlugin(t, func(cfg *Config) { cfg.EnableRcptCallback = true })
+	w.respond = func(event map[string]any) string {
+		if event["event"] == "RCPT_TO" && event["to"] == "r2@example.com" {
+			return "REJECT"
+		}
+		return "CONTINUE"
+	}
+
+	c, _, _ := dialTest(t, startTestServer(t, p))
+	c.cmd("EHLO client.example")
+	c.cmd("MAIL FROM:<a@example.com>")
+	for _, rcpt := range []string{"r1@example.com", "r2@example.com", "r3@example.com", "r4@example.com"} {
+		code, _ := c.cmd("RCPT TO:<%s>", rcpt)
+		if rcpt == "r2@example.com" {
+			require.Equal(t, 550, code)
+		} else {
+			require.Equal(t, 250, code, rcpt)
+		}
+	}
+	c.cmd("DATA")
+	code, _ := c.cmd("Subject: hi\r\n\r\nbody\r\n.")
+	require.Equal(t, 250, code)
+
+	rcptEvents := w.eventsOf("RCPT_TO")
+	require.Len(t, rcptEvents, 4)
+	require.Equal(t, []any{"r1@example.com", "r3@example.com"}, rcptEvents[3]["accepted"])
+	require.Equal(t, []any{"r1@example.com", "r3@example.com", "r4@example.com"},
+		w.waitEvent(t, "EMAIL_RECEIVED")["allRecipients"])
+}
+
+func TestWorkerCustomReply(t *testing.T) {
+	for _, tc := range []struct {
+		response string
+		code     int
+		msg      string
+	}{
+		{`{"action":"reject","code":550,"message":"Spam detected"}`, 550, "5.0.0 Spam detected"},
+		{`{"action":"reject","code":554,"enhancedCode":"5.7.1","message":"Blocked"}`, 554, "5.7.1 Blocked"},
+		{`{"action":"defer","code":450,"message":"Greylisted"}`, 450, "4.0.0 Greylisted"},
+		{`{"action":"defer"}`, 451, "4.7.1 Try again later"},
+		{`{"action":"accept"}`, 250, "2.0.0 OK: queued"},
+		{"451 4.3.0 Busy", 451, "4.3.0 Busy"},
+		{"CONTINUE", 250, "2.0.0 OK: queued"},
+	} {
+		t.Run(tc.response, func(t *testing.T) {
+			p, w := newTestPlugin(t, nil)
+			w.respond = func(map[string]any) string { return tc.response }
+
+			c, _, _ := dialTest(t, startTestServer(t, p))
+			c.cmd("EHLO client.example")
+			code, msg := c.send("a@example.com", []string{"b@example.com"}, "Subject: hi\r\n\r\nbody")
+			require.Equal(t, tc.code, code)
+			require.Equal(t, tc.msg, msg)
+		})
+	}
+}
+
+func TestConnectEventOncePerConnection(t *testing.T) {
+	p, w := newTestPlugin(t, func(cfg *Config) { cfg.ConnectEvent = true })
+	addr := startTestServer(t, p)
+
+	c, _, _ := dialTest(t, addr)
+	code, _ := c.cmd("HELO client.example")
+	require.Equal(t, 250, code)
+	code, _ = c.cmd("EHLO client.example")
+	require.Equal(t, 250, code)
+	code, _ = c.send("a@example.com", []string{"b@example.com"}, "Subject: hi\r\n\r\nbody")
+	require.Equal(t, 250, code)
+
+	events := w.eventsOf("CONNECTION_OPENED")
+	require.Len(t, events, 1)
+	require.Equal(t, "client.example", events[0]["helo"])
+}
+
+func TestConnectEventRefusalClosesConnection(t *testing.T) {
+	for response, want := range map[string]struct {
+		code int
+		msg  string
+	}{
+		"CLOSE":               {554, "5.7.1 Connection refused"},
+		"REJECT":              {554, "5.7.1 Connection refused"},
+		`{"action":"close"}`:  {554, "5.7.1 Connection refused"},
+		`{"action":"reject"}`: {550, "5.7.1 Rejected by policy"},
+		`{"action":"reject","code":521,"message":"Go away"}`: {521, "5.0.0 Go away"},
+		`{"action":"defer"}`: {451, "4.7.1 Try again later"},
+		"421 4.7.0 Busy":     {421, "4.7.0 Busy"},
+	} {
+		t.Run(response, func(t *testing.T) {
+			p, w := newTestPlugin(t, func(cfg *Config) { cfg.ConnectEvent = true })
+			w.respond = func(map[string]any) string { return response }
+			addr := startTestServer(t, p)
+
+			c, _, _ := dialTest(t, addr)
+			code, msg := c.cmd("EHLO client.example")
+			require.Equal(t, want.code, code)
+			require.Equal(t, want.msg, msg)
+			require.True(t, c.closed())
+			require.Len(t, w.eventsOf("CONNECTION_OPENED"), 1)
+		})
+	}
+}
@@ -0,0 +1,438 @@
+package smtp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testWorker stands in for the worker pool, it records events and answers
+// with respond ("CONTINUE" when nil), or fails every delivery with err
+type testWorker struct {
+	mu      sync.Mutex
+	events  []map[string]any
+	respond func(event map[string]any) string
+	err     error
+}
+
+// fail makes further deliveries return err
+func (w *testWorker) fail(err error) {
+	w.mu.Lock()
+	w.err = err
+	w.mu.Unlock()
+}
+
+func (w *testWorker) exec(jsonData []byte) (string, error) {
+	var event map[string]any
+	if err := json.Unmarshal(jsonData, &event); err != nil {
+		return "", err
+	}
+
+	w.mu.Lock()
+	w.events = append(w.events, event)
+	respond, err := w.respond, w.err
+	w.mu.Unlock()
+
+	if err != nil {
+		return "", err
+	}
+	if respond == nil {
+		return "CONTINUE", nil
+	}
+	return respond(event), nil
+}
+
+// eventsOf returns the recorded events of one kind, "EMAIL_RECEIVED" also
+// matches events without an event field
+func (w *testWorker) eventsOf(kind string) []map[string]any {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var out []map[string]any
+	for _, event := range w.events {
+		name, _ := event["event"].(string)
+		if name == kind || (name == "" && kind == "EMAIL_RECEIVED") {
+			out = append(out, event)
+		}
+	}
+	return out
+}
+
+// waitEvent waits for the first event of a kind delivered asynchronously
+func (w *testWorker) waitEvent(t *testing.T, kind string) map[string]any {
+	t.Helper()
+
+	var event map[string]any
+	require.Eventually(t, func() bool {
+		events := w.eventsOf(kind)
+		if len(events) == 0 {
+			return false
+		}
+		event = events[0]
+		return true
+	}, 5*time.Second, 10*time.Millisecond, "no %s event", kind)
+	return event
+}
+
+// newTestPlugin returns a plugin initialized like Init, with configure applied
+// before the defaults and events going to the returned testWorker
+func newTestPlugin(t *testing.T, configure func(cfg *Config)) (*Plugin, *testWorker) {
+	t.Helper()
+
+	cfg := &Config{}
+	cfg.AttachmentStorage.TempDir = t.TempDir()
+	if configure != nil {
+		configure(cfg)
+	}
+	require.NoError(t, cfg.InitDefaults())
+
+	w := &testWorker{}
+	p := &Plugin{cfg: cfg, log: zap.NewNop(), exec: w.exec}
+	p.stats.startedAt = time.Now()
+	p.dns = newDNSResolver(cfg, &p.stats)
+	p.connLimiter = newRateLimiter(cfg.RateLimit.ConnectionsPerMinute)
+	p.msgLimiter = newRateLimiter(cfg.RateLimit.MessagesPerMinute)
+
+	var err error
+	if cfg.TLS.enabled() {
+		p.tlsConfig, err = cfg.TLS.build()
+		require.NoError(t, err)
+	}
+	p.credentialKey, err = credentialKey(cfg.CredentialKey)
+	require.NoError(t, err)
+
+	return p, w
+}
+
+// testCertificate writes a self-signed certificate for localhost and returns
+// the PEM cert and key paths
+func testCertificate(t *testing.T) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+// newTestSession returns a session as NewSession would create it for a
+// client at 192.0.2.1, without a connection
+func newTestSession(p *Plugin) *Session {
+	return &Session{
+		backend:    NewBackend(p),
+		uuid:       "test-uuid",
+		remoteAddr: "192.0.2.1:4321",
+		remoteIP:   "192.0.2.1",
+		localAddr:  "127.0.0.1:1025",
+		heloName:   "client.example",
+		log:        p.log,
+		helloAt:    time.Now(),
+		mailAt:     time.Now(),
+	}
+}
+
+// startTestServer serves p on a loopback port and returns its address
+func startTestServer(t *testing.T, p *Plugin) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	l := &listener{Listener: ln, plugin: p}
+	p.listener = l
+	p.smtpServer = p.newSMTPServer(NewBackend(p), ln.Addr().String())
+	p.offerStartTLS(p.smtpServer, l)
+
+	go func() { _ = p.smtpServer.Serve(p.listener) }()
+	t.Cleanup(func() { _ = p.smtpServer.Close() })
+
+	return ln.Addr().String()
+}
+
+// testClient is a line based SMTP client for protocol tests
+type testClient struct {
+	t *testing.T
+	*textproto.Conn
+	conn net.Conn
+}
+
+// dialTest connects to addr and returns the client with the greeting reply
+func dialTest(t *testing.T, addr string) (*testClient, int, string) {
+	t.Helper()
+	return dialTestFrom(t, addr, "")
+}
+
+// dialTestFrom is dialTest from the local (loopback) address ip
+func dialTestFrom(t *testing.T, addr, ip string) (*testClient, int, string) {
+	t.Helper()
+
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if ip != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(ip)}
+	}
+	conn, err := dialer.Dial("tcp", addr)
+	require.NoError(t, err)
+	require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+	t.Cleanup(func() { _ = conn.Close() })
+
+	c := &testClient{t: t, Conn: textproto.NewConn(conn), conn: conn}
+	code, msg := c.reply()
+	return c, code, msg
+}
+
+// reply reads one (possibly multiline) reply, code 0 once the connection is gone
+func (c *testClient) reply() (int, string) {
+	c.t.Helper()
+
+	code, msg, err := c.ReadResponse(0)
+	if err != nil {
+		if _, ok := err.(*textproto.Error); !ok {
+			return 0, err.Error()
+		}
+	}
+	return code, msg
+}
+
+// cmd sends a command line and reads its reply
+func (c *testClient) cmd(format string, args ...any) (int, string) {
+	c.t.Helper()
+
+	if err := c.PrintfLine(format, args...); err != nil {
+		return 0, err.Error()
+	}
+	return c.reply()
+}
+
+// send runs a transaction for data and returns the final reply, or the
+// first refusal of MAIL, RCPT or DATA
+func (c *testClient) send(from string, to []string, data string) (int, string) {
+	c.t.Helper()
+
+	if code, msg := c.cmd("MAIL FROM:<%s>", from); code != 250 {
+		return code, msg
+	}
+	for _, rcpt := range to {
+		if code, msg := c.cmd("RCPT TO:<%s>", rcpt); code != 250 {
+			return code, msg
+		}
+	}
+	if code, msg := c.cmd("DATA"); code != 354 {
+		return code, msg
+	}
+	return c.cmd("%s\r\n.", data)
+}
+
+// startTLS sends STARTTLS and continues the dialog over TLS
+func (c *testClient) startTLS(config *tls.Config) {
+	c.t.Helper()
+
+	code, msg := c.cmd("STARTTLS")
+	require.Equal(c.t, 220, code, msg)
+
+	tc := tls.Client(c.conn, config)
+	require.NoError(c.t, tc.Handshake())
+	c.conn = tc
+	c.Conn = textproto.NewConn(tc)
+}
+
+// closed reports whether the server closed the connection, waiting up to 2s
+func (c *testClient) closed() bool {
+	_ = c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := c.R.ReadByte()
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false
+	}
+	return err != nil
+}
+
+// fakeDNS answers the queries of a net.Resolver from static records, names
+// absent from every map are NXDOMAIN. Keys are names without the trailing dot.
+type fakeDNS struct {
+	a        map[string][]string // A and AAAA
+	txt      map[string][]string
+	mx       map[string][]string
+	ptr      map[string][]string // keyed by reverse name, e.g. "1.2.0.192.in-addr.arpa"
+	servfail map[string]bool
+	silent   map[string]bool // never answered
+
+	mu      sync.Mutex
+	queries int
+}
+
+// install makes p resolve through f
+func (f *fakeDNS) install(p *Plugin) {
+	p.dns.resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(context.Context, string, string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go f.serve(server)
+			return client, nil
+		},
+	}
+}
+
+// queryCount returns the number of queries answered so far
+func (f *fakeDNS) queryCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.queries
+}
+
+// serve answers length prefixed (TCP style) DNS messages, net.Pipe is not a PacketConn
+func (f *fakeDNS) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		answer, err := f.answer(query)
+		if err != nil {
+			return
+		}
+		if answer == nil {
+			continue
+		}
+		out := binary.BigEndian.AppendUint16(nil, uint16(len(answer)))
+		if _, err := conn.Write(append(out, answer...)); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeDNS) answer(query []byte) ([]byte, error) {
+	f.mu.Lock()
+	f.queries++
+	f.mu.Unlock()
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := parser.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	name := strings.TrimSuffix(strings.ToLower(q.Name.String()), ".")
+	if f.silent[name] {
+		return nil, nil
+	}
+	_, inA := f.a[name]
+	_, inTXT := f.txt[name]
+	_, inMX := f.mx[name]
+	_, inPTR := f.ptr[name]
+
+	rcode := dnsmessage.RCodeSuccess
+	switch {
+	case f.servfail[name]:
+		rcode = dnsmessage.RCodeServerFailure
+	case !inA && !inTXT && !inMX && !inPTR:
+		rcode = dnsmessage.RCodeNameError
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		Authoritative:      true,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: 60}
+	if rcode == dnsmessage.RCodeSuccess {
+		switch q.Type {
+		case dnsmessage.TypeA, dnsmessage.TypeAAAA:
+			for _, addr := range f.a[name] {
+				ip := net.ParseIP(addr)
+				if v4 := ip.To4(); v4 != nil && q.Type == dnsmessage.TypeA {
+					err = b.AResource(rh, dnsmessage.AResource{A: [4]byte(v4)})
+				} else if v4 == nil && q.Type == dnsmessage.TypeAAAA {
+					err = b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())})
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+		case dnsmessage.TypeTXT:
+			for _, txt := range f.txt[name] {
+				if err := b.TXTResource(rh, dnsmessage.TXTResource{TXT: []string{txt}}); err != nil {
+					return nil, err
+				}
+			}
+		case dnsmessage.TypeMX:
+			for i, host := range f.mx[name] {
+				mx := dnsmessage.MXResource{Pref: uint16(10 * (i + 1)), MX: dnsmessage.MustNewName(host + ".")}
+				if err := b.MXResource(rh, mx); err != nil {
+					return nil, err
+				}
+			}
+		case dnsmessage.TypePTR:
+			for _, host := range f.ptr[name] {
+				if err := b.PTRResource(rh, dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(host + ".")}); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return b.Finish()
+}
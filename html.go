@@ -0,0 +1,73 @@
+package smtp
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// htmlToText renders an HTML body as plain text: tags are dropped, entities
+// decoded, script/style content skipped and block elements end a line
+func htmlToText(body string) string {
+	z := html.NewTokenizer(strings.NewReader(body))
+
+	var (
+		b    strings.Builder
+		skip int // depth inside script/style/head
+	)
+
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			// io.EOF or malformed input, keep what was rendered
+			return collapseLines(b.String())
+
+		case html.TextToken:
+			if skip == 0 {
+				b.Write(z.Text())
+			}
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			switch a := atom.Lookup(name); {
+			case a == atom.Script || a == atom.Style || a == atom.Head:
+				skip++
+			case isBlockElement(a):
+				b.WriteByte('\n')
+			}
+
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch a := atom.Lookup(name); {
+			case (a == atom.Script || a == atom.Style || a == atom.Head) && skip > 0:
+				skip--
+			case isBlockElement(a):
+				b.WriteByte('\n')
+			}
+		}
+	}
+}
+
+// isBlockElement reports whether an element starts a new line in text output
+func isBlockElement(a atom.Atom) bool {
+	switch a {
+	case atom.Br, atom.P, atom.Div, atom.Li, atom.Tr, atom.Table, atom.Ul, atom.Ol,
+		atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6,
+		atom.Blockquote, atom.Pre, atom.Hr, atom.Section, atom.Article:
+		return true
+	}
+	return false
+}
+
+// collapseLines collapses whitespace within lines and drops blank lines
+func collapseLines(text string) string {
+	lines := strings.Split(text, "\n")
+	out := lines[:0]
+	for _, line := range lines {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			out = append(out, line)
+		}
+	}
+	return strings.Join(out, "\n")
+}
@@ -0,0 +1,70 @@
+package smtp
+
+import (
+	"bytes"
+	"errors"
+	"net/mail"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/google/uuid"
+)
+
+// WorkerResponse is the outcome of a message injected over RPC
+type WorkerResponse struct {
+	UUID     string `json:"uuid"`
+	Response string `json:"response"` // worker response, e.g. "CONTINUE"
+	Code     int    `json:"code"`     // SMTP reply code a client would have received
+	Message  string `json:"message"`
+}
+
+// inject runs a raw message through the same store, parse and delivery path as
+// DATA. The envelope is taken from the From, To and Cc headers.
+func (p *Plugin) inject(raw []byte) *WorkerResponse {
+	s := &Session{
+		backend: NewBackend(p),
+		uuid:    uuid.NewString(),
+		log:     p.log,
+	}
+	s.connectedAt = time.Now()
+	s.helloAt = s.connectedAt
+	s.mailAt = s.connectedAt
+
+	if msg, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		if from, err := msg.Header.AddressList("From"); err == nil && len(from) > 0 {
+			s.from = from[0].Address
+		}
+		for _, key := range []string{"To", "Cc"} {
+			if addrs, err := msg.Header.AddressList(key); err == nil {
+				for _, addr := range addrs {
+					s.to = append(s.to, addr.Address)
+				}
+			}
+		}
+	}
+
+	out := &WorkerResponse{UUID: s.uuid, Code: 250, Message: "OK"}
+
+	var err error
+	size := int64(len(raw))
+	if size > p.cfg.messageSizeLimitFor(s.to) {
+		err = errMessageTooLarge
+	} else {
+		s.emailData.Write(raw)
+		err = s.processMessage(size, size, s.connectedAt, time.Now())
+	}
+
+	out.Response = s.lastResponse
+	if err != nil {
+		var smtpErr *smtp.SMTPError
+		if errors.As(err, &smtpErr) {
+			out.Code = smtpErr.Code
+			out.Message = smtpErr.Message
+		} else {
+			out.Code = 451
+			out.Message = err.Error()
+		}
+	}
+
+	return out
+}
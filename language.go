@@ -0,0 +1,45 @@
+package smtp
+
+import (
+	"strings"
+
+	"github.com/abadojack/whatlanggo"
+)
+
+// languageSampleSize bounds the text passed to the detector
+const languageSampleSize = 4096
+
+// detectLanguage returns the ISO 639-1 code of the body language,
+// or "" when the body is empty or detection is not reliable.
+// HTML-only bodies are rendered to text first.
+func detectLanguage(msg *ParsedMessage) string {
+	text := msg.TextBody
+	if strings.TrimSpace(text) == "" {
+		text = htmlToText(msg.HTMLBody)
+	}
+
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return ""
+	}
+
+	// Cut on a rune boundary
+	if len(text) > languageSampleSize {
+		cut := languageSampleSize
+		for cut > 0 && !isRuneStart(text[cut]) {
+			cut--
+		}
+		text = text[:cut]
+	}
+
+	info := whatlanggo.Detect(text)
+	if !info.IsReliable() {
+		return ""
+	}
+	return info.Lang.Iso6391()
+}
+
+// isRuneStart reports whether b starts a UTF-8 sequence
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
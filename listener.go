@@ -0,0 +1,736 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// invalidCommandReplies are go-smtp reply texts sent for unknown or malformed commands
+var invalidCommandReplies = [][]byte{
+	[]byte("command unrecognized"),
+	[]byte("Error: bad syntax"),
+	[]byte("Bad command"),
+	[]byte("command not implemented"),
+}
+
+// listener wraps accepted connections with protocol level guards
+type listener struct {
+	net.Listener
+	plugin *Plugin
+
+	// STARTTLS is offered and terminated by guardedConn when set
+	tlsConfig *tls.Config
+}
+
+// Accept waits for the next connection and wraps it
+func (l *listener) Accept() (net.Conn, error) {
+	var c net.Conn
+	for {
+		var err error
+		c, err = l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		// Counted here, go-smtp creates a session per HELO/EHLO and after STARTTLS
+		l.plugin.stats.connections.Add(1)
+
+		if ip := remoteIP(c.RemoteAddr()); !l.plugin.cfg.clientAllowed(ip) {
+			l.plugin.log.Info("client rejected by allow_cidrs/deny_cidrs", zap.String("remote_ip", ip))
+			go l.refuse(c)
+			continue
+		}
+		break
+	}
+
+	client := newClientConn(c, l.plugin)
+	cfg := l.plugin.cfg
+	if !cfg.guardsConnections() {
+		return client, nil
+	}
+
+	var emulate *mtaPreset
+	if preset, ok := mtaPresets[cfg.Emulate]; ok {
+		emulate = &preset
+	}
+	return &guardedConn{
+		Conn:         client,
+		log:          l.plugin.log,
+		maxInvalid:   cfg.MaxInvalidCommands,
+		reply:        []byte("421 4.7.0 " + cfg.InvalidCommandsReply + "\r\n"),
+		captureRaw:   cfg.CaptureRawCommands,
+		tlsConfig:    l.tlsConfig,
+		bannerDelay:  cfg.BannerDelay,
+		hostname:     cfg.Hostname,
+		banner:       cfg.Banner,
+		ehloGreeting: cfg.EhloGreeting,
+		quitMessage:  cfg.QuitMessage,
+		emulate:      emulate,
+	}, nil
+}
+
+// refuse answers a client refused before the greeting and closes the connection
+func (l *listener) refuse(c net.Conn) {
+	defer c.Close()
+
+	// Also bounds the handshake of implicit TLS connections
+	_ = c.SetDeadline(time.Now().Add(l.plugin.cfg.WriteTimeout))
+	_, _ = c.Write([]byte("554 5.7.1 Access denied\r\n"))
+}
+
+// clientConn carries the state of one accepted connection. go-smtp creates a
+// new session for every HELO/EHLO and after STARTTLS, whatever spans the whole
+// connection lives here.
+type clientConn struct {
+	net.Conn
+	plugin *Plugin
+
+	// Connection id, shared by all sessions of the connection
+	uuid string
+
+	// TCP accept time, go-smtp creates sessions only on HELO/EHLO
+	acceptedAt time.Time
+
+	mu    sync.Mutex
+	trace []CommandTraceEntry
+
+	// Close once the next reply is written, for refusals after which go-smtp
+	// would keep the connection open
+	closeAfterReply atomic.Bool
+
+	// DNSBL result, looked up on the first HELO/EHLO
+	dnsblOnce     sync.Once
+	dnsblListings []string
+
+	// Connection rate limit decision, taken on the first HELO/EHLO
+	rateOnce    sync.Once
+	rateLimited bool
+
+	// Worker decision on the CONNECTION_OPENED event (connect_event)
+	connectOnce  sync.Once
+	connectReply *smtp.SMTPError
+
+	closeOnce sync.Once
+}
+
+// newClientConn wraps an accepted connection
+func newClientConn(c net.Conn, p *Plugin) *clientConn {
+	cc := &clientConn{
+		Conn:       c,
+		plugin:     p,
+		uuid:       uuid.NewString(),
+		acceptedAt: time.Now(),
+	}
+	p.clients.Store(cc, struct{}{})
+	return cc
+}
+
+// clientConnOf returns the clientConn under c, looking through TLS and
+// guardedConn wrappers, nil if there is none
+func clientConnOf(c net.Conn) *clientConn {
+	for {
+		switch conn := c.(type) {
+		case *clientConn:
+			return conn
+		case *guardedConn:
+			c = conn.Conn
+		case *tls.Conn:
+			c = conn.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// Close closes the connection, the CONNECTION_CLOSED event is sent once
+func (c *clientConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(c.closed)
+	return err
+}
+
+// Write writes to the client, closing the connection after it when closeAfterReply is set
+func (c *clientConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if c.closeAfterReply.Load() {
+		_ = c.Close()
+	}
+	return n, err
+}
+
+// closed runs once the connection is gone
+func (c *clientConn) closed() {
+	c.plugin.clients.Delete(c)
+	if c.plugin.cfg.TraceCommands {
+		go c.plugin.sendCloseEvent(c)
+	}
+}
+
+// dnsbl returns the DNSBL listings of the client, queried once per connection
+func (c *clientConn) dnsbl() []string {
+	c.dnsblOnce.Do(func() {
+		c.dnsblListings = c.plugin.checkDNSBL(remoteIP(c.RemoteAddr()))
+	})
+	return c.dnsblListings
+}
+
+// rateLimit reports whether the client exceeded rate_limit.connections_per_minute,
+// a token is taken once per connection
+func (c *clientConn) rateLimit() bool {
+	c.rateOnce.Do(func() {
+		if ip := remoteIP(c.RemoteAddr()); ip != "" {
+			c.rateLimited = !c.plugin.connLimiter.allow(ip, time.Now())
+		}
+	})
+	return c.rateLimited
+}
+
+// connectEvent sends the CONNECTION_OPENED event of the first session once
+// per connection and returns the refusal reply, nil when the client may proceed
+func (c *clientConn) connectEvent(s *Session) *smtp.SMTPError {
+	c.connectOnce.Do(func() {
+		c.connectReply = s.connectRefused()
+	})
+	return c.connectReply
+}
+
+// addTrace records an SMTP command in the connection command trace
+func (c *clientConn) addTrace(command, args string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.trace = append(c.trace, CommandTraceEntry{
+		Command: command,
+		Args:    args,
+		Time:    time.Now(),
+	})
+}
+
+// relabelGreeting renames the last HELO entry, go-smtp creates the session
+// before the session can tell HELO from EHLO
+func (c *clientConn) relabelGreeting(command string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := len(c.trace) - 1; i >= 0; i-- {
+		if c.trace[i].Command == "HELO" {
+			c.trace[i].Command = command
+			return
+		}
+	}
+}
+
+// commandTrace returns a copy of the commands recorded so far
+func (c *clientConn) commandTrace() []CommandTraceEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.trace)
+}
+
+// go-smtp reply texts replaced by banner, ehlo_greeting and quit_message
+var (
+	goSMTPQuitReply   = []byte("221 2.0.0 Bye\r\n")
+	goSMTPEhloPrefix  = []byte("250-Hello ")
+	goSMTPHeloPrefix  = []byte("250 2.0.0 Hello ")
+	goSMTPGreetPrefix = []byte("220 ")
+
+	// STARTTLS terminated by guardedConn
+	startTLSCapability = []byte("250-STARTTLS\r\n")
+	startTLSReply      = []byte("220 2.0.0 Ready to start TLS\r\n")
+	regreetReply       = []byte("502 5.5.1 Please introduce yourself first.\r\n")
+)
+
+// isClosedError reports whether err comes from a server or listener that was
+// closed on purpose rather than a genuine accept or bind failure
+func isClosedError(err error) bool {
+	return errors.Is(err, smtp.ErrServerClosed) || errors.Is(err, net.ErrClosed)
+}
+
+// errEarlyTalker is returned for the greeting write to a client that talked first
+var errEarlyTalker = errors.New("client sent data before greeting")
+
+// earlyTalkerReply is sent to clients that talk before the greeting
+var earlyTalkerReply = []byte("554 5.5.1 Protocol error: data sent before greeting\r\n")
+
+// guardedConn observes the SMTP dialog on the wire, go-smtp has no hooks for it.
+// It counts invalid commands from server replies, records raw MAIL/RCPT lines,
+// holds the greeting for banner_delay and replaces reply texts. Connections are
+// only wrapped when one of these is configured, see Config.guardsConnections.
+// With a tlsConfig it terminates STARTTLS itself instead of go-smtp, so the
+// dialog stays observable after the upgrade, and resets go-smtp's state as its
+// own STARTTLS would.
+type guardedConn struct {
+	net.Conn
+	log *zap.Logger
+
+	mu         sync.Mutex
+	invalid    int
+	maxInvalid int
+	reply      []byte
+	closed     bool
+
+	// Greeting delay (banner_delay), checked on the first write
+	bannerDelay time.Duration
+	greeted     bool
+
+	// STARTTLS, go-smtp's server has no TLSConfig when set
+	tlsConfig *tls.Config
+	tlsConn   atomic.Pointer[tls.Conn] // carries the dialog after STARTTLS
+	startTLS  bool                     // STARTTLS received, upgrade before the next read
+	backlog   []byte                   // client data not yet handed to go-smtp
+	held      int                      // leading bytes of pending withheld, they may be STARTTLS
+	regreet   bool                     // after STARTTLS, commands are refused until HELO/EHLO
+	dropReply bool                     // reply to the RSET injected after STARTTLS, not for the client
+
+	// Reply text replacements, empty keeps the go-smtp text
+	hostname     string
+	banner       string
+	ehloGreeting string
+	quitMessage  string
+	emulate      *mtaPreset // success replies, nil without emulate
+
+	// Client line tracking
+	pending  []byte // incomplete client line
+	overflow bool   // current line exceeded maxRawLine, skip until newline
+	inData   bool   // inside DATA, lines are message content
+	bdatLeft int64  // BDAT chunk bytes still to come
+	commands int    // client lines go-smtp answers
+	replies  int    // final reply lines written, greeting excluded
+	dataCmd  int    // number of the DATA command awaiting its reply, 0 for none
+
+	// Raw command capture
+	captureRaw bool
+	mailLines  []string
+	rcptLines  []string
+}
+
+// maxRawLine bounds the buffered partial client line
+const maxRawLine = 2000
+
+// transport returns the connection carrying the dialog, TLS after STARTTLS
+func (c *guardedConn) transport() net.Conn {
+	if tc := c.tlsConn.Load(); tc != nil {
+		return tc
+	}
+	return c.Conn
+}
+
+// Read passes client data through to go-smtp. Lines are tracked to record raw
+// MAIL FROM/RCPT TO and to take STARTTLS out of the stream.
+func (c *guardedConn) Read(b []byte) (int, error) {
+	if !c.captureRaw && c.tlsConfig == nil {
+		return c.Conn.Read(b)
+	}
+
+	for {
+		if len(c.backlog) > 0 {
+			n := copy(b, c.backlog)
+			c.backlog = c.backlog[n:]
+			return n, nil
+		}
+
+		if c.startTLS {
+			c.startTLS = false
+			if err := c.upgrade(); err != nil {
+				return 0, err
+			}
+			// go-smtp still holds the plain text transaction, RFC 3207 wants it gone
+			c.backlog = append(c.backlog, "RSET\r\n"...)
+			c.dropReply = true
+			continue
+		}
+
+		n, err := c.transport().Read(b)
+		if n > 0 {
+			out := c.filterClient(b[:n])
+			n = copy(b, out)
+			c.backlog = append(c.backlog, out[n:]...)
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// filterClient tracks client lines and returns the part of data go-smtp gets.
+// A partial line that may still turn out to be STARTTLS is withheld, STARTTLS
+// and anything pipelined after it never reach go-smtp (RFC 3207).
+func (c *guardedConn) filterClient(data []byte) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.regreet {
+		if data = c.awaitGreeting(data); len(data) == 0 {
+			return nil
+		}
+	}
+
+	var release []byte // withheld bytes that turned out not to be STARTTLS
+	cut := len(data)
+
+	for pos := 0; pos < len(data); {
+		rest := data[pos:]
+		if c.bdatLeft > 0 {
+			skip := min(int64(len(rest)), c.bdatLeft)
+			c.bdatLeft -= skip
+			pos += int(skip)
+			continue
+		}
+
+		idx := bytes.IndexByte(rest, '\n')
+		if idx < 0 {
+			held := c.held
+			c.appendPending(rest)
+			if c.mayStartTLS() && !c.overflow && hasPrefixFold([]byte("STARTTLS\r\n"), c.pending) {
+				c.held = len(c.pending)
+				cut = pos
+			} else if held > 0 {
+				release = slices.Clone(c.pending[:held])
+				c.held = 0
+			}
+			break
+		}
+
+		c.appendPending(rest[:idx])
+		line := string(bytes.TrimRight(c.pending, "\r"))
+		if c.mayStartTLS() && !c.overflow && strings.EqualFold(line, "STARTTLS") {
+			c.startTLS = true
+			c.pending, c.held = c.pending[:0], 0
+			cut = pos
+			break
+		}
+		if c.held > 0 {
+			release = slices.Clone(c.pending[:c.held])
+			c.held = 0
+		}
+		if !c.overflow {
+			c.handleLine(line)
+		}
+
+		c.pending = c.pending[:0]
+		c.overflow = false
+		pos += idx + 1
+	}
+
+	if release == nil {
+		return data[:cut]
+	}
+	return append(release, data[:cut]...)
+}
+
+// awaitGreeting refuses the client lines sent after STARTTLS before HELO/EHLO,
+// go-smtp keeps the greeting of the plain text dialog otherwise. It returns the
+// data from the greeting (or QUIT) line on, nil while still waiting for it.
+func (c *guardedConn) awaitGreeting(data []byte) []byte {
+	for len(data) > 0 {
+		idx := bytes.IndexByte(data, '\n')
+		if idx < 0 {
+			c.appendPending(data)
+			return nil
+		}
+
+		c.appendPending(data[:idx])
+		line, overflow := string(bytes.TrimRight(c.pending, "\r")), c.overflow
+		c.pending, c.overflow = c.pending[:0], false
+		data = data[idx+1:]
+
+		verb, arg, _ := strings.Cut(line, " ")
+		greets := (strings.EqualFold(verb, "HELO") || strings.EqualFold(verb, "EHLO")) && strings.TrimSpace(arg) != ""
+		if !overflow && (greets || strings.EqualFold(line, "QUIT")) {
+			c.regreet = false
+			return append([]byte(line+"\r\n"), data...)
+		}
+		if _, err := c.transport().Write(regreetReply); err != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+// appendPending adds to the partial line unless it exceeds maxRawLine
+func (c *guardedConn) appendPending(data []byte) {
+	if !c.overflow && len(c.pending)+len(data) <= maxRawLine {
+		c.pending = append(c.pending, data...)
+		return
+	}
+	c.overflow = true
+	c.pending = c.pending[:0]
+}
+
+// mayStartTLS reports whether a STARTTLS line would be a command to upgrade
+func (c *guardedConn) mayStartTLS() bool {
+	return c.tlsConfig != nil && c.tlsConn.Load() == nil && !c.inData && c.bdatLeft == 0
+}
+
+// hasPrefixFold reports whether prefix is a case-insensitive prefix of s
+func hasPrefixFold(s, prefix []byte) bool {
+	return len(prefix) <= len(s) && bytes.EqualFold(s[:len(prefix)], prefix)
+}
+
+// handleLine records a complete client line
+func (c *guardedConn) handleLine(line string) {
+	if c.inData {
+		if line == "." {
+			c.inData = false
+			c.commands++
+		}
+		return
+	}
+	c.commands++
+
+	switch upper := strings.ToUpper(line); {
+	case strings.HasPrefix(upper, "MAIL FROM:"):
+		if c.captureRaw {
+			c.mailLines = append(c.mailLines, line)
+		}
+	case strings.HasPrefix(upper, "RCPT TO:"):
+		if c.captureRaw {
+			c.rcptLines = append(c.rcptLines, line)
+		}
+	case upper == "DATA":
+		// Content follows only once go-smtp answered 354
+		c.dataCmd = c.commands
+	case strings.HasPrefix(upper, "BDAT "):
+		c.bdatLeft = bdatSize(line[len("BDAT "):])
+	}
+}
+
+// bdatSize returns the chunk size of valid BDAT arguments, go-smtp reads no
+// chunk for invalid ones. A chunk refused for a missing RCPT TO is not read
+// either, its bytes are then taken as commands on both sides.
+func bdatSize(arg string) int64 {
+	args := strings.Fields(arg)
+	if len(args) == 0 || len(args) > 2 || (len(args) == 2 && !strings.EqualFold(args[1], "LAST")) {
+		return 0
+	}
+	size, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		return 0
+	}
+	return int64(size)
+}
+
+// trackReply matches a reply line to the client command it answers,
+// DATA content starts only after a 354
+func (c *guardedConn) trackReply(b []byte) {
+	if len(b) < 4 || b[3] == '-' {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.replies++
+	if c.dataCmd != 0 && c.replies >= c.dataCmd {
+		c.inData = c.replies == c.dataCmd && bytes.HasPrefix(b, []byte("354"))
+		c.dataCmd = 0
+	}
+}
+
+// upgrade answers STARTTLS and runs the handshake, the client greets again after it
+func (c *guardedConn) upgrade() error {
+	if _, err := c.Conn.Write(startTLSReply); err != nil {
+		return err
+	}
+
+	tc := tls.Server(c.Conn, c.tlsConfig)
+	if err := tc.Handshake(); err != nil {
+		c.log.Debug("STARTTLS handshake failed",
+			zap.String("remote_addr", addrString(c.RemoteAddr())),
+			zap.Error(err),
+		)
+		return err
+	}
+
+	c.tlsConn.Store(tc)
+
+	c.mu.Lock()
+	c.regreet = true
+	c.mailLines, c.rcptLines = nil, nil
+	c.mu.Unlock()
+	return nil
+}
+
+// tlsState returns the state of a STARTTLS upgrade done by the connection
+func (c *guardedConn) tlsState() (tls.ConnectionState, bool) {
+	if tc := c.tlsConn.Load(); tc != nil {
+		return tc.ConnectionState(), true
+	}
+	return tls.ConnectionState{}, false
+}
+
+// Close closes the connection, sending close_notify after STARTTLS
+func (c *guardedConn) Close() error {
+	if tc := c.tlsConn.Load(); tc != nil {
+		return tc.Close()
+	}
+	return c.Conn.Close()
+}
+
+// popRawCommand returns the oldest recorded line containing addr,
+// dropping older lines that go-smtp rejected before reaching the session
+func popRawCommand(lines *[]string, addr string) string {
+	for i, line := range *lines {
+		if strings.Contains(strings.ToLower(line), strings.ToLower(addr)) {
+			*lines = (*lines)[i+1:]
+			return line
+		}
+	}
+	return ""
+}
+
+// rawMailFrom returns the raw MAIL FROM line for the given address
+func (c *guardedConn) rawMailFrom(addr string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return popRawCommand(&c.mailLines, addr)
+}
+
+// rawRcptTo returns the raw RCPT TO line for the given address
+func (c *guardedConn) rawRcptTo(addr string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return popRawCommand(&c.rcptLines, addr)
+}
+
+// Write passes the server reply through and closes the connection
+// once the client exceeds max_invalid_commands
+func (c *guardedConn) Write(b []byte) (int, error) {
+	if c.dropReply {
+		c.dropReply = false
+		return len(b), nil
+	}
+
+	// The first write is the 220 greeting
+	greeting := !c.greeted
+	if greeting {
+		c.greeted = true
+		if c.bannerDelay > 0 && !c.waitBanner() {
+			return 0, errEarlyTalker
+		}
+	} else {
+		c.trackReply(b)
+	}
+
+	out := b
+	if replaced := c.rewriteReply(b, greeting); replaced != nil {
+		out = replaced
+	}
+	// go-smtp does not know about STARTTLS handled here
+	if c.tlsConfig != nil && c.tlsConn.Load() == nil && bytes.HasPrefix(b, goSMTPEhloPrefix) {
+		out = append(slices.Clip(out), startTLSCapability...)
+	}
+
+	conn := c.transport()
+	if _, err := conn.Write(out); err != nil {
+		return 0, err
+	}
+
+	if c.maxInvalid <= 0 {
+		return len(b), nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return len(b), nil
+	}
+
+	for _, line := range bytes.Split(b, []byte("\r\n")) {
+		if isInvalidCommandReply(line) {
+			c.invalid++
+		}
+	}
+
+	if c.invalid >= c.maxInvalid {
+		c.closed = true
+		c.log.Info("too many invalid commands, closing connection",
+			zap.String("remote_addr", addrString(c.RemoteAddr())),
+			zap.Int("invalid_commands", c.invalid),
+		)
+		_, _ = conn.Write(c.reply)
+		_ = c.Close()
+	}
+
+	return len(b), nil
+}
+
+// rewriteReply returns the configured replacement for a go-smtp reply line or nil.
+// go-smtp flushes every reply line separately, so each is a whole write.
+func (c *guardedConn) rewriteReply(b []byte, greeting bool) []byte {
+	ip := remoteIP(c.RemoteAddr())
+
+	switch {
+	case greeting && c.banner != "" && bytes.HasPrefix(b, goSMTPGreetPrefix):
+		return []byte("220 " + expandResponse(c.banner, c.hostname, "", ip) + "\r\n")
+
+	case c.ehloGreeting != "" && bytes.HasPrefix(b, goSMTPEhloPrefix):
+		helo := string(bytes.TrimSpace(b[len(goSMTPEhloPrefix):]))
+		return []byte("250-" + expandResponse(c.ehloGreeting, c.hostname, helo, ip) + "\r\n")
+
+	case c.ehloGreeting != "" && bytes.HasPrefix(b, goSMTPHeloPrefix):
+		helo := string(bytes.TrimSpace(b[len(goSMTPHeloPrefix):]))
+		return []byte("250 " + expandResponse(c.ehloGreeting, c.hostname, helo, ip) + "\r\n")
+
+	case c.quitMessage != "" && bytes.Equal(b, goSMTPQuitReply):
+		return []byte("221 2.0.0 " + expandResponse(c.quitMessage, c.hostname, "", ip) + "\r\n")
+
+	case c.emulate != nil:
+		return c.emulate.rewrite(b)
+	}
+
+	return nil
+}
+
+// waitBanner holds the greeting for banner_delay and reports whether the client
+// stayed silent. Early talkers get a 554 and the connection is closed.
+func (c *guardedConn) waitBanner() bool {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.bannerDelay)); err != nil {
+		return true
+	}
+
+	var buf [1]byte
+	n, err := c.Conn.Read(buf[:])
+
+	var netErr net.Error
+	if n == 0 && errors.As(err, &netErr) && netErr.Timeout() {
+		// go-smtp sets its own read deadline before each command
+		_ = c.Conn.SetReadDeadline(time.Time{})
+		return true
+	}
+
+	if n > 0 {
+		c.log.Info("early talker rejected", zap.String("remote_addr", addrString(c.RemoteAddr())))
+		_, _ = c.Conn.Write(earlyTalkerReply)
+	}
+
+	_ = c.Conn.Close()
+	return false
+}
+
+// isInvalidCommandReply reports whether a reply line rejects an unknown or malformed command
+func isInvalidCommandReply(line []byte) bool {
+	if len(line) < 4 || (line[0] != '5' || line[1] != '0') {
+		return false
+	}
+
+	for _, text := range invalidCommandReplies {
+		if bytes.Contains(line, text) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,403 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func traceCommands(event map[string]any) []string {
+	var commands []string
+	for _, entry := range event["commandTrace"].([]any) {
+		commands = append(commands, entry.(map[string]any)["command"].(string))
+	}
+	return commands
+}
+
+func TestCommandTraceRecordsGreetingVerb(t *testing.T) {
+	p, w := newTestPlugin(t, func(cfg *Config) { cfg.TraceCommands = true })
+	addr := startTestServer(t, p)
+
+	c, code, _ := dialTest(t, addr)
+	require.Equal(t, 220, code)
+
+	code, _ = c.cmd("HELO client.example")
+	require.Equal(t, 250, code)
+	code, _ = c.cmd("EHLO client.example")
+	require.Equal(t, 250, code)
+	code, _ = c.cmd("MAIL FROM:<a@example.com>")
+	require.Equal(t, 250, code)
+	code, _ = c.cmd("QUIT")
+	require.Equal(t, 221, code)
+
+	event := w.waitEvent(t, "CONNECTION_CLOSED")
+	require.Equal(t, []string{"HELO", "EHLO", "MAIL"}, traceCommands(event))
+	require.NotEmpty(t, event["uuid"])
+}
+
+func TestCommandTraceInMessageEvent(t *testing.T) {
+	p, w := newTestPlugin(t, func(cfg *Config) { cfg.TraceCommands = true })
+	addr := startTestServer(t, p)
+
+	c, _, _ := dialTest(t, addr)
+	c.cmd("EHLO client.example")
+	c.cmd("MAIL FROM:<a@example.com>")
+	c.cmd("RCPT TO:<b@example.com>")
+	code, _ := c.cmd("DATA")
+	require.Equal(t, 354, code)
+	code, _ = c.cmd("Subject: hi\r\n\r\nbody\r\n.")
+	require.Equal(t, 250, code)
+
+	events := w.eventsOf("EMAIL_RECEIVED")
+	require.Len(t, events, 1)
+	require.Equal(t, []string{"EHLO", "MAIL", "RCPT", "DATA"}, traceCommands(events[0]))
+
+	c.cmd("QUIT")
+	closed := w.waitEvent(t, "CONNECTION_CLOSED")
+	require.Equal(t, []string{"EHLO", "MAIL", "RCPT", "DATA"}, traceCommands(closed))
+}
+
+// rawCommandsPlugin serves a plugin capturing raw commands with STARTTLS
+func rawCommandsPlugin(t *testing.T) (*testWorker, string) {
+	certFile, keyFile := testCertificate(t)
+	p, w := newTestPlugin(t, func(cfg *Config) {
+		cfg.CaptureRawCommands = true
+		cfg.TLS.CertFile, cfg.TLS.KeyFile = certFile, keyFile
+	})
+	return w, startTestServer(t, p)
+}
+
+func TestRawCommandsCapturedAfterStartTLS(t *testing.T) {
+	w, addr := rawCommandsPlugin(t)
+
+	c, _, _ := dialTest(t, addr)
+	code, msg := c.cmd("EHLO client.example")
+	require.Equal(t, 250, code)
+	require.Contains(t, msg, "STARTTLS")
+
+	c.startTLS(&tls.Config{InsecureSkipVerify: true, ServerName: "localhost"})
+
+	code, msg = c.cmd("EHLO client.example")
+	require.Equal(t, 250, code)
+	require.NotContains(t, msg, "STARTTLS")
+	c.cmd("MAIL FROM:<a@example.com> BODY=8BITMIME")
+	c.cmd("RCPT TO:<b@example.com>")
+	c.cmd("DATA")
+	code, _ = c.cmd("Subject: hi\r\n\r\nbody\r\n.")
+	require.Equal(t, 250, code)
+
+	event := w.waitEvent(t, "EMAIL_RECEIVED")
+	require.Equal(t, "MAIL FROM:<a@example.com> BODY=8BITMIME", event["mailFromRaw"])
+	require.Equal(t, []any{"RCPT TO:<b@example.com>"}, event["rcptToRaw"])
+	require.Equal(t, true, event["connection"].(map[string]any)["tls"])
+}
+
+func TestRawCommandsAfterRejectedData(t *testing.T) {
+	w, addr := rawCommandsPlugin(t)
+
+	c, _, _ := dialTest(t, addr)
+	c.cmd("EHLO client.example")
+	c.cmd("MAIL FROM:<a@example.com>")
+	// Refused without a recipient, the following lines are still commands
+	code, _ := c.cmd("DATA")
+	require.Equal(t, 502, code)
+	c.cmd("RSET")
+	c.cmd("MAIL FROM:<a@example.com> SIZE=10")
+	c.cmd("RCPT TO:<b@example.com>")
+	code, _ = c.cmd("DATA")
+	require.Equal(t, 354, code)
+	code, _ = c.cmd("Subject: hi\r\n\r\nbody\r\n.")
+	require.Equal(t, 250, code)
+
+	event := w.waitEvent(t, "EMAIL_RECEIVED")
+	require.Equal(t, "MAIL FROM:<a@example.com> SIZE=10", event["mailFromRaw"])
+}
+
+func TestRawCommandsSkipBdatChunks(t *testing.T) {
+	w, addr := rawCommandsPlugin(t)
+
+	c, _, _ := dialTest(t, addr)
+	c.cmd("EHLO client.example")
+	c.cmd("MAIL FROM:<a@example.com>")
+	c.cmd("RCPT TO:<b@example.com>")
+
+	chunk := "Subject: hi\r\n\r\nMAIL FROM:<a@example.com> SIZE=1\r\n"
+	code, _ := c.cmd("BDAT %d LAST\r\n%s", len(chunk), strings.TrimSuffix(chunk, "\r\n"))
+	require.Equal(t, 250, code)
+
+	c.cmd("MAIL FROM:<a@example.com> SIZE=2")
+	c.cmd("RCPT TO:<b@example.com>")
+	c.cmd("DATA")
+	code, _ = c.cmd("Subject: second\r\n\r\nbody\r\n.")
+	require.Equal(t, 250, code)
+
+	events := w.eventsOf("EMAIL_RECEIVED")
+	require.Len(t, events, 2)
+	require.Equal(t, "MAIL FROM:<a@example.com>", events[0]["mailFromRaw"])
+	require.Equal(t, "MAIL FROM:<a@example.com> SIZE=2", events[1]["mailFromRaw"])
+}
+
+func TestConnectionsGuardedOnlyWhenNeeded(t *testing.T) {
+	for name, tc := range map[string]struct {
+		configure func(cfg *Config)
+		guarded   bool
+	}{
+		"defaults":             {nil, false},
+		"max_invalid_commands": {func(cfg *Config) { cfg.MaxInvalidCommands = 2 }, true},
+		"capture_raw_commands": {func(cfg *Config) { cfg.CaptureRawCommands = true }, true},
+		"banner":               {func(cfg *Config) { cfg.Banner = "{hostname} ready" }, true},
+		"emulate":              {func(cfg *Config) { cfg.Emulate = "exim" }, true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p, _ := newTestPlugin(t, tc.configure)
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			l := &listener{Listener: ln, plugin: p}
+			defer l.Close()
+
+			client, err := net.Dial("tcp", ln.Addr().String())
+			require.NoError(t, err)
+			defer client.Close()
+
+			conn, err := l.Accept()
+			require.NoError(t, err)
+			defer conn.Close()
+
+			_, guarded := conn.(*guardedConn)
+			require.Equal(t, tc.guarded, guarded)
+			require.NotNil(t, clientConnOf(conn))
+		})
+	}
+}
+
+func TestProtocolFromGreeting(t *testing.T) {
+	for _, guarded := range []bool{false, true} {
+		p, w := newTestPlugin(t, func(cfg *Config) { cfg.CaptureRawCommands = guarded })
+		addr := startTestServer(t, p)
+
+		for _, greeting := range []string{"HELO", "EHLO"} {
+			c, _, _ := dialTest(t, addr)
+			c.cmd("%s client.example", greeting)
+			code, _ := c.send("a@example.com", []string{"b@example.com"}, "Subject: "+greeting+"\r\n\r\nbody")
+			require.Equal(t, 250, code)
+		}
+
+		events := w.eventsOf("EMAIL_RECEIVED")
+		require.Len(t, events, 2)
+		require.Equal(t, "SMTP", events[0]["protocol"])
+		require.Equal(t, "ESMTP", events[1]["protocol"])
+	}
+}
+
+func TestClientNetworksRefusedBeforeGreeting(t *testing.T) {
+	for name, tc := range map[string]struct {
+		configure func(cfg *Config)
+		code      int
+	}{
+		"allowed":     {func(cfg *Config) { cfg.AllowCIDRs = []string{"127.0.0.0/8"} }, 220},
+		"not allowed": {func(cfg *Config) { cfg.AllowCIDRs = []string{"10.0.0.0/8"} }, 554},
+		"denied": {func(cfg *Config) {
+			cfg.AllowCIDRs = []string{"127.0.0.0/8"}
+			cfg.DenyCIDRs = []string{"127.0.0.1/32"}
+		}, 554},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p, w := newTestPlugin(t, func(cfg *Config) {
+				cfg.ConnectEvent = true
+				tc.configure(cfg)
+			})
+			addr := startTestServer(t, p)
+
+			c, code, msg := dialTest(t, addr)
+			require.Equal(t, tc.code, code)
+			if code == 554 {
+				require.Equal(t, "5.7.1 Access denied", msg)
+				require.True(t, c.closed())
+				require.Empty(t, w.eventsOf("CONNECTION_OPENED"))
+			}
+		})
+	}
+}
+
+func TestUnixClientsFilteredByAllowCIDRs(t *testing.T) {
+	for _, allow := range [][]string{nil, {"127.0.0.0/8"}} {
+		p, _ := newTestPlugin(t, func(cfg *Config) { cfg.AllowCIDRs = allow })
+		ln, err := net.Listen("unix", filepath.Join(t.TempDir(), "smtp.sock"))
+		require.NoError(t, err)
+		l := &listener{Listener: ln, plugin: p}
+
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			if conn, err := l.Accept(); err == nil {
+				accepted <- conn
+			}
+		}()
+
+		client, err := net.Dial("unix", ln.Addr().String())
+		require.NoError(t, err)
+
+		if allow == nil {
+			conn := <-accepted
+			require.NotNil(t, clientConnOf(conn))
+			conn.Close()
+		} else {
+			line, err := bufio.NewReader(client).ReadString('\n')
+			require.NoError(t, err)
+			require.Equal(t, "554 5.7.1 Access denied\r\n", line)
+		}
+		client.Close()
+		l.Close()
+	}
+}
+
+// recordingConn keeps every write to the client as one chunk
+type recordingConn struct {
+	net.Conn
+	mu     sync.Mutex
+	writes [][]byte
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.writes = append(c.writes, slices.Clone(b))
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+// recordingListener hands out recordingConns through conns
+type recordingListener struct {
+	net.Listener
+	conns chan *recordingConn
+}
+
+func (l *recordingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	rc := &recordingConn{Conn: c}
+	l.conns <- rc
+	return rc, nil
+}
+
+// The connection guard rewrites replies by matching go-smtp's wording, pinned
+// here against the writes of an unguarded server
+func TestGoSMTPReplyTexts(t *testing.T) {
+	p, _ := newTestPlugin(t, nil)
+	require.False(t, p.cfg.guardsConnections())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	rl := &recordingListener{Listener: ln, conns: make(chan *recordingConn, 1)}
+	srv := p.newSMTPServer(NewBackend(p), ln.Addr().String())
+	go func() { _ = srv.Serve(&listener{Listener: rl, plugin: p}) }()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	c, code, _ := dialTest(t, ln.Addr().String())
+	require.Equal(t, 220, code)
+	rc := <-rl.conns
+
+	// Replies of one command each, in order
+	var replies [][][]byte
+	step := func(line string) {
+		t.Helper()
+		rc.mu.Lock()
+		start := len(rc.writes)
+		rc.mu.Unlock()
+
+		c.cmd("%s", line)
+
+		rc.mu.Lock()
+		replies = append(replies, rc.writes[start:])
+		rc.mu.Unlock()
+	}
+	for _, line := range []string{
+		"EHLO client.example",
+		"HELO client.example",
+		"MAIL FROM:<a@example.com>",
+		"RCPT TO:<b@example.com>",
+		"DATA",
+		"Subject: hi\r\n\r\nbody\r\n.",
+		"RSET",
+		"NOOP",
+		"HELP",
+		"FOOO",
+		"AB",
+		"",
+		"QUIT",
+	} {
+		step(line)
+	}
+
+	rc.mu.Lock()
+	require.True(t, bytes.HasPrefix(rc.writes[0], goSMTPGreetPrefix), "%q", rc.writes[0])
+	rc.mu.Unlock()
+
+	ehlo, helo, mail, rcpt, data, queued, reset, noop := replies[0], replies[1], replies[2], replies[3], replies[4], replies[5], replies[6], replies[7]
+	require.True(t, bytes.HasPrefix(ehlo[0], goSMTPEhloPrefix), "%q", ehlo[0])
+	require.Len(t, helo, 1)
+	require.True(t, bytes.HasPrefix(helo[0], goSMTPHeloPrefix), "%q", helo[0])
+	require.Len(t, mail, 1)
+	require.True(t, bytes.HasPrefix(mail[0], goSMTPMailPrefix), "%q", mail[0])
+	require.Len(t, rcpt, 1)
+	require.True(t, bytes.HasPrefix(rcpt[0], goSMTPRcptPrefix), "%q", rcpt[0])
+	require.Equal(t, [][]byte{goSMTPDataReply}, data)
+	require.Equal(t, [][]byte{goSMTPQueuedReply}, queued)
+	require.Equal(t, [][]byte{goSMTPResetReply}, reset)
+	require.Equal(t, [][]byte{goSMTPNoopReply}, noop)
+
+	for _, invalid := range replies[8:12] {
+		require.Len(t, invalid, 1)
+		require.True(t, isInvalidCommandReply(invalid[0]), "%q", invalid[0])
+	}
+	require.Equal(t, [][]byte{goSMTPQuitReply}, replies[12])
+}
+
+// RFC 3207: commands pipelined after STARTTLS are discarded and the dialog
+// starts over after the handshake
+func TestStartTLSDiscardsPipelinedCommands(t *testing.T) {
+	w, addr := rawCommandsPlugin(t)
+	tlsConfig := &tls.Config{InsecureSkipVerify: true, ServerName: "localhost"}
+
+	c, _, _ := dialTest(t, addr)
+	code, _ := c.cmd("EHLO client.example")
+	require.Equal(t, 250, code)
+	code, _ = c.cmd("MAIL FROM:<a@example.com> SIZE=20")
+	require.Equal(t, 250, code)
+
+	require.NoError(t, c.PrintfLine("STARTTLS\r\nMAIL FROM:<injected@example.com>\r\nRCPT TO:<injected@example.com>"))
+	code, msg := c.reply()
+	require.Equal(t, 220, code, msg)
+	tc := tls.Client(c.conn, tlsConfig)
+	require.NoError(t, tc.Handshake())
+	c.conn = tc
+	c.Conn = textproto.NewConn(tc)
+
+	// The client greets again before anything else
+	code, msg = c.cmd("RCPT TO:<b@example.com>")
+	require.Equal(t, 502, code, msg)
+	require.Contains(t, msg, "introduce yourself")
+	code, _ = c.cmd("EHLO client.example")
+	require.Equal(t, 250, code)
+
+	// Neither the transaction begun in plain text nor the injected one survives
+	code, msg = c.cmd("RCPT TO:<b@example.com>")
+	require.Equal(t, 502, code, msg)
+	require.Contains(t, msg, "Missing MAIL FROM")
+	code, _ = c.send("a@example.com", []string{"b@example.com"}, "Subject: hi\r\n\r\nbody")
+	require.Equal(t, 250, code)
+
+	event := w.waitEvent(t, "EMAIL_RECEIVED")
+	require.Equal(t, "MAIL FROM:<a@example.com>", event["mailFromRaw"])
+	require.Equal(t, []any{"RCPT TO:<b@example.com>"}, event["rcptToRaw"])
+	require.Len(t, w.eventsOf("EMAIL_RECEIVED"), 1)
+}
@@ -1,8 +1,14 @@
 package smtp
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
@@ -10,13 +16,24 @@ import (
 	"mime/quotedprintable"
 	"net/mail"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"go.uber.org/zap"
+	"golang.org/x/text/encoding/htmlindex"
 )
 
 // parseEmail parses raw email data into structured format for PHP
 func (s *Session) parseEmail(rawData []byte) (*ParsedMessage, error) {
+	received := rawData
+	if s.receivedData != nil {
+		received = s.receivedData
+	}
+	if s.backend.plugin.cfg.AddReceivedHeader {
+		rawData = s.prependReceived(rawData, time.Now())
+	}
+
 	// 1. Parse as mail.Message (stdlib)
 	msg, err := mail.ReadMessage(bytes.NewReader(rawData))
 	if err != nil {
@@ -34,13 +51,37 @@ func (s *Session) parseEmail(rawData []byte) (*ParsedMessage, error) {
 		Attachments:   make([]Attachment, 0),
 	}
 
+	rawHeaders, rawBody := splitRawMessage(rawData)
+	if s.backend.plugin.cfg.IncludeRawHeaders {
+		parsed.RawHeaders = string(rawHeaders)
+	}
+	if s.backend.plugin.cfg.OrderedHeaders {
+		for _, field := range splitHeaderFields(rawHeaders) {
+			parsed.HeadersRaw = append(parsed.HeadersRaw, [2]string{field.name, field.value})
+		}
+	}
+
+	var encodedHeaders map[string][]string
+	parsed.Headers, encodedHeaders = s.headerMap(msg.Header, rawHeaders)
+	if s.backend.plugin.cfg.IncludeRaw {
+		parsed.HeadersEncoded = encodedHeaders
+	}
+
+	// Verified on the bytes as received, before the body is decoded
+	if s.backend.plugin.cfg.DKIM.Enabled {
+		parsed.DKIM = s.verifyDKIM(received)
+	}
+
+	// Distinguishes a headers-only message from a body that failed to parse
+	parsed.HasBody = len(bytes.TrimSpace(rawBody)) > 0
+
 	// 2. Parse Message-ID
 	if msgID := msg.Header.Get("Message-ID"); msgID != "" {
 		parsed.ID = &msgID
 	}
 
 	// 3. Parse From (sender)
-	if fromAddrs, err := msg.Header.AddressList("From"); err == nil {
+	if fromAddrs, err := parseAddressList(msg.Header, "From"); err == nil {
 		for _, addr := range fromAddrs {
 			parsed.Sender = append(parsed.Sender, EmailAddress{
 				Email: addr.Address,
@@ -49,8 +90,16 @@ func (s *Session) parseEmail(rawData []byte) (*ParsedMessage, error) {
 		}
 	}
 
+	// Spoofing signal, multi-address From headers use the first address
+	parsed.EnvelopeFromDomain = addressDomain(s.from)
+	if len(parsed.Sender) > 0 {
+		parsed.HeaderFromDomain = addressDomain(parsed.Sender[0].Email)
+	}
+	parsed.EnvelopeHeaderFromMatch = parsed.EnvelopeFromDomain != "" &&
+		parsed.EnvelopeFromDomain == parsed.HeaderFromDomain
+
 	// 4. Parse To (recipients)
-	if toAddrs, err := msg.Header.AddressList("To"); err == nil {
+	if toAddrs, err := parseAddressList(msg.Header, "To"); err == nil {
 		for _, addr := range toAddrs {
 			parsed.Recipients = append(parsed.Recipients, EmailAddress{
 				Email: addr.Address,
@@ -60,7 +109,7 @@ func (s *Session) parseEmail(rawData []byte) (*ParsedMessage, error) {
 	}
 
 	// 5. Parse CC
-	if ccAddrs, err := msg.Header.AddressList("Cc"); err == nil {
+	if ccAddrs, err := parseAddressList(msg.Header, "Cc"); err == nil {
 		for _, addr := range ccAddrs {
 			parsed.CCs = append(parsed.CCs, EmailAddress{
 				Email: addr.Address,
@@ -70,7 +119,7 @@ func (s *Session) parseEmail(rawData []byte) (*ParsedMessage, error) {
 	}
 
 	// 6. Parse Reply-To
-	if replyAddrs, err := msg.Header.AddressList("Reply-To"); err == nil {
+	if replyAddrs, err := parseAddressList(msg.Header, "Reply-To"); err == nil {
 		for _, addr := range replyAddrs {
 			parsed.ReplyTo = append(parsed.ReplyTo, EmailAddress{
 				Email: addr.Address,
@@ -80,7 +129,15 @@ func (s *Session) parseEmail(rawData []byte) (*ParsedMessage, error) {
 	}
 
 	// 7. Parse Subject
-	parsed.Subject = msg.Header.Get("Subject")
+	parsed.Subject = decodeHeaderValue(msg.Header.Get("Subject"))
+
+	// Date header, normalized to RFC 3339
+	if date, err := msg.Header.Date(); err == nil {
+		s.setDate(parsed, date)
+	}
+
+	// Normalize X-Priority/Importance/Priority
+	parsed.Priority = parsePriority(msg.Header)
 
 	// 8. Parse body and attachments
 	contentType := msg.Header.Get("Content-Type")
@@ -93,48 +150,215 @@ func (s *Session) parseEmail(rawData []byte) (*ParsedMessage, error) {
 		// Simple email (no attachments)
 		body, _ := io.ReadAll(msg.Body)
 		decoded := s.decodeContent(body, msg.Header.Get("Content-Transfer-Encoding"))
-		if strings.HasPrefix(mediaType, "text/html") {
+		decoded = s.toUTF8(decoded, params["charset"])
+		if !s.consumeDecodeBudget(parsed, len(decoded)) {
+			decoded = nil
+			parsed.SkippedParts = append(parsed.SkippedParts, SkippedPart{
+				Reason:      skipDecodeLimit,
+				ContentType: mediaType,
+			})
+		}
+		switch {
+		case strings.HasPrefix(mediaType, "text/html"):
 			parsed.HTMLBody = string(decoded)
-		} else {
+		case mediaType == "text/calendar" && s.backend.plugin.cfg.ParseCalendar:
+			s.setCalendar(parsed, decoded)
+		default:
 			parsed.TextBody = string(decoded)
 		}
+		parsed.partCount = 1
 	} else {
 		// 9. Parse multipart message
-		boundary := params["boundary"]
-		mr := multipart.NewReader(msg.Body, boundary)
+		err := s.walkMultipart(msg.Body, params["boundary"], parsed, 1)
+		if errors.Is(err, errAttachmentPersist) || errors.Is(err, errTooManyAttachments) {
+			s.removeTempFiles(parsed)
+			s.removeUploads(parsed)
+			return nil, err
+		}
+	}
 
-		for {
-			part, err := mr.NextPart()
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				s.log.Error("multipart parse error", zap.Error(err))
+	if s.backend.plugin.cfg.HTMLToText && strings.TrimSpace(parsed.TextBody) == "" && parsed.HTMLBody != "" {
+		parsed.BodyTextExtracted = htmlToText(parsed.HTMLBody)
+	}
+
+	if s.backend.plugin.cfg.DetectLanguage {
+		parsed.Language = detectLanguage(parsed)
+	}
+
+	// 10. Size breakdown
+	parsed.BodySize = int64(len(parsed.TextBody) + len(parsed.HTMLBody))
+	for i := range parsed.Attachments {
+		parsed.AttachmentsSize += parsed.Attachments[i].Size
+	}
+
+	return parsed, nil
+}
+
+// setDate stores the Date header, replacing dates further in the future than
+// clamp_future_date_skew with the receive time when clamp_future_date is set
+func (s *Session) setDate(parsed *ParsedMessage, date time.Time) {
+	cfg := s.backend.plugin.cfg
+	parsed.Date = date.Format(time.RFC3339)
+
+	now := time.Now()
+	if !cfg.ClampFutureDate || date.Sub(now) <= cfg.ClampFutureDateSkew {
+		return
+	}
+
+	parsed.DateOriginal = parsed.Date
+	parsed.Date = now.UTC().Format(time.RFC3339)
+	parsed.DateClamped = true
+}
+
+// maxMultipartDepth bounds multipart nesting, deeper containers are skipped
+const maxMultipartDepth = 16
+
+// walkMultipart processes the parts of a multipart body, descending into nested
+// multipart containers so that parts at any depth are flattened into the message.
+// Leaf parts are counted depth-first in partCount. It returns errDecodeLimit,
+// errAttachmentPersist or errTooManyAttachments when parsing must stop at every level.
+func (s *Session) walkMultipart(body io.Reader, boundary string, parsed *ParsedMessage, depth int) error {
+	mr := multipart.NewReader(body, boundary)
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			// Reader can't recover (e.g. truncated message), keep what we have
+			s.log.Error("multipart parse error", zap.Error(err))
+			parsed.SkippedParts = append(parsed.SkippedParts, SkippedPart{
+				Reason:    skipMultipartError,
+				PartIndex: parsed.partCount,
+				Error:     err.Error(),
+			})
+			return nil
+		}
+
+		mediaType, params, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+			if depth >= maxMultipartDepth {
+				parsed.SkippedParts = append(parsed.SkippedParts, SkippedPart{
+					Reason:      skipDepthLimit,
+					PartIndex:   parsed.partCount,
+					ContentType: mediaType,
+				})
 				continue
 			}
+			if err := s.walkMultipart(part, params["boundary"], parsed, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+
+		parsed.partCount++
 
-			if err := s.processPartParsed(part, parsed); err != nil {
-				s.log.Error("process part error", zap.Error(err))
+		if err := s.processPartParsed(part, parsed); err != nil {
+			if errors.Is(err, errDecodeLimit) {
+				s.log.Warn("max_decoded_bytes exceeded, skipping remaining parts",
+					zap.String("uuid", s.uuid),
+					zap.Int64("limit", s.backend.plugin.cfg.MaxDecodedBytes),
+				)
+				s.dropPart(parsed, part, skipDecodeLimit, nil)
+				return err
 			}
+			if errors.Is(err, errAttachmentPersist) || errors.Is(err, errTooManyAttachments) {
+				return err
+			}
+			s.log.Error("process part error", zap.Error(err))
+			s.dropPart(parsed, part, skipError, err)
 		}
 	}
+}
 
-	return parsed, nil
+// errDecodeLimit stops parsing once max_decoded_bytes is exceeded
+var errDecodeLimit = errors.New("decoded bytes limit exceeded")
+
+// errAttachmentPersist aborts parsing when an attachment could not be durably
+// written to temp_dir, the message is then refused with a transient error
+var errAttachmentPersist = errors.New("attachment not persisted")
+
+// errTooManyAttachments aborts parsing once max_attachments is exceeded, the message is rejected
+var errTooManyAttachments = errors.New("too many attachments")
+
+// removeTempFiles deletes attachment temp files already written for a message
+// that will not be delivered
+func (s *Session) removeTempFiles(parsed *ParsedMessage) {
+	st := &s.backend.plugin.stats
+	for _, att := range parsed.Attachments {
+		if att.StoredFilename == "" {
+			continue
+		}
+		if err := os.Remove(att.Content); err != nil {
+			continue
+		}
+		st.tempFiles.Add(-1)
+		st.tempBytes.Add(-att.Size)
+	}
+}
+
+// consumeDecodeBudget accounts n decoded bytes against max_decoded_bytes,
+// returning false and flagging the message once the cap is exceeded
+func (s *Session) consumeDecodeBudget(parsed *ParsedMessage, n int) bool {
+	limit := s.backend.plugin.cfg.MaxDecodedBytes
+	if limit <= 0 {
+		return true
+	}
+
+	parsed.decodedBytes += int64(n)
+	if parsed.decodedBytes > limit {
+		parsed.DecodeLimitExceeded = true
+		return false
+	}
+	return true
+}
+
+// decodeBudgetReader limits r to one byte over what is left of max_decoded_bytes,
+// so a part exceeding the budget is noticed without decoding the rest of it
+func (s *Session) decodeBudgetReader(parsed *ParsedMessage, r io.Reader) io.Reader {
+	limit := s.backend.plugin.cfg.MaxDecodedBytes
+	if limit <= 0 {
+		return r
+	}
+	return io.LimitReader(r, limit-parsed.decodedBytes+1)
+}
+
+// isAttachmentPart reports whether a part carries an attachment or inline
+// disposition, or is a non-text part referenced by Content-ID (multipart/related)
+func isAttachmentPart(part *multipart.Part) bool {
+	disposition := part.Header.Get("Content-Disposition")
+	if strings.HasPrefix(disposition, "attachment") ||
+		strings.HasPrefix(disposition, "inline") {
+		return true
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+	return disposition == "" && part.Header.Get("Content-ID") != "" &&
+		mediaType != "" && !strings.HasPrefix(mediaType, "text/")
+}
+
+// isInlinePart reports whether an attachment part is meant to be displayed in
+// the body, by disposition or by a Content-ID without a disposition
+func isInlinePart(part *multipart.Part) bool {
+	disposition := part.Header.Get("Content-Disposition")
+	if disposition == "" {
+		return part.Header.Get("Content-ID") != ""
+	}
+	return strings.HasPrefix(disposition, "inline")
 }
 
 // processPartParsed handles individual MIME parts for ParsedMessage
 func (s *Session) processPartParsed(part *multipart.Part, parsed *ParsedMessage) error {
-	disposition := part.Header.Get("Content-Disposition")
 	contentType := part.Header.Get("Content-Type")
 
 	// Check if this is an attachment
-	if strings.HasPrefix(disposition, "attachment") ||
-		strings.HasPrefix(disposition, "inline") {
+	if isAttachmentPart(part) {
 		return s.processAttachmentParsed(part, parsed)
 	}
 
 	// This is body content
-	mediaType, _, _ := mime.ParseMediaType(contentType)
+	mediaType, params, _ := mime.ParseMediaType(contentType)
 	if strings.HasPrefix(mediaType, "text/plain") ||
 		strings.HasPrefix(mediaType, "text/html") ||
 		contentType == "" {
@@ -145,6 +369,10 @@ func (s *Session) processPartParsed(part *multipart.Part, parsed *ParsedMessage)
 
 		// Decode if needed (quoted-printable, base64)
 		decoded := s.decodeContent(bodyBytes, part.Header.Get("Content-Transfer-Encoding"))
+		decoded = s.toUTF8(decoded, params["charset"])
+		if !s.consumeDecodeBudget(parsed, len(decoded)) {
+			return errDecodeLimit
+		}
 
 		if strings.HasPrefix(mediaType, "text/html") {
 			if parsed.HTMLBody == "" {
@@ -159,18 +387,107 @@ func (s *Session) processPartParsed(part *multipart.Part, parsed *ParsedMessage)
 				parsed.TextBody += "\n\n" + string(decoded)
 			}
 		}
+		return nil
+	}
+
+	if mediaType == "text/calendar" && s.backend.plugin.cfg.ParseCalendar {
+		bodyBytes, err := io.ReadAll(part)
+		if err != nil {
+			return err
+		}
+		decoded := s.decodeContent(bodyBytes, part.Header.Get("Content-Transfer-Encoding"))
+		decoded = s.toUTF8(decoded, params["charset"])
+		if !s.consumeDecodeBudget(parsed, len(decoded)) {
+			return errDecodeLimit
+		}
+		s.setCalendar(parsed, decoded)
+		return nil
 	}
 
+	// Neither a body nor marked as an attachment
+	parsed.skipPart(part, skipUnsupported, nil)
 	return nil
 }
 
+// setCalendar parses a decoded text/calendar part, the first one wins
+func (s *Session) setCalendar(parsed *ParsedMessage, data []byte) {
+	if parsed.Calendar != nil {
+		return
+	}
+
+	parsed.Calendar = parseCalendar(data)
+	if parsed.Calendar.Warning != "" {
+		s.log.Warn("malformed calendar part",
+			zap.String("uuid", s.uuid),
+			zap.String("warning", parsed.Calendar.Warning),
+		)
+	}
+}
+
+// Reasons recorded in skippedParts
+const (
+	skipDecodeLimit    = "decode_limit"    // max_decoded_bytes exceeded
+	skipUnsupported    = "unsupported"     // neither a text body nor an attachment
+	skipError          = "error"           // read or storage failure
+	skipMultipartError = "multipart_error" // malformed structure, remaining parts are lost
+	skipDepthLimit     = "depth_limit"     // multipart nested deeper than maxMultipartDepth
+	skipSizeLimit      = "size_limit"      // attachment over max_attachment_size, kept as metadata
+)
+
+// skipPart records a part the parser did not deliver, the current part was already counted
+func (m *ParsedMessage) skipPart(part *multipart.Part, reason string, err error) {
+	skipped := SkippedPart{
+		Reason:      reason,
+		PartIndex:   m.partCount - 1,
+		ContentType: part.Header.Get("Content-Type"),
+	}
+	if name := part.FileName(); name != "" {
+		skipped.Filename = sanitizeFilename(name)
+	}
+	if err != nil {
+		skipped.Error = err.Error()
+	}
+	m.SkippedParts = append(m.SkippedParts, skipped)
+}
+
+// dropReasonStorageNone marks attachments kept as metadata only (attachment_storage.mode: none)
+const dropReasonStorageNone = "storage_none"
+
+// dropPart records a part that failed to process and, with dropped_stubs,
+// keeps a metadata entry in attachments when the part is an attachment
+func (s *Session) dropPart(parsed *ParsedMessage, part *multipart.Part, reason string, err error) {
+	parsed.skipPart(part, reason, err)
+
+	if !s.backend.plugin.cfg.AttachmentStorage.DroppedStubs || !isAttachmentPart(part) {
+		return
+	}
+
+	contentType := part.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	parsed.Attachments = append(parsed.Attachments, Attachment{
+		Filename:   sanitizeFilename(part.FileName()),
+		Type:       contentType,
+		PartIndex:  parsed.partCount - 1,
+		Inline:     isInlinePart(part),
+		Dropped:    true,
+		DropReason: reason,
+	})
+}
+
 // processAttachmentParsed extracts attachment data for ParsedMessage
 func (s *Session) processAttachmentParsed(part *multipart.Part, parsed *ParsedMessage) error {
-	filename := part.FileName()
-	if filename == "" {
-		filename = "unnamed"
+	if limit := s.backend.plugin.cfg.MaxAttachments; limit > 0 && len(parsed.Attachments) >= limit {
+		return errTooManyAttachments
 	}
 
+	filename := sanitizeFilename(part.FileName())
+
 	contentType := part.Header.Get("Content-Type")
 	if contentType == "" {
 		contentType = "application/octet-stream"
@@ -184,24 +501,12 @@ func (s *Session) processAttachmentParsed(part *multipart.Part, parsed *ParsedMe
 	// Clean up Content-ID (remove angle brackets)
 	contentID = strings.Trim(contentID, "<>")
 
-	// Read attachment content
-	content, err := io.ReadAll(part)
-	if err != nil {
-		return err
-	}
-
-	// Decode if base64
-	encoding := part.Header.Get("Content-Transfer-Encoding")
-	if strings.EqualFold(encoding, "base64") {
-		decoded, err := base64.StdEncoding.DecodeString(string(content))
-		if err == nil {
-			content = decoded
-		}
-	}
-
 	attachment := Attachment{
 		Filename: filename,
 		Type:     contentType,
+		// The current part was already counted
+		PartIndex: parsed.partCount - 1,
+		Inline:    isInlinePart(part),
 	}
 
 	// Set ContentID if present
@@ -209,55 +514,610 @@ func (s *Session) processAttachmentParsed(part *multipart.Part, parsed *ParsedMe
 		attachment.ContentID = &contentID
 	}
 
-	// Handle based on storage mode
+	encoding := normalizeTransferEncoding(part.Header.Get("Content-Transfer-Encoding"))
+
+	// Metadata only: count decoded bytes without keeping them
 	cfg := s.backend.plugin.cfg
-	if cfg.AttachmentStorage.Mode == "memory" {
+	if cfg.AttachmentStorage.Mode == "none" {
+		var r io.Reader = part
+		if encoding == "base64" {
+			r = newBase64Reader(part)
+		}
+
+		hash := sha256.New()
+		n, err := io.Copy(hash, s.decodeBudgetReader(parsed, r))
+		if err != nil {
+			return err
+		}
+		if !s.consumeDecodeBudget(parsed, int(n)) {
+			return errDecodeLimit
+		}
+
+		attachment.Size = n
+		attachment.SHA256 = hex.EncodeToString(hash.Sum(nil))
+		attachment.Dropped = true
+		attachment.DropReason = dropReasonStorageNone
+		parsed.Attachments = append(parsed.Attachments, attachment)
+		return nil
+	}
+
+	// Read and decode attachment content, undecodable content is dropped
+	// instead of delivered encoded
+	var r io.Reader = part
+	if encoding == "base64" {
+		r = newBase64Reader(part)
+	}
+	content, err := io.ReadAll(s.decodeBudgetReader(parsed, r))
+	if err != nil {
+		return err
+	}
+
+	if !s.consumeDecodeBudget(parsed, len(content)) {
+		return errDecodeLimit
+	}
+
+	if contentType == "text/calendar" && cfg.ParseCalendar {
+		s.setCalendar(parsed, content)
+	}
+
+	attachment.Size = int64(len(content))
+	sum := sha256.Sum256(content)
+	attachment.SHA256 = hex.EncodeToString(sum[:])
+
+	// Metadata only for attachments over max_attachment_size
+	if limit := cfg.MaxAttachmentSize; limit > 0 && attachment.Size > limit {
+		s.log.Debug("attachment exceeds max_attachment_size",
+			zap.String("uuid", s.uuid),
+			zap.String("filename", filename),
+			zap.Int64("size", attachment.Size),
+		)
+		attachment.Truncated = true
+		attachment.Dropped = true
+		attachment.DropReason = skipSizeLimit
+		parsed.Attachments = append(parsed.Attachments, attachment)
+		parsed.skipPart(part, skipSizeLimit, nil)
+		return nil
+	}
+
+	// Handle based on storage mode
+	switch cfg.AttachmentStorage.Mode {
+	case "memory":
 		// Base64 encode for JSON
 		attachment.Content = base64.StdEncoding.EncodeToString(content)
-	} else {
+	case "s3":
+		// Upload, the object location goes to Path and Content stays empty
+		path, err := s.backend.plugin.uploader.upload(context.Background(),
+			s.attachmentKey(attachment.PartIndex, filename), contentType, content)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errAttachmentPersist, err)
+		}
+		attachment.Path = path
+	default:
 		// Write to temp file and store path in Content field
 		path, err := s.saveTempFile(content, filename)
 		if err != nil {
 			return err
 		}
 		attachment.Content = path
+		attachment.StoredFilename = filepath.Base(path)
 	}
 
 	parsed.Attachments = append(parsed.Attachments, attachment)
 	return nil
 }
 
+// storeEml writes the raw message to the store_eml directory, gzipped with store_eml_compress
+func (s *Session) storeEml(raw []byte) (string, error) {
+	return s.writeEml(s.backend.plugin.cfg.StoreEml, raw)
+}
+
+// writeEml writes the raw message to dir as <uuid>-<n>.eml, gzipped with store_eml_compress
+func (s *Session) writeEml(dir string, raw []byte) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, s.messageID()+".eml")
+	if !s.backend.plugin.cfg.StoreEmlCompress {
+		if err := os.WriteFile(path, raw, 0644); err != nil {
+			return "", err
+		}
+		return path, nil
+	}
+
+	path += ".gz"
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	zw := gzip.NewWriter(f)
+	if _, err := zw.Write(raw); err != nil {
+		_ = f.Close()
+		_ = os.Remove(path)
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		_ = f.Close()
+		_ = os.Remove(path)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(path)
+		return "", err
+	}
+
+	return path, nil
+}
+
 // saveTempFile writes attachment to temporary file
 func (s *Session) saveTempFile(content []byte, filename string) (string, error) {
 	cfg := s.backend.plugin.cfg
 
+	// Queue behind max_concurrent_attachment_writes
+	if sem := s.backend.plugin.attachmentWriteSem; sem != nil {
+		sem <- struct{}{}
+		defer func() { <-sem }()
+	}
+	s.backend.plugin.stats.attachmentWrites.Add(1)
+	defer s.backend.plugin.stats.attachmentWrites.Add(-1)
+
 	// Ensure temp directory exists
 	if err := os.MkdirAll(cfg.AttachmentStorage.TempDir, 0755); err != nil {
-		return "", err
+		return "", fmt.Errorf("%w: %w", errAttachmentPersist, err)
 	}
 
-	// Create temp file with unique name
+	// Create temp file with unique name, keeping the original extension last
+	// so consumers can dispatch by it
 	tmpFile, err := os.CreateTemp(
 		cfg.AttachmentStorage.TempDir,
-		fmt.Sprintf("smtp-att-%s-*-%s", s.uuid[:8], filename),
+		fmt.Sprintf("smtp-att-%s-*%s", s.uuid[:8], safeExtension(filename)),
 	)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("%w: %w", errAttachmentPersist, err)
 	}
-	defer tmpFile.Close()
 
-	if _, err := tmpFile.Write(content); err != nil {
-		return "", err
+	// The worker only gets the path, so the data must be on disk before the
+	// message is acknowledged; a partial file is removed rather than delivered
+	_, err = tmpFile.Write(content)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return "", fmt.Errorf("%w: %w", errAttachmentPersist, err)
 	}
 
+	st := &s.backend.plugin.stats
+	st.tempFiles.Add(1)
+	st.tempBytes.Add(int64(len(content)))
+	st.tempFilesCreated.Add(1)
+
 	return tmpFile.Name(), nil
 }
 
+// sanitizeFilename strips directory components and control characters from
+// a client supplied filename. The result is only a logical name, never a path.
+func sanitizeFilename(name string) string {
+	// Windows clients may send backslash separated paths
+	if idx := strings.LastIndexAny(name, `/\`); idx >= 0 {
+		name = name[idx+1:]
+	}
+
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." {
+		return "unnamed"
+	}
+
+	return name
+}
+
+// safeExtension returns the file extension of name limited to alphanumeric characters
+func safeExtension(name string) string {
+	ext := filepath.Ext(filepath.Base(name))
+	if len(ext) < 2 {
+		return ""
+	}
+
+	for _, r := range ext[1:] {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') {
+			return ""
+		}
+	}
+
+	return ext
+}
+
+// parsePriority maps the X-Priority, Importance and Priority header conventions
+// to "high", "normal" or "low". X-Priority wins when several are present.
+func parsePriority(h mail.Header) string {
+	// X-Priority: 1 (Highest) .. 5 (Lowest)
+	if v := strings.TrimSpace(h.Get("X-Priority")); v != "" {
+		switch v[0] {
+		case '1', '2':
+			return "high"
+		case '4', '5':
+			return "low"
+		case '3':
+			return "normal"
+		}
+	}
+
+	// Importance: high | normal | low (RFC 2156)
+	switch strings.ToLower(strings.TrimSpace(h.Get("Importance"))) {
+	case "high":
+		return "high"
+	case "low":
+		return "low"
+	case "normal":
+		return "normal"
+	}
+
+	// Priority: urgent | normal | non-urgent (RFC 2156)
+	switch strings.ToLower(strings.TrimSpace(h.Get("Priority"))) {
+	case "urgent":
+		return "high"
+	case "non-urgent":
+		return "low"
+	}
+
+	return "normal"
+}
+
+// headerMap returns the parsed headers with RFC 2047 encoded words decoded,
+// keyed by on-wire casing instead of the canonical one when canonicalize_headers
+// is off. encoded holds the original values of headers that were decoded.
+func (s *Session) headerMap(header mail.Header, rawHeaders []byte) (decoded, encoded map[string][]string) {
+	source := map[string][]string(header)
+	if !*s.backend.plugin.cfg.CanonicalizeHeaders {
+		source = make(map[string][]string)
+		for _, field := range splitHeaderFields(rawHeaders) {
+			source[field.name] = append(source[field.name], field.value)
+		}
+	}
+
+	decoded = make(map[string][]string, len(source))
+	for name, values := range source {
+		out := make([]string, len(values))
+		changed := false
+		for i, value := range values {
+			out[i] = decodeHeaderValue(value)
+			changed = changed || out[i] != value
+		}
+		decoded[name] = out
+
+		if changed {
+			if encoded == nil {
+				encoded = make(map[string][]string)
+			}
+			encoded[name] = values
+		}
+	}
+	return decoded, encoded
+}
+
+// headerWordDecoder decodes RFC 2047 encoded words in any charset known to htmlindex
+var headerWordDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		if isUTF8Compatible(charset) {
+			return input, nil
+		}
+		enc, err := htmlindex.Get(charset)
+		if err != nil {
+			return nil, err
+		}
+		return enc.NewDecoder().Reader(input), nil
+	},
+}
+
+// decodeHeaderValue decodes RFC 2047 encoded words to UTF-8, values with an
+// unknown charset or malformed words are returned unchanged
+func decodeHeaderValue(value string) string {
+	if !strings.Contains(value, "=?") {
+		return value
+	}
+
+	decoded, err := headerWordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// parseAddressList parses an address header, decoding encoded display names
+// with the same charsets as other headers
+func parseAddressList(header mail.Header, key string) ([]*mail.Address, error) {
+	value := header.Get(key)
+	if value == "" {
+		return nil, mail.ErrHeaderNotPresent
+	}
+	parser := mail.AddressParser{WordDecoder: headerWordDecoder}
+	if addrs, err := parser.ParseList(value); err == nil {
+		return addrs, nil
+	}
+
+	// Keep the well-formed entries of a list with malformed ones
+	var addrs []*mail.Address
+	for _, entry := range splitAddressList(value) {
+		if addr, err := parser.Parse(entry); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, mail.ErrHeaderNotPresent
+	}
+	return addrs, nil
+}
+
+// splitAddressList splits an address list at commas outside quoted strings,
+// comments and angle brackets
+func splitAddressList(value string) []string {
+	var (
+		entries []string
+		start   int
+		quoted  bool
+		escaped bool
+		depth   int // comment nesting
+		angle   bool
+	)
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && (quoted || depth > 0):
+			escaped = true
+		case c == '"' && depth == 0:
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case depth > 0:
+		case c == '<':
+			angle = true
+		case c == '>':
+			angle = false
+		case c == ',' && !angle:
+			if entry := strings.TrimSpace(value[start:i]); entry != "" {
+				entries = append(entries, entry)
+			}
+			start = i + 1
+		}
+	}
+	if entry := strings.TrimSpace(value[start:]); entry != "" {
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// splitRawMessage splits raw message data at the first blank line into
+// the verbatim header section and the body
+func splitRawMessage(data []byte) (header, body []byte) {
+	if idx := bytes.Index(data, []byte("\r\n\r\n")); idx >= 0 {
+		return data[:idx], data[idx+4:]
+	}
+	// Tolerate bare LF line endings
+	if idx := bytes.Index(data, []byte("\n\n")); idx >= 0 {
+		return data[:idx], data[idx+2:]
+	}
+	// Headers-only message
+	return data, nil
+}
+
+// prependReceived returns the message with a Received trace header
+// (RFC 5321 section 4.4) for this hop in front, in the message's line endings
+func (s *Session) prependReceived(data []byte, now time.Time) []byte {
+	eol := "\r\n"
+	if line, _, ok := bytes.Cut(data, []byte("\n")); ok && !bytes.HasSuffix(line, []byte("\r")) {
+		eol = "\n"
+	}
+
+	helo := s.heloName
+	if helo == "" {
+		helo = "unknown"
+	}
+
+	from := helo
+	if s.remoteIP != "" {
+		host := s.remoteHost
+		if host == "" {
+			host = "unknown"
+		}
+		from += " (" + host + " [" + s.remoteIP + "])"
+	}
+
+	// RFC 3848 protocol names, "S" for TLS and "A" for authenticated sessions
+	protocol := s.protocol()
+	if protocol == "" {
+		protocol = "SMTP"
+	}
+	if protocol == "ESMTP" {
+		if _, isTLS := s.tlsState(); isTLS {
+			protocol += "S"
+		}
+		if s.authenticated {
+			protocol += "A"
+		}
+	}
+
+	header := "Received: from " + from + eol +
+		"\tby " + s.backend.plugin.cfg.Hostname + " with " + protocol + " id " + s.messageID() + ";" + eol +
+		"\t" + now.Format(time.RFC1123Z) + eol
+
+	return append([]byte(header), data...)
+}
+
+// headerField is a single header line with its on-wire name casing
+type headerField struct {
+	name  string
+	value string
+}
+
+// splitHeaderFields splits a raw header section into fields in order,
+// unfolding continuation lines the same way net/textproto does
+func splitHeaderFields(raw []byte) []headerField {
+	var fields []headerField
+	for _, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+
+		// Continuation of the previous field
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(fields) > 0 {
+				last := &fields[len(fields)-1]
+				last.value = strings.TrimSpace(last.value + " " + strings.TrimSpace(line))
+			}
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		name = strings.TrimRight(name, " \t")
+		if name == "" {
+			continue
+		}
+		fields = append(fields, headerField{name: name, value: strings.TrimSpace(value)})
+	}
+	return fields
+}
+
+// normalizeTransferEncoding reduces a Content-Transfer-Encoding value to its
+// lowercase token, dropping RFC 5322 comments and surrounding whitespace,
+// e.g. "Base64\t" or "quoted-printable (comment)"
+func normalizeTransferEncoding(v string) string {
+	var b strings.Builder
+	depth := 0
+	escaped := false
+	for _, r := range v {
+		switch {
+		case escaped:
+			escaped = false
+			if depth == 0 {
+				b.WriteRune(r)
+			}
+		case r == '\\':
+			escaped = true
+		case r == '(':
+			depth++
+		case r == ')' && depth > 0:
+			depth--
+		case depth == 0:
+			b.WriteRune(r)
+		}
+	}
+
+	fields := strings.Fields(b.String())
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToLower(fields[0])
+}
+
+// toUTF8 transcodes text in the given charset to UTF-8. Text without a charset
+// parameter is assumed to be in default_charset. Unknown charsets are passed through.
+func (s *Session) toUTF8(data []byte, charset string) []byte {
+	if charset == "" {
+		charset = s.backend.plugin.cfg.DefaultCharset
+	}
+
+	if isUTF8Compatible(charset) {
+		return data
+	}
+
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		s.log.Debug("unknown charset, passing text through", zap.String("charset", charset))
+		return data
+	}
+
+	decoded, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return data
+	}
+	return decoded
+}
+
+// isUTF8Compatible reports whether text in charset is already valid UTF-8.
+// Checked before htmlindex, which maps us-ascii to windows-1252 per WHATWG.
+func isUTF8Compatible(charset string) bool {
+	switch strings.ToLower(strings.TrimSpace(charset)) {
+	case "utf-8", "utf8", "us-ascii", "ascii":
+		return true
+	}
+	return false
+}
+
+// decodeBase64 decodes MIME base64. Line breaks are ignored by encoding/base64
+// already; other whitespace and missing padding from sloppy encoders are tolerated too.
+func decodeBase64(data []byte) ([]byte, error) {
+	return io.ReadAll(newBase64Reader(bytes.NewReader(data)))
+}
+
+// newBase64Reader decodes MIME base64 from r like decodeBase64
+func newBase64Reader(r io.Reader) io.Reader {
+	return base64.NewDecoder(base64.RawStdEncoding, &base64Filter{r: bufio.NewReader(r)})
+}
+
+// base64Filter drops whitespace and trailing padding from base64 input, so it
+// decodes without padding. Padding followed by more data is passed on and
+// rejected by the decoder.
+type base64Filter struct {
+	r   *bufio.Reader
+	pad bool // padding seen and held back
+}
+
+func (f *base64Filter) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		c, err := f.r.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '=':
+			f.pad = true
+			continue
+		}
+
+		if f.pad {
+			// Data after padding: pass the padding on, c is read again
+			f.pad = false
+			_ = f.r.UnreadByte()
+			c = '='
+		}
+		p[n] = c
+		n++
+	}
+	return n, nil
+}
+
 // decodeContent decodes content based on transfer encoding
 func (s *Session) decodeContent(data []byte, encoding string) []byte {
-	switch strings.ToLower(encoding) {
+	switch normalizeTransferEncoding(encoding) {
 	case "base64":
-		decoded, err := base64.StdEncoding.DecodeString(string(data))
+		decoded, err := decodeBase64(data)
 		if err != nil {
 			return data
 		}
@@ -0,0 +1,626 @@
+package smtp
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// crlf joins message lines with CRLF
+func crlf(lines ...string) string {
+	return strings.Join(lines, "\r\n")
+}
+
+// parseTest parses raw with a session of p
+func parseTest(t *testing.T, p *Plugin, raw string) *ParsedMessage {
+	t.Helper()
+
+	parsed, err := newTestSession(p).parseEmail([]byte(raw))
+	require.NoError(t, err)
+	return parsed
+}
+
+// attachmentPart returns a base64 attachment part with the given boundary
+func attachmentPart(boundary, filename string, content []byte) string {
+	return crlf(
+		"--"+boundary,
+		"Content-Type: application/octet-stream",
+		`Content-Disposition: attachment; filename="`+filename+`"`,
+		"Content-Transfer-Encoding: base64",
+		"",
+		base64.StdEncoding.EncodeToString(content),
+		"",
+	)
+}
+
+// mixedMessage wraps parts in a multipart/mixed message with boundary "b1"
+func mixedMessage(parts ...string) string {
+	return crlf(
+		"From: a@example.com",
+		"Subject: test",
+		`Content-Type: multipart/mixed; boundary="b1"`,
+		"",
+		strings.Join(parts, "")+"--b1--",
+		"",
+	)
+}
+
+func TestTempFileKeepsExtension(t *testing.T) {
+	p, _ := newTestPlugin(t, func(cfg *Config) { cfg.AttachmentStorage.Mode = "tempfile" })
+
+	parsed := parseTest(t, p, mixedMessage(attachmentPart("b1", "report.final.pdf", []byte("%PDF-1.4"))))
+	require.Len(t, parsed.Attachments, 1)
+
+	path := parsed.Attachments[0].Content
+	require.Equal(t, ".pdf", filepath.Ext(path))
+	require.True(t, strings.HasPrefix(filepath.Base(path), "smtp-att-"))
+}
+
+func TestSameNamedAttachmentsStoredSeparately(t *testing.T) {
+	p, _ := newTestPlugin(t, func(cfg *Config) { cfg.AttachmentStorage.Mode = "tempfile" })
+
+	parsed := parseTest(t, p, mixedMessage(
+		attachmentPart("b1", "image.png", []byte("one")),
+		attachmentPart("b1", "image.png", []byte("two")),
+		attachmentPart("b1", "image.png", []byte("three")),
+	))
+	require.Len(t, parsed.Attachments, 3)
+
+	stored := map[string]bool{}
+	for i, att := range parsed.Attachments {
+		require.Equal(t, "image.png", att.Filename)
+		require.Equal(t, filepath.Base(att.Content), att.StoredFilename)
+		stored[att.StoredFilename] = true
+
+		content, err := os.ReadFile(att.Content)
+		require.NoError(t, err)
+		require.Equal(t, []string{"one", "two", "three"}[i], string(content))
+	}
+	require.Len(t, stored, 3)
+}
+
+func TestMaxDecodedBytes(t *testing.T) {
+	body := strings.Repeat("a", 100)
+	raw := mixedMessage(
+		crlf("--b1", "Content-Type: text/plain", "", body, ""),
+		attachmentPart("b1", "a.bin", []byte(strings.Repeat("b", 100))),
+	)
+
+	// Metadata only attachments are decoded too and count alike
+	for _, mode := range []string{"memory", "none"} {
+		p, _ := newTestPlugin(t, func(cfg *Config) {
+			cfg.AttachmentStorage.Mode = mode
+			cfg.MaxDecodedBytes = 200
+		})
+		parsed := parseTest(t, p, raw)
+		require.False(t, parsed.DecodeLimitExceeded, mode)
+		require.Equal(t, body, parsed.TextBody)
+		require.Len(t, parsed.Attachments, 1)
+
+		p, _ = newTestPlugin(t, func(cfg *Config) {
+			cfg.AttachmentStorage.Mode = mode
+			cfg.MaxDecodedBytes = 199
+		})
+		parsed = parseTest(t, p, raw)
+		require.True(t, parsed.DecodeLimitExceeded, mode)
+		require.Equal(t, body, parsed.TextBody)
+		require.Empty(t, parsed.Attachments)
+		require.Equal(t, skipDecodeLimit, parsed.SkippedParts[0].Reason)
+	}
+}
+
+func TestDecodeBudgetReader(t *testing.T) {
+	p, _ := newTestPlugin(t, func(cfg *Config) { cfg.MaxDecodedBytes = 10 })
+	s := newTestSession(p)
+	parsed := &ParsedMessage{decodedBytes: 4}
+
+	// Decoding stops one byte past the budget left
+	read, err := io.ReadAll(s.decodeBudgetReader(parsed, strings.NewReader(strings.Repeat("x", 1000))))
+	require.NoError(t, err)
+	require.Len(t, read, 7)
+}
+
+func TestParsePriority(t *testing.T) {
+	p, _ := newTestPlugin(t, nil)
+
+	for header, want := range map[string]string{
+		"X-Priority: 1 (Highest)": "high",
+		"X-Priority: 2":           "high",
+		"X-Priority: 3":           "normal",
+		"X-Priority: 5 (Lowest)":  "low",
+		"Importance: High":        "high",
+		"Importance: low":         "low",
+		"Priority: urgent":        "high",
+		"Priority: non-urgent":    "low",
+		"X-Mailer: test":          "normal",
+	} {
+		parsed := parseTest(t, p, crlf(header, "Subject: x", "", "body"))
+		require.Equal(t, want, parsed.Priority, header)
+	}
+}
+
+func TestTransferEncodingWithComments(t *testing.T) {
+	p, _ := newTestPlugin(t, nil)
+
+	for _, encoding := range []string{"Base64\t", " BASE64 (wrapped at 76)", "base64(comment (nested))"} {
+		parsed := parseTest(t, p, crlf(
+			"Content-Type: text/plain",
+			"Content-Transfer-Encoding: "+encoding,
+			"",
+			base64.StdEncoding.EncodeToString([]byte("hello")),
+		))
+		require.Equal(t, "hello", parsed.TextBody, encoding)
+	}
+
+	parsed := parseTest(t, p, crlf(
+		"Content-Type: text/plain",
+		"Content-Transfer-Encoding: quoted-printable (soft breaks)",
+		"",
+		"a=3Db",
+	))
+	require.Equal(t, "a=b", parsed.TextBody)
+}
+
+func TestAttachmentPartIndex(t *testing.T) {
+	p, _ := newTestPlugin(t, nil)
+
+	raw := mixedMessage(
+		crlf(
+			"--b1",
+			`Content-Type: multipart/alternative; boundary="b2"`,
+			"",
+			"--b2",
+			"Content-Type: text/plain",
+			"",
+			"text",
+			"--b2",
+			"Content-Type: text/html",
+			"",
+			"<p>html</p>",
+			"--b2--",
+			"",
+		),
+		attachmentPart("b1", "first.bin", []byte("1")),
+		attachmentPart("b1", "second.bin", []byte("2")),
+	)
+
+	parsed := parseTest(t, p, raw)
+	require.Len(t, parsed.Attachments, 2)
+	require.Equal(t, 2, parsed.Attachments[0].PartIndex)
+	require.Equal(t, 3, parsed.Attachments[1].PartIndex)
+}
+
+func TestDecodeQuotedPrintable(t *testing.T) {
+	p, _ := newTestPlugin(t, nil)
+	s := newTestSession(p)
+
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"price: 10 =E2=82=AC", "price: 10 €"},
+		{"a=3Db", "a=b"},
+		{"soft =\r\nbreak", "soft break"},
+		{"trailing   \r\nspace", "trailing\r\nspace"},
+	} {
+		require.Equal(t, tc.want, string(s.decodeContent([]byte(tc.in), "quoted-printable")), tc.in)
+	}
+}
+
+func TestEncodedWordHeaders(t *testing.T) {
+	p, _ := newTestPlugin(t, func(cfg *Config) { cfg.IncludeRaw = true })
+
+	parsed := parseTest(t, p, crlf(
+		"Subject: =?UTF-8?B?4pyFIGRvbmU=?=",
+		"X-Q: =?ISO-8859-1?Q?caf=E9?=",
+		"X-Adjacent: =?UTF-8?Q?hello?= =?UTF-8?Q?_world?=",
+		"X-Unknown: =?x-unknown?Q?abc?=",
+		`From: =?UTF-8?Q?J=C3=BCrgen?= <j@example.com>`,
+		"",
+		"body",
+	))
+
+	require.Equal(t, "✅ done", parsed.Subject)
+	require.Equal(t, []string{"café"}, parsed.Headers["X-Q"])
+	require.Equal(t, []string{"hello world"}, parsed.Headers["X-Adjacent"])
+	require.Equal(t, []string{"=?x-unknown?Q?abc?="}, parsed.Headers["X-Unknown"])
+	require.Equal(t, "Jürgen", parsed.Sender[0].Name)
+	require.Equal(t, []string{"=?UTF-8?B?4pyFIGRvbmU=?="}, parsed.HeadersEncoded["Subject"])
+}
+
+func TestAlternativeBodies(t *testing.T) {
+	p, _ := newTestPlugin(t, nil)
+
+	parsed := parseTest(t, p, crlf(
+		`Content-Type: multipart/alternative; boundary="b1"`,
+		"",
+		"--b1",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		"plain text",
+		"--b1",
+		"Content-Type: text/html; charset=utf-8",
+		"",
+		"<p>html</p>",
+		"--b1--",
+		"",
+	))
+
+	require.Equal(t, "plain text", parsed.TextBody)
+	require.Equal(t, "<p>html</p>", parsed.HTMLBody)
+}
+
+func TestNestedMultipart(t *testing.T) {
+	p, _ := newTestPlugin(t, nil)
+
+	parsed := parseTest(t, p, crlf(
+		`Content-Type: multipart/mixed; boundary="b1"`,
+		"",
+		"--b1",
+		`Content-Type: multipart/related; boundary="b2"`,
+		"",
+		"--b2",
+		`Content-Type: multipart/alternative; boundary="b3"`,
+		"",
+		"--b3",
+		"Content-Type: text/plain",
+		"",
+		"deep text",
+		"--b3",
+		"Content-Type: text/html",
+		"",
+		`<img src="cid:logo@example">`,
+		"--b3--",
+		"",
+		"--b2",
+		"Content-Type: image/png",
+		"Content-ID: <logo@example>",
+		"Content-Transfer-Encoding: base64",
+		"",
+		base64.StdEncoding.EncodeToString([]byte("png")),
+		"--b2--",
+		"",
+		"--b1",
+		"Content-Type: application/pdf",
+		`Content-Disposition: attachment; filename="doc.pdf"`,
+		"",
+		"pdf",
+		"--b1--",
+		"",
+	))
+
+	require.Equal(t, "deep text", parsed.TextBody)
+	require.Equal(t, `<img src="cid:logo@example">`, parsed.HTMLBody)
+	require.Len(t, parsed.Attachments, 2)
+	require.Equal(t, "doc.pdf", parsed.Attachments[1].Filename)
+	require.Empty(t, parsed.SkippedParts)
+}
+
+func TestInlineContentID(t *testing.T) {
+	p, _ := newTestPlugin(t, nil)
+
+	parsed := parseTest(t, p, crlf(
+		`Content-Type: multipart/related; boundary="b1"`,
+		"",
+		"--b1",
+		"Content-Type: text/html",
+		"",
+		`<img src="cid:logo@example">`,
+		"--b1",
+		"Content-Type: image/png",
+		`Content-Disposition: inline; filename="logo.png"`,
+		"Content-ID: <logo@example>",
+		"Content-Transfer-Encoding: base64",
+		"",
+		base64.StdEncoding.EncodeToString([]byte("png")),
+		"--b1--",
+		"",
+	))
+
+	require.Len(t, parsed.Attachments, 1)
+	att := parsed.Attachments[0]
+	require.NotNil(t, att.ContentID)
+	require.Equal(t, "logo@example", *att.ContentID)
+	require.True(t, att.Inline)
+	require.Equal(t, "image/png", att.Type)
+}
+
+func TestAttachmentSHA256(t *testing.T) {
+	// Tolerated base64 quirks decode alike whether the content is kept or not
+	sloppy := crlf(
+		"--b1",
+		"Content-Type: application/octet-stream",
+		`Content-Disposition: attachment; filename="abc.txt"`,
+		"Content-Transfer-Encoding: base64",
+		"",
+		"YW Jj\t",
+		"",
+	)
+
+	for _, mode := range []string{"memory", "none", "tempfile"} {
+		p, _ := newTestPlugin(t, func(cfg *Config) { cfg.AttachmentStorage.Mode = mode })
+
+		for _, raw := range []string{mixedMessage(attachmentPart("b1", "abc.txt", []byte("abc"))), mixedMessage(sloppy)} {
+			parsed := parseTest(t, p, raw)
+			require.Len(t, parsed.Attachments, 1, mode)
+			// FIPS 180-2 test vector
+			require.Equal(t, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad", parsed.Attachments[0].SHA256, mode)
+			require.Equal(t, int64(3), parsed.Attachments[0].Size, mode)
+		}
+	}
+}
+
+func TestDecodeBase64(t *testing.T) {
+	for in, want := range map[string]string{
+		"YWJj":           "abc",
+		"YWI=":           "ab",
+		"YWI":            "ab",
+		"YQ==\r\n":       "a",
+		"YQ=":            "a",
+		" Y W\tJ j \r\n": "abc",
+	} {
+		decoded, err := decodeBase64([]byte(in))
+		require.NoError(t, err, in)
+		require.Equal(t, want, string(decoded), in)
+	}
+
+	for _, in := range []string{"YQ==YQ==", "Y", "YW!j"} {
+		_, err := decodeBase64([]byte(in))
+		require.Error(t, err, in)
+	}
+}
+
+func TestMaxAttachments(t *testing.T) {
+	parts := make([]string, 101)
+	for i := range parts {
+		parts[i] = attachmentPart("b1", fmt.Sprintf("%d.bin", i), []byte("x"))
+	}
+
+	// Unlimited by default
+	p, _ := newTestPlugin(t, nil)
+	require.Zero(t, p.cfg.MaxAttachments)
+	require.Len(t, parseTest(t, p, mixedMessage(parts...)).Attachments, 101)
+
+	p, _ = newTestPlugin(t, func(cfg *Config) { cfg.MaxAttachments = 100 })
+	_, err := newTestSession(p).parseEmail([]byte(mixedMessage(parts...)))
+	require.ErrorIs(t, err, errTooManyAttachments)
+
+	parsed := parseTest(t, p, mixedMessage(parts[:100]...))
+	require.Len(t, parsed.Attachments, 100)
+
+	cfg := &Config{MaxAttachments: -1}
+	require.ErrorContains(t, cfg.InitDefaults(), "max_attachments cannot be negative")
+}
+
+func TestWrappedBase64Attachment(t *testing.T) {
+	p, _ := newTestPlugin(t, nil)
+
+	content := []byte("%PDF-1.4\n" + strings.Repeat("0123456789abcdef", 20) + "\n%%EOF\n")
+	encoded := base64.StdEncoding.EncodeToString(content)
+	var wrapped []string
+	for len(encoded) > 76 {
+		wrapped = append(wrapped, encoded[:76])
+		encoded = encoded[76:]
+	}
+	wrapped = append(wrapped, encoded)
+
+	parsed := parseTest(t, p, mixedMessage(crlf(
+		"--b1",
+		"Content-Type: application/pdf",
+		`Content-Disposition: attachment; filename="doc.pdf"`,
+		"Content-Transfer-Encoding: base64",
+		"",
+		crlf(wrapped...),
+		"",
+	)))
+
+	require.Len(t, parsed.Attachments, 1)
+	decoded, err := base64.StdEncoding.DecodeString(parsed.Attachments[0].Content)
+	require.NoError(t, err)
+	require.Equal(t, content, decoded)
+
+	sum := sha256.Sum256(content)
+	require.Equal(t, hex.EncodeToString(sum[:]), parsed.Attachments[0].SHA256)
+}
+
+func TestCalendarPartDecoded(t *testing.T) {
+	calendar := crlf(
+		"BEGIN:VCALENDAR",
+		"METHOD:REQUEST",
+		"BEGIN:VEVENT",
+		"UID:1",
+		"SUMMARY:R\xe9union",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	)
+	raw := mixedMessage(
+		crlf("--b1", "Content-Type: text/plain", "", "body", ""),
+		crlf("--b1", "Content-Type: text/calendar; method=REQUEST; charset=iso-8859-1", "", calendar, ""),
+	)
+
+	p, _ := newTestPlugin(t, func(cfg *Config) { cfg.ParseCalendar = true })
+	parsed := parseTest(t, p, raw)
+	require.NotNil(t, parsed.Calendar)
+	require.Equal(t, "Réunion", parsed.Calendar.Summary)
+
+	p, _ = newTestPlugin(t, func(cfg *Config) {
+		cfg.ParseCalendar = true
+		cfg.MaxDecodedBytes = int64(len("body") + len(calendar) - 1)
+	})
+	parsed = parseTest(t, p, raw)
+	require.True(t, parsed.DecodeLimitExceeded)
+	require.Nil(t, parsed.Calendar)
+}
+
+func TestAttachmentOverMaxSizeDropped(t *testing.T) {
+	p, _ := newTestPlugin(t, func(cfg *Config) { cfg.MaxAttachmentSize = 4 })
+
+	parsed := parseTest(t, p, mixedMessage(
+		attachmentPart("b1", "small.bin", []byte("abcd")),
+		attachmentPart("b1", "large.bin", []byte("abcde")),
+	))
+	require.Len(t, parsed.Attachments, 2)
+	require.False(t, parsed.Attachments[0].Dropped)
+
+	large := parsed.Attachments[1]
+	require.True(t, large.Truncated)
+	require.True(t, large.Dropped)
+	require.Equal(t, skipSizeLimit, large.DropReason)
+	require.Empty(t, large.Content)
+	require.EqualValues(t, 5, large.Size)
+
+	require.Len(t, parsed.SkippedParts, 1)
+	require.Equal(t, skipSizeLimit, parsed.SkippedParts[0].Reason)
+	require.Equal(t, "large.bin", parsed.SkippedParts[0].Filename)
+	require.Equal(t, 1, parsed.SkippedParts[0].PartIndex)
+}
+
+func TestReceivedHeader(t *testing.T) {
+	p, _ := newTestPlugin(t, func(cfg *Config) { cfg.Hostname = "mx.example" })
+	s := newTestSession(p)
+	s.messageCount = 2
+	s.remoteHost = "client.example.net"
+
+	now := time.Date(2026, time.March, 5, 9, 4, 7, 0, time.FixedZone("", 2*60*60))
+	out := string(s.prependReceived([]byte("Subject: hi\r\n\r\nbody\r\n"), now))
+	require.Equal(t, crlf(
+		"Received: from client.example (client.example.net [192.0.2.1])",
+		"\tby mx.example with SMTP id test-uuid-2;",
+		"\tThu, 05 Mar 2026 09:04:07 +0200",
+		"Subject: hi",
+		"",
+		"body",
+		"",
+	), out)
+
+	msg, err := mail.ReadMessage(strings.NewReader(out))
+	require.NoError(t, err)
+	received := msg.Header.Get("Received")
+	date, err := mail.ParseDate(strings.TrimSpace(received[strings.LastIndexByte(received, ';')+1:]))
+	require.NoError(t, err)
+	require.True(t, now.Equal(date))
+
+	// Bare LF messages get bare LF trace lines, clients without an IP no address
+	s.remoteIP = ""
+	out = string(s.prependReceived([]byte("Subject: hi\n\nbody\n"), now))
+	require.True(t, strings.HasPrefix(out, "Received: from client.example\n\tby mx.example"), out)
+}
+
+func TestReceivedHeaderIDPerMessage(t *testing.T) {
+	p, w := newTestPlugin(t, func(cfg *Config) { cfg.AddReceivedHeader = true })
+	addr := startTestServer(t, p)
+
+	c, _, _ := dialTest(t, addr)
+	c.cmd("EHLO client.example")
+	for range 2 {
+		code, _ := c.send("a@example.com", []string{"b@example.com"}, "Subject: hi\r\n\r\nbody")
+		require.Equal(t, 250, code)
+	}
+
+	events := w.eventsOf("EMAIL_RECEIVED")
+	require.Len(t, events, 2)
+	for i, event := range events {
+		received := event["headers"].(map[string]any)["Received"].([]any)[0].(string)
+		require.Contains(t, received, fmt.Sprintf(" with ESMTP id %s-%d;", event["uuid"], i+1))
+	}
+}
+
+func TestSplitAddressList(t *testing.T) {
+	for value, want := range map[string][]string{
+		`a@example.com`: {"a@example.com"},
+		`"Doe, John" <john@example.com>, jane@example.com`:  {`"Doe, John" <john@example.com>`, "jane@example.com"},
+		`"Say \"hi\", then" <a@example.com>,b@example.com`:  {`"Say \"hi\", then" <a@example.com>`, "b@example.com"},
+		`a@example.com (Doe, John (jr, ok)), b@example.com`: {"a@example.com (Doe, John (jr, ok))", "b@example.com"},
+		`<"odd,local"@example.com>, , c@example.com,`:       {`<"odd,local"@example.com>`, "c@example.com"},
+		`Team: a@example.com, b@example.com;`:               {"Team: a@example.com", "b@example.com;"},
+		`"unterminated, <a@example.com>, b@example.com`:     {`"unterminated, <a@example.com>, b@example.com`},
+		`  `: nil,
+	} {
+		require.Equal(t, want, splitAddressList(value), value)
+	}
+}
+
+func TestParseAddressHeaders(t *testing.T) {
+	p, _ := newTestPlugin(t, nil)
+
+	parsed := parseTest(t, p, crlf(
+		`From: "Doe, John" <john@example.com>`,
+		`To: "Smith, Jane (Sales)" <jane@example.com>, bob@example.com, =?UTF-8?Q?Ren=C3=A9e?= <renee@example.com>`,
+		`Cc: broken@@example.com, "Quoted" <carol@example.com>, <>`,
+		"Subject: hi",
+		"",
+		"body",
+	))
+	require.Equal(t, []EmailAddress{{Email: "john@example.com", Name: "Doe, John"}}, parsed.Sender)
+	require.Equal(t, []EmailAddress{
+		{Email: "jane@example.com", Name: "Smith, Jane (Sales)"},
+		{Email: "bob@example.com"},
+		{Email: "renee@example.com", Name: "Renée"},
+	}, parsed.Recipients)
+	// Malformed entries are skipped, the rest of the list is kept
+	require.Equal(t, []EmailAddress{{Email: "carol@example.com", Name: "Quoted"}}, parsed.CCs)
+	require.Empty(t, parsed.ReplyTo)
+	require.Equal(t, "example.com", parsed.HeaderFromDomain)
+}
+
+func TestParseDate(t *testing.T) {
+	p, _ := newTestPlugin(t, nil)
+
+	parsed := parseTest(t, p, crlf("Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)", "Subject: hi", "", "body"))
+	require.Equal(t, "2003-07-11T21:00:37-07:00", parsed.Date)
+
+	// An unparseable date leaves the field empty, the rest is parsed
+	parsed = parseTest(t, p, crlf("Date: yesterday at noon", "Subject: hi", "", "body"))
+	require.Empty(t, parsed.Date)
+	require.False(t, parsed.DateClamped)
+	require.Equal(t, "hi", parsed.Subject)
+	require.Equal(t, []string{"yesterday at noon"}, parsed.Headers["Date"])
+}
+
+func TestOrderedHeadersKeepReceivedOrder(t *testing.T) {
+	raw := crlf(
+		"Received: from c.example by d.example; Fri, 11 Jul 2003 21:00:39 -0700",
+		"Subject: hi",
+		"Received: from b.example",
+		"\tby c.example; Fri, 11 Jul 2003 21:00:38 -0700",
+		"received: from a.example by b.example; Fri, 11 Jul 2003 21:00:37 -0700",
+		"",
+		"body",
+	)
+
+	p, _ := newTestPlugin(t, func(cfg *Config) { cfg.OrderedHeaders = true })
+	parsed := parseTest(t, p, raw)
+	require.Equal(t, [][2]string{
+		{"Received", "from c.example by d.example; Fri, 11 Jul 2003 21:00:39 -0700"},
+		{"Subject", "hi"},
+		{"Received", "from b.example by c.example; Fri, 11 Jul 2003 21:00:38 -0700"},
+		{"received", "from a.example by b.example; Fri, 11 Jul 2003 21:00:37 -0700"},
+	}, parsed.HeadersRaw)
+
+	// The trace header of this hop goes on top
+	p, _ = newTestPlugin(t, func(cfg *Config) {
+		cfg.OrderedHeaders = true
+		cfg.AddReceivedHeader = true
+	})
+	parsed = parseTest(t, p, raw)
+	var received []string
+	for _, field := range parsed.HeadersRaw {
+		if strings.EqualFold(field[0], "Received") {
+			received = append(received, field[1])
+		}
+	}
+	require.Len(t, received, 4)
+	require.True(t, strings.HasPrefix(received[0], "from client.example "), received[0])
+	require.True(t, strings.HasPrefix(received[1], "from c.example"))
+	require.True(t, strings.HasPrefix(received[2], "from b.example"))
+	require.True(t, strings.HasPrefix(received[3], "from a.example"))
+}
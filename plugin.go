@@ -2,8 +2,11 @@ package smtp
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/emersion/go-smtp"
 	"github.com/roadrunner-server/errors"
@@ -63,11 +66,53 @@ type Plugin struct {
 
 	wPool       Pool
 	connections sync.Map // uuid -> *Session
+	clients     sync.Map // *clientConn -> struct{}, every accepted connection
 	pldPool     sync.Pool
 
+	// Delivers marshaled events instead of wPool when set (tests)
+	exec func(jsonData []byte) (string, error)
+
 	// SMTP server components
 	smtpServer *smtp.Server
 	listener   net.Listener
+
+	// Implicit TLS server on tls_addr, nil when disabled
+	smtpsServer *smtp.Server
+	tlsListener net.Listener
+
+	// Set once Stop is called, new transactions are refused
+	shuttingDown atomic.Bool
+
+	// Messages not forwarded due to delivery_filter since the last report
+	filteredCount atomic.Uint64
+
+	// Aggregate counters since startup
+	stats stats
+
+	// Shared, cached and bounded DNS lookups
+	dns *dnsResolver
+
+	// Sessions counted against max_connections
+	activeSessions atomic.Int64
+
+	// Per client IP token buckets (rate_limit), nil when disabled
+	connLimiter *rateLimiter
+	msgLimiter  *rateLimiter
+
+	// Bounds concurrent parsing (parse_concurrency), nil when unlimited
+	parseSem chan struct{}
+
+	// Object store for attachment_storage.mode s3
+	uploader attachmentUploader
+
+	// STARTTLS configuration, nil without a certificate
+	tlsConfig *tls.Config
+
+	// HMAC key for credential_storage
+	credentialKey []byte
+
+	// Bounds attachment temp file writes (max_concurrent_attachment_writes), nil when unlimited
+	attachmentWriteSem chan struct{}
 }
 
 // Init initializes the plugin with configuration and logger
@@ -100,6 +145,37 @@ func (p *Plugin) Init(log Logger, cfg Configurer, server Server) error {
 	// Setup logger
 	p.log = log.NamedLogger(PluginName)
 	p.server = server
+	p.stats.startedAt = time.Now()
+	p.dns = newDNSResolver(p.cfg, &p.stats)
+	p.connLimiter = newRateLimiter(p.cfg.RateLimit.ConnectionsPerMinute)
+	p.msgLimiter = newRateLimiter(p.cfg.RateLimit.MessagesPerMinute)
+
+	if p.cfg.AttachmentStorage.Mode == "s3" {
+		p.uploader, err = newS3Uploader(&p.cfg.AttachmentStorage.S3)
+		if err != nil {
+			return errors.E(op, err)
+		}
+	}
+
+	if p.cfg.TLS.enabled() {
+		p.tlsConfig, err = p.cfg.TLS.build()
+		if err != nil {
+			return errors.E(op, err)
+		}
+	}
+
+	p.credentialKey, err = credentialKey(p.cfg.CredentialKey)
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	if p.cfg.ParseConcurrency > 0 {
+		p.parseSem = make(chan struct{}, p.cfg.ParseConcurrency)
+	}
+
+	if p.cfg.MaxConcurrentAttachmentWrites > 0 {
+		p.attachmentWriteSem = make(chan struct{}, p.cfg.MaxConcurrentAttachmentWrites)
+	}
 
 	p.log.Info("SMTP plugin initialized",
 		zap.String("addr", p.cfg.Addr),
@@ -132,14 +208,7 @@ func (p *Plugin) Serve() chan error {
 	backend := NewBackend(p)
 
 	// 3. Create SMTP server
-	p.smtpServer = smtp.NewServer(backend)
-	p.smtpServer.Addr = p.cfg.Addr
-	p.smtpServer.Domain = p.cfg.Hostname
-	p.smtpServer.ReadTimeout = p.cfg.ReadTimeout
-	p.smtpServer.WriteTimeout = p.cfg.WriteTimeout
-	p.smtpServer.MaxMessageBytes = p.cfg.MaxMessageSize
-	p.smtpServer.MaxRecipients = 100
-	p.smtpServer.AllowInsecureAuth = true
+	p.smtpServer = p.newSMTPServer(backend, p.cfg.Addr)
 
 	p.log.Info("SMTP server configured",
 		zap.String("addr", p.smtpServer.Addr),
@@ -147,29 +216,107 @@ func (p *Plugin) Serve() chan error {
 	)
 
 	// 4. Create listener
-	p.listener, err = net.Listen("tcp", p.cfg.Addr)
+	lc := net.ListenConfig{KeepAlive: p.cfg.keepAlivePeriod()}
+	ln, err := lc.Listen(context.Background(), "tcp", p.cfg.Addr)
 	if err != nil {
 		errCh <- errors.E(errors.Op("smtp_listen"), err)
 		return errCh
 	}
+	plain := &listener{Listener: ln, plugin: p}
+	p.offerStartTLS(p.smtpServer, plain)
+	p.listener = plain
 
 	p.log.Info("SMTP listener created", zap.String("addr", p.cfg.Addr))
 
-	// 5. Start SMTP server in goroutine
+	// Implicit TLS shares the backend, so sessions, stats and shutdown are common.
+	// Connections are wrapped after the handshake to keep observing plaintext.
+	if p.cfg.TLSAddr != "" {
+		tln, err := lc.Listen(context.Background(), "tcp", p.cfg.TLSAddr)
+		if err != nil {
+			_ = ln.Close()
+			errCh <- errors.E(errors.Op("smtp_listen_tls"), err)
+			return errCh
+		}
+		p.tlsListener = &listener{Listener: tls.NewListener(tln, p.tlsConfig), plugin: p}
+		// No TLSConfig: STARTTLS must not be offered on an encrypted connection
+		p.smtpsServer = p.newSMTPServer(backend, p.cfg.TLSAddr)
+
+		p.log.Info("SMTPS listener created", zap.String("addr", p.cfg.TLSAddr))
+	}
+
+	// 5. Hold the listeners until enough workers are ready, then start serving.
+	// The wait runs without p.mu so Stop and the worker RPCs are not blocked.
+	pool, srv, ln, smtpsSrv, tlsLn := p.wPool, p.smtpServer, p.listener, p.smtpsServer, p.tlsListener
 	go func() {
-		p.log.Info("SMTP server starting", zap.String("addr", p.cfg.Addr))
-		if err := p.smtpServer.Serve(p.listener); err != nil {
-			p.log.Error("SMTP server error", zap.Error(err))
-			errCh <- err
+		p.waitForWorkers(pool)
+
+		// 6. Start SMTP servers
+		go p.serveListener(srv, ln, errCh)
+		if smtpsSrv != nil {
+			go p.serveListener(smtpsSrv, tlsLn, errCh)
 		}
+
+		// Deliver events spooled by a previous run
+		p.replaySpool()
 	}()
 
-	// 6. Start temp file cleanup routine
+	// 7. Start temp file cleanup routine
 	p.startCleanupRoutine(context.Background())
 
+	// 8. Start delivery filter reporting
+	p.startFilterReportRoutine(context.Background())
+
+	// 9. Start eviction of idle rate limit buckets
+	p.startRateLimitEviction(context.Background())
+
 	return errCh
 }
 
+// newSMTPServer creates a go-smtp server for addr with the shared settings
+func (p *Plugin) newSMTPServer(backend *Backend, addr string) *smtp.Server {
+	srv := smtp.NewServer(backend)
+	srv.Addr = addr
+	srv.Domain = p.cfg.Hostname
+	srv.ReadTimeout = p.cfg.ReadTimeout
+	srv.WriteTimeout = p.cfg.WriteTimeout
+	srv.MaxMessageBytes = p.cfg.maxAcceptedMessageSize()
+	// max_recipients is enforced by the session, go-smtp would count duplicates
+	srv.MaxRecipients = 0
+	srv.AllowInsecureAuth = true
+
+	if preset, ok := mtaPresets[p.cfg.Emulate]; ok {
+		srv.EnableSMTPUTF8 = preset.smtputf8
+		srv.EnableDSN = preset.dsn
+		srv.EnableBINARYMIME = preset.binarymime
+	}
+
+	return srv
+}
+
+// offerStartTLS hands STARTTLS to guardedConn when connections are guarded, so
+// the dialog stays observable after the upgrade, and to go-smtp otherwise
+func (p *Plugin) offerStartTLS(srv *smtp.Server, l *listener) {
+	if p.cfg.guardsConnections() {
+		l.tlsConfig = p.tlsConfig
+		return
+	}
+	srv.TLSConfig = p.tlsConfig
+}
+
+// serveListener runs srv on ln, reporting unexpected failures to errCh
+func (p *Plugin) serveListener(srv *smtp.Server, ln net.Listener, errCh chan error) {
+	p.log.Info("SMTP server starting", zap.String("addr", srv.Addr))
+	if err := srv.Serve(ln); err != nil {
+		// Closed listener errors are expected while stopping
+		if p.shuttingDown.Load() && isClosedError(err) {
+			p.log.Debug("SMTP server stopped", zap.String("addr", srv.Addr), zap.Error(err))
+			return
+		}
+		p.log.Error("SMTP server error", zap.String("addr", srv.Addr), zap.Error(err))
+		errCh <- errors.E(errors.Op("smtp_serve"), err)
+	}
+}
+
 // Stop gracefully stops the plugin
 func (p *Plugin) Stop(ctx context.Context) error {
 	p.log.Info("stopping SMTP plugin")
@@ -177,22 +324,48 @@ func (p *Plugin) Stop(ctx context.Context) error {
 	doneCh := make(chan struct{}, 1)
 
 	go func() {
+		// 1. Refuse new transactions, in-flight DATA is allowed to complete
+		p.shuttingDown.Store(true)
+
+		p.mu.RLock()
+		servers := []*smtp.Server{p.smtpServer, p.smtpsServer}
+		p.mu.RUnlock()
+
+		// 2. Wait for active sessions, force-close them when ctx expires.
+		// Must run without p.mu held: in-flight sessions need it to reach the pool.
+		var wg sync.WaitGroup
+		for _, srv := range servers {
+			if srv == nil {
+				continue
+			}
+			wg.Add(1)
+			go func(srv *smtp.Server) {
+				defer wg.Done()
+				if err := srv.Shutdown(ctx); err != nil && !isClosedError(err) {
+					p.log.Warn("graceful shutdown incomplete, closing connections",
+						zap.String("addr", srv.Addr),
+						zap.Error(err),
+					)
+				}
+			}(srv)
+		}
+		wg.Wait()
+
 		p.mu.Lock()
 		defer p.mu.Unlock()
 
-		// 1. Close listener (stops accepting new connections)
+		// Close listeners (already closed by Shutdown in the normal case)
 		if p.listener != nil {
 			_ = p.listener.Close()
 		}
-
-		// 2. Close SMTP server
-		if p.smtpServer != nil {
-			_ = p.smtpServer.Close()
+		if p.tlsListener != nil {
+			_ = p.tlsListener.Close()
 		}
 
-		// 3. Close all tracked connections
-		p.connections.Range(func(key, value any) bool {
-			// Sessions will be cleaned up by Logout()
+		// 3. Close connections left by a timed out Shutdown. srv.Close can't be
+		// used for that, after Shutdown it returns ErrServerClosed right away.
+		p.clients.Range(func(key, _ any) bool {
+			_ = key.(*clientConn).Close()
 			return true
 		})
 
@@ -267,6 +440,11 @@ func (p *Plugin) Workers() []*process.State {
 	return ps
 }
 
+// RPC returns associated rpc service
+func (p *Plugin) RPC() any {
+	return &rpc{p: p}
+}
+
 // Name returns plugin name for RoadRunner
 func (p *Plugin) Name() string {
 	return PluginName
@@ -0,0 +1,125 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/roadrunner-server/pool/worker"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStopClosesConnectionsAfterTimeout(t *testing.T) {
+	p, _ := newTestPlugin(t, nil)
+	addr := startTestServer(t, p)
+
+	// One idle greeted client and one that never greets
+	greeted, _, _ := dialTest(t, addr)
+	code, _ := greeted.cmd("EHLO client.example")
+	require.Equal(t, 250, code)
+	silent, _, _ := dialTest(t, addr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, p.Stop(ctx), context.DeadlineExceeded)
+
+	require.True(t, greeted.closed())
+	require.True(t, silent.closed())
+	require.Eventually(t, func() bool {
+		empty := true
+		p.clients.Range(func(_, _ any) bool {
+			empty = false
+			return false
+		})
+		return empty
+	}, time.Second, 10*time.Millisecond)
+}
+
+// failingListener fails Accept with err
+type failingListener struct {
+	net.Listener
+	err error
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	return nil, l.err
+}
+
+func TestServeErrorsDuringShutdown(t *testing.T) {
+	p, _ := newTestPlugin(t, nil)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := p.newSMTPServer(NewBackend(p), ln.Addr().String())
+
+	errCh := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		p.serveListener(srv, ln, errCh)
+		close(done)
+	}()
+
+	p.shuttingDown.Store(true)
+	require.NoError(t, ln.Close())
+	<-done
+	require.Empty(t, errCh)
+}
+
+func TestServeErrorsEscalated(t *testing.T) {
+	for name, err := range map[string]error{
+		"accept failure": errors.New("accept: too many open files"),
+		// Not stopping, so a closed listener is a failure too
+		"closed listener": net.ErrClosed,
+	} {
+		t.Run(name, func(t *testing.T) {
+			p, _ := newTestPlugin(t, nil)
+			ln, listenErr := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, listenErr)
+			defer ln.Close()
+			srv := p.newSMTPServer(NewBackend(p), ln.Addr().String())
+
+			errCh := make(chan error, 1)
+			p.serveListener(srv, &failingListener{Listener: ln, err: err}, errCh)
+			require.Len(t, errCh, 1)
+			require.ErrorContains(t, <-errCh, err.Error())
+		})
+	}
+}
+
+// idlePool is a pool whose workers never become ready
+type idlePool struct {
+	Pool
+}
+
+func (idlePool) Workers() []*worker.Process {
+	return nil
+}
+
+func (idlePool) AddWorker() error {
+	return nil
+}
+
+func TestWaitForWorkersDoesNotBlockPlugin(t *testing.T) {
+	p, _ := newTestPlugin(t, func(cfg *Config) {
+		cfg.WaitForWorkers = 1
+		cfg.WorkerReadyTimeout = time.Minute
+	})
+	p.wPool = idlePool{}
+
+	done := make(chan struct{})
+	go func() {
+		p.waitForWorkers(idlePool{})
+		close(done)
+	}()
+
+	// Worker RPCs go through while serving waits
+	require.NoError(t, p.AddWorker())
+
+	p.shuttingDown.Store(true)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("waitForWorkers kept waiting after stop")
+	}
+}
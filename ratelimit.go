@@ -0,0 +1,156 @@
+package smtp
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"go.uber.org/zap"
+)
+
+const (
+	// rateLimitShards spreads client IPs over independently locked maps
+	rateLimitShards = 32
+	// rateLimitEvictInterval is how often idle buckets are dropped
+	rateLimitEvictInterval = time.Minute
+)
+
+// errConnectionRateLimited is returned at greeting when a client IP opens
+// connections faster than rate_limit.connections_per_minute
+var errConnectionRateLimited = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+	Message:      "Too many connections, try again later",
+}
+
+// errMessageRateLimited is returned at DATA when a client IP sends messages
+// faster than rate_limit.messages_per_minute
+var errMessageRateLimited = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+	Message:      "Message rate limit exceeded, try again later",
+}
+
+// errTooManyConnections is returned at greeting when max_connections sessions are open
+var errTooManyConnections = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+	Message:      "Too many connections",
+}
+
+// rateLimiter is a token bucket per key: perMinute tokens refill evenly over
+// a minute and up to perMinute may be spent at once
+type rateLimiter struct {
+	rate   float64 // tokens per second
+	burst  float64
+	shards [rateLimitShards]rateLimitShard
+}
+
+type rateLimitShard struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter creates a limiter, nil when perMinute is 0 (disabled)
+func newRateLimiter(perMinute int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+
+	l := &rateLimiter{
+		rate:  float64(perMinute) / 60,
+		burst: float64(perMinute),
+	}
+	for i := range l.shards {
+		l.shards[i].buckets = make(map[string]*tokenBucket)
+	}
+	return l
+}
+
+// allow takes a token for key and reports whether one was available.
+// A nil limiter allows everything.
+func (l *rateLimiter) allow(key string, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+
+	shard := l.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	b, ok := shard.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		shard.buckets[key] = b
+	}
+
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// evict drops buckets that have refilled completely, they are
+// indistinguishable from a new bucket
+func (l *rateLimiter) evict(now time.Time) int {
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+
+	evicted := 0
+	for i := range l.shards {
+		shard := &l.shards[i]
+		shard.mu.Lock()
+		for key, b := range shard.buckets {
+			if now.Sub(b.last) >= full {
+				delete(shard.buckets, key)
+				evicted++
+			}
+		}
+		shard.mu.Unlock()
+	}
+	return evicted
+}
+
+func (l *rateLimiter) shard(key string) *rateLimitShard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return &l.shards[h.Sum32()%rateLimitShards]
+}
+
+// startRateLimitEviction periodically drops idle rate limit buckets
+func (p *Plugin) startRateLimitEviction(ctx context.Context) {
+	if p.connLimiter == nil && p.msgLimiter == nil {
+		return
+	}
+
+	ticker := time.NewTicker(rateLimitEvictInterval)
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			case now := <-ticker.C:
+				for _, l := range []*rateLimiter{p.connLimiter, p.msgLimiter} {
+					if l == nil {
+						continue
+					}
+					if n := l.evict(now); n > 0 {
+						p.log.Debug("evicted idle rate limit buckets", zap.Int("count", n))
+					}
+				}
+			}
+		}
+	}()
+}
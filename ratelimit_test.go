@@ -0,0 +1,52 @@
+package smtp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectionRateLimit(t *testing.T) {
+	p, _ := newTestPlugin(t, func(cfg *Config) { cfg.RateLimit.ConnectionsPerMinute = 2 })
+	addr := startTestServer(t, p)
+
+	// Greeting again takes no further token
+	c, _, _ := dialTest(t, addr)
+	for _, greeting := range []string{"HELO", "EHLO", "EHLO", "EHLO"} {
+		code, _ := c.cmd("%s client.example", greeting)
+		require.Equal(t, 250, code)
+	}
+
+	c, _, _ = dialTest(t, addr)
+	code, _ := c.cmd("EHLO client.example")
+	require.Equal(t, 250, code)
+
+	c, _, _ = dialTest(t, addr)
+	code, msg := c.cmd("EHLO client.example")
+	require.Equal(t, 421, code)
+	require.Equal(t, "4.7.0 Too many connections, try again later", msg)
+	require.True(t, c.closed())
+}
+
+func TestMessageRateLimit(t *testing.T) {
+	p, w := newTestPlugin(t, func(cfg *Config) { cfg.RateLimit.MessagesPerMinute = 2 })
+	addr := startTestServer(t, p)
+
+	c, _, _ := dialTest(t, addr)
+	c.cmd("EHLO client.example")
+	for range 2 {
+		code, _ := c.send("a@example.com", []string{"b@example.com"}, "Subject: hi\r\n\r\nbody")
+		require.Equal(t, 250, code)
+	}
+
+	code, msg := c.send("a@example.com", []string{"b@example.com"}, "Subject: hi\r\n\r\nbody")
+	require.Equal(t, 451, code)
+	require.Equal(t, "4.7.1 Message rate limit exceeded, try again later", msg)
+	require.Len(t, w.eventsOf("EMAIL_RECEIVED"), 2)
+
+	// The rate is per client IP, not per connection
+	c, _, _ = dialTest(t, addr)
+	c.cmd("EHLO client.example")
+	code, _ = c.send("a@example.com", []string{"b@example.com"}, "Subject: hi\r\n\r\nbody")
+	require.Equal(t, 451, code)
+}
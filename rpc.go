@@ -11,6 +11,7 @@ import (
 type ConnectionInfo struct {
 	UUID          string   `json:"uuid"`
 	RemoteAddr    string   `json:"remote_addr"`
+	LocalAddr     string   `json:"local_addr"`
 	From          string   `json:"from"`
 	To            []string `json:"to"`
 	Authenticated bool     `json:"authenticated"`
@@ -85,6 +86,7 @@ func (r *rpc) ListConnections(_ bool, connections *[]ConnectionInfo) error {
 		result = append(result, ConnectionInfo{
 			UUID:          session.uuid,
 			RemoteAddr:    session.remoteAddr,
+			LocalAddr:     session.localAddr,
 			From:          session.from,
 			To:            session.to,
 			Authenticated: session.authenticated,
@@ -96,3 +98,20 @@ func (r *rpc) ListConnections(_ bool, connections *[]ConnectionInfo) error {
 	*connections = result
 	return nil
 }
+
+// Inject runs a raw message through parsing and worker delivery exactly like
+// a message received over SMTP and returns the worker response
+func (r *rpc) Inject(raw []byte, out *WorkerResponse) error {
+	if len(raw) == 0 {
+		return errors.Str("empty message")
+	}
+
+	*out = *r.p.inject(raw)
+	return nil
+}
+
+// Stats returns aggregate counters since plugin startup
+func (r *rpc) Stats(_ bool, out *Stats) error {
+	*out = r.p.stats.snapshot()
+	return nil
+}
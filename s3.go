@@ -0,0 +1,231 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/roadrunner-server/errors"
+	"go.uber.org/zap"
+)
+
+// attachmentUploader stores decoded attachment content in an object store
+// (attachment_storage.mode: s3) and returns its location
+type attachmentUploader interface {
+	upload(ctx context.Context, key, contentType string, content []byte) (string, error)
+	// remove deletes an object by the location upload returned
+	remove(ctx context.Context, location string) error
+}
+
+// s3Uploader puts objects to S3 or an S3 compatible store such as MinIO,
+// requests are signed with AWS Signature Version 4
+type s3Uploader struct {
+	client       *http.Client
+	endpoint     *url.URL
+	bucket       string
+	region       string
+	pathStyle    bool
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// newS3Uploader creates the uploader, credentials not set in the config are
+// taken from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+func newS3Uploader(cfg *S3Config) (*s3Uploader, error) {
+	const op = errors.Op("smtp_s3_uploader")
+
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, errors.E(op, errors.Errorf("invalid attachment_storage.s3.endpoint %q", cfg.Endpoint))
+	}
+
+	up := &s3Uploader{
+		client:       &http.Client{Timeout: cfg.Timeout},
+		endpoint:     u,
+		bucket:       cfg.Bucket,
+		region:       cfg.Region,
+		pathStyle:    cfg.ForcePathStyle,
+		accessKey:    cfg.AccessKey,
+		secretKey:    cfg.SecretKey,
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if up.accessKey == "" {
+		up.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		up.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if up.accessKey == "" || up.secretKey == "" {
+		return nil, errors.E(op, errors.Str("s3 mode needs access_key/secret_key or AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY"))
+	}
+
+	return up, nil
+}
+
+// objectURL returns the URL and escaped path of the object under key
+func (u *s3Uploader) objectURL(key string) (string, string) {
+	host := u.endpoint.Host
+	path := strings.TrimSuffix(u.endpoint.EscapedPath(), "/")
+	if u.pathStyle {
+		path += "/" + s3EscapePath(u.bucket)
+	} else {
+		host = u.bucket + "." + host
+	}
+	path += "/" + s3EscapePath(key)
+
+	return u.endpoint.Scheme + "://" + host + path, path
+}
+
+// upload puts content under key and returns its s3://bucket/key location
+func (u *s3Uploader) upload(ctx context.Context, key, contentType string, content []byte) (string, error) {
+	target, path := u.objectURL(key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, bytes.NewReader(content))
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = int64(len(content))
+	req.Header.Set("Content-Type", contentType)
+
+	sum := sha256.Sum256(content)
+	u.sign(req, path, hex.EncodeToString(sum[:]), time.Now().UTC())
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("s3 put %s: %s: %s", key, resp.Status, bytes.TrimSpace(body))
+	}
+
+	return "s3://" + u.bucket + "/" + key, nil
+}
+
+// remove deletes the object at an s3://bucket/key location
+func (u *s3Uploader) remove(ctx context.Context, location string) error {
+	key, ok := strings.CutPrefix(location, "s3://"+u.bucket+"/")
+	if !ok {
+		return fmt.Errorf("s3 delete: %s is not in bucket %s", location, u.bucket)
+	}
+
+	target, path := u.objectURL(key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, target, nil)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(nil)
+	u.sign(req, path, hex.EncodeToString(sum[:]), time.Now().UTC())
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("s3 delete %s: %s: %s", key, resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// sign adds SigV4 headers for a request without query parameters
+func (u *s3Uploader) sign(req *http.Request, canonicalURI, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if u.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", u.sessionToken)
+	}
+
+	// Canonical headers must be sorted by lowercase name
+	headers := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	signed := "host;x-amz-content-sha256;x-amz-date"
+	if u.sessionToken != "" {
+		headers += "x-amz-security-token:" + u.sessionToken + "\n"
+		signed += ";x-amz-security-token"
+	}
+
+	canonical := strings.Join([]string{req.Method, canonicalURI, "", headers, signed, payloadHash}, "\n")
+	hashed := sha256.Sum256([]byte(canonical))
+
+	scope := date + "/" + u.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+u.secretKey), date)
+	key = hmacSHA256(key, u.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+u.accessKey+"/"+scope+
+		", SignedHeaders="+signed+", Signature="+hex.EncodeToString(hmacSHA256(key, toSign)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3EscapePath percent-encodes an object key as SigV4 expects, keeping slashes
+func s3EscapePath(key string) string {
+	const unreserved = "-_.~/"
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte(unreserved, c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// attachmentKey returns the object key of an attachment:
+// <prefix><uuid>-<message>/<partIndex>-<filename>
+func (s *Session) attachmentKey(partIndex int, filename string) string {
+	return fmt.Sprintf("%s%s/%d-%s",
+		s.backend.plugin.cfg.AttachmentStorage.S3.Prefix, s.messageID(), partIndex, filename)
+}
+
+// removeUploads deletes attachment objects already uploaded for a message
+// that will not be delivered
+func (s *Session) removeUploads(parsed *ParsedMessage) {
+	uploader := s.backend.plugin.uploader
+	if uploader == nil {
+		return
+	}
+
+	for _, att := range parsed.Attachments {
+		if !strings.HasPrefix(att.Path, "s3://") {
+			continue
+		}
+		if err := uploader.remove(context.Background(), att.Path); err != nil {
+			s.log.Warn("failed to remove uploaded attachment",
+				zap.String("uuid", s.uuid),
+				zap.String("path", att.Path),
+				zap.Error(err),
+			)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package smtp
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// memoryUploader keeps uploaded objects in a map
+type memoryUploader struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	removed []string
+}
+
+func (u *memoryUploader) upload(_ context.Context, key, _ string, content []byte) (string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.objects == nil {
+		u.objects = map[string][]byte{}
+	}
+	location := "s3://attachments/" + key
+	u.objects[location] = content
+	return location, nil
+}
+
+func (u *memoryUploader) remove(_ context.Context, location string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	delete(u.objects, location)
+	u.removed = append(u.removed, location)
+	return nil
+}
+
+func (u *memoryUploader) stored() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.objects)
+}
+
+// s3Plugin returns a plugin storing attachments in a memoryUploader
+func s3Plugin(t *testing.T, configure func(cfg *Config)) (*Plugin, *testWorker, *memoryUploader) {
+	p, w := newTestPlugin(t, func(cfg *Config) {
+		cfg.AttachmentStorage.Mode = "s3"
+		cfg.AttachmentStorage.S3.Bucket = "attachments"
+		cfg.AttachmentStorage.S3.Prefix = "mail/"
+		if configure != nil {
+			configure(cfg)
+		}
+	})
+	up := &memoryUploader{}
+	p.uploader = up
+	return p, w, up
+}
+
+func TestAttachmentUploadedToS3(t *testing.T) {
+	p, w, up := s3Plugin(t, nil)
+
+	c, _, _ := dialTest(t, startTestServer(t, p))
+	c.cmd("EHLO client.example")
+	code, _ := c.send("a@example.com", []string{"b@example.com"},
+		strings.TrimSuffix(mixedMessage(attachmentPart("b1", "a.pdf", []byte("pdf"))), "\r\n"))
+	require.Equal(t, 250, code)
+
+	event := w.waitEvent(t, "EMAIL_RECEIVED")
+	attachment := event["attachments"].([]any)[0].(map[string]any)
+	location := "s3://attachments/mail/" + event["uuid"].(string) + "-1/0-a.pdf"
+	require.Equal(t, location, attachment["path"])
+	require.Empty(t, attachment["content"])
+	require.Equal(t, []byte("pdf"), up.objects[location])
+}
+
+func TestUploadsRemovedWhenMessageFails(t *testing.T) {
+	message := strings.TrimSuffix(mixedMessage(
+		attachmentPart("b1", "a.pdf", []byte("one")),
+		attachmentPart("b1", "b.pdf", []byte("two")),
+	), "\r\n")
+
+	for name, tc := range map[string]struct {
+		configure func(cfg *Config)
+		respond   func(event map[string]any) string
+		code      int
+	}{
+		"max_attachments": {func(cfg *Config) { cfg.MaxAttachments = 1 }, nil, 552},
+		"worker_reject":   {nil, func(map[string]any) string { return `{"action":"reject"}` }, 550},
+		"worker_error":    {nil, nil, 451},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p, w, up := s3Plugin(t, tc.configure)
+			w.respond = tc.respond
+			if tc.code == 451 {
+				w.fail(io.ErrUnexpectedEOF)
+			}
+
+			c, _, _ := dialTest(t, startTestServer(t, p))
+			c.cmd("EHLO client.example")
+			code, _ := c.send("a@example.com", []string{"b@example.com"}, message)
+			require.Equal(t, tc.code, code)
+
+			require.Zero(t, up.stored())
+			require.NotEmpty(t, up.removed)
+		})
+	}
+}
+
+func TestS3UploaderPutAndDelete(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.EscapedPath())
+		mu.Unlock()
+
+		require.True(t, strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/"))
+		switch r.Method {
+		case http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			require.Equal(t, "pdf", string(body))
+			require.Equal(t, "application/pdf", r.Header.Get("Content-Type"))
+		case http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	up, err := newS3Uploader(&S3Config{
+		Bucket:         "attachments",
+		Region:         "us-east-1",
+		Endpoint:       server.URL,
+		ForcePathStyle: true,
+		AccessKey:      "key",
+		SecretKey:      "secret",
+	})
+	require.NoError(t, err)
+
+	location, err := up.upload(context.Background(), "mail/id-1/0-a b.pdf", "application/pdf", []byte("pdf"))
+	require.NoError(t, err)
+	require.Equal(t, "s3://attachments/mail/id-1/0-a b.pdf", location)
+
+	require.NoError(t, up.remove(context.Background(), location))
+	require.Error(t, up.remove(context.Background(), "s3://other/key"))
+
+	require.Equal(t, []string{
+		"PUT /attachments/mail/id-1/0-a%20b.pdf",
+		"DELETE /attachments/mail/id-1/0-a%20b.pdf",
+	}, requests)
+}
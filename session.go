@@ -2,20 +2,46 @@ package smtp
 
 import (
 	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
+	"strings"
+	"time"
 
 	"github.com/emersion/go-smtp"
 	"go.uber.org/zap"
 )
 
+// errMessageTooLarge is returned when a message exceeds the applicable size limit
+var errMessageTooLarge = &smtp.SMTPError{
+	Code:         552,
+	EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+	Message:      "Message size exceeds fixed maximum message size",
+}
+
+// errSizeMismatch is returned when a message exceeds its declared SIZE (size_mismatch_reject)
+var errSizeMismatch = &smtp.SMTPError{
+	Code:         552,
+	EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+	Message:      "Message size exceeds declared SIZE",
+}
+
 // Session represents an SMTP session (one connection)
 type Session struct {
 	backend    *Backend
 	conn       *smtp.Conn
+	client     *clientConn // nil for injected messages
 	uuid       string
 	remoteAddr string
+	remoteIP   string // "" when the transport has no IP (e.g. unix sockets)
+	remoteHost string // PTR name of remoteIP (rdns)
+	localAddr  string
 	log        *zap.Logger
 
+	// Counted against max_connections until Logout
+	holdsSlot bool
+
 	// Authentication data (captured but not verified)
 	authenticated bool
 	authUsername  string
@@ -23,20 +49,171 @@ type Session struct {
 	authMechanism string
 
 	// SMTP envelope data
-	from     string
-	to       []string
-	heloName string
+	from         string
+	fromRaw      string // raw MAIL FROM line (capture_raw_commands)
+	declaredSize int64  // SIZE parameter of MAIL FROM, 0 if not declared
+	sizeMismatch bool   // received more than declaredSize allows
+	to           []string
+	toRaw        []string // raw RCPT TO lines (capture_raw_commands)
+	duplicateTo  []string
+	rewrittenTo  []RecipientRewrite
+	heloName     string
+
+	// Closed once the EMAIL_HEADERS event of the current message was delivered (stream_events)
+	headersSent chan struct{}
+
+	// DNSBL zones listing the client IP (dnsbl_policy: flag)
+	dnsblListings []string
+
+	// Receives the SPF result of the current transaction (spf.enabled)
+	spfResult chan string
+	spf       string // result once received
 
 	// Email data (accumulated during DATA command)
 	emailData bytes.Buffer
+	// Message as received when normalize_bare_cr rewrote emailData, for DKIM
+	receivedData []byte
+
+	// Messages received on this connection
+	messageCount int
 
 	// Connection control
-	shouldClose bool // Set to true when worker requests connection close
+	shouldClose  bool   // Set to true when worker requests connection close
+	lastResponse string // Worker response to the last message
+
+	// Greeted with EHLO, set while go-smtp builds the EHLO reply
+	esmtp bool
+
+	// Phase timestamps (emit_timing)
+	connectedAt time.Time
+	helloAt     time.Time
+	mailAt      time.Time
+	workerTime  time.Duration // total worker processing on this connection
+}
+
+// trace records an SMTP command in the connection command trace
+func (s *Session) trace(command, args string) {
+	if !s.backend.plugin.cfg.TraceCommands || s.client == nil {
+		return
+	}
+	s.client.addTrace(command, args)
+}
+
+// commandTrace returns the commands of the connection so far
+func (s *Session) commandTrace() []CommandTraceEntry {
+	if s.client == nil {
+		return nil
+	}
+	return s.client.commandTrace()
+}
+
+// markESMTP records that the client greeted with EHLO
+func (s *Session) markESMTP() {
+	if s.esmtp {
+		return
+	}
+	s.esmtp = true
+	if s.backend.plugin.cfg.TraceCommands && s.client != nil {
+		s.client.relabelGreeting("EHLO")
+	}
+}
+
+// messageID identifies the current message: the connection uuid and the
+// sequence of the message on the connection
+func (s *Session) messageID() string {
+	return fmt.Sprintf("%s-%d", s.uuid, s.messageCount)
+}
+
+// closeAfterReply closes the connection once the current reply is written
+func (s *Session) closeAfterReply() {
+	if s.client != nil {
+		s.client.closeAfterReply.Store(true)
+	}
+}
+
+// rateLimited reports whether the client exceeded the connection rate limit,
+// counted once per connection
+func (s *Session) rateLimited() bool {
+	if s.client != nil {
+		return s.client.rateLimit()
+	}
+	return s.remoteIP != "" && !s.backend.plugin.connLimiter.allow(s.remoteIP, time.Now())
+}
+
+// connectEvent returns the reply refusing the client on the connect event,
+// sent once per connection, nil when the client may proceed
+func (s *Session) connectEvent() *smtp.SMTPError {
+	if s.client != nil {
+		return s.client.connectEvent(s)
+	}
+	return s.connectRefused()
 }
 
 // Mail is called for MAIL FROM command
-func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
+func (s *Session) Mail(from string, opts *smtp.MailOptions) (err error) {
+	defer func() {
+		if err != nil {
+			s.backend.plugin.stats.rejectedMail.Add(1)
+		}
+	}()
+
+	s.trace("MAIL", from)
+	if s.backend.plugin.shuttingDown.Load() {
+		return s.shutdownError()
+	}
+
+	if s.backend.plugin.cfg.RequireTLS {
+		if _, isTLS := s.tlsState(); !isTLS {
+			return errTLSRequired
+		}
+	}
+
+	if !*s.backend.plugin.cfg.AllowAnonymous && !s.authenticated {
+		return errAuthRequired
+	}
+
+	// Make the client reconnect, spreading its messages over connections
+	if limit := s.backend.plugin.cfg.MaxMessagesPerConnection; limit > 0 && s.messageCount >= limit {
+		s.log.Debug("message limit per connection reached",
+			zap.String("uuid", s.uuid),
+			zap.Int("messages", s.messageCount),
+		)
+		s.closeAfterReply()
+		return &smtp.SMTPError{
+			Code:         421,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+			Message:      "Too many messages on this connection, reconnect",
+		}
+	}
+
+	if s.backend.plugin.cfg.EnableMailCallback {
+		if err := s.mailCallback(from, opts); err != nil {
+			return err
+		}
+	}
+
+	if spf := &s.backend.plugin.cfg.SPF; spf.Enabled {
+		s.startSPF(from)
+		// spf.reject needs the result before answering MAIL FROM
+		if spf.Reject && s.awaitSPF(spf.Timeout) == spfFail {
+			s.log.Info("sender rejected by SPF",
+				zap.String("uuid", s.uuid),
+				zap.String("from", from),
+				zap.String("remote_ip", s.remoteIP),
+			)
+			s.resetSPF()
+			return errSPFFail
+		}
+	}
+
 	s.from = from
+	s.mailAt = time.Now()
+	if gc, ok := s.conn.Conn().(*guardedConn); ok && gc.captureRaw {
+		s.fromRaw = gc.rawMailFrom(from)
+	}
+	if opts != nil {
+		s.declaredSize = opts.Size
+	}
 	s.log.Debug("MAIL FROM",
 		zap.String("uuid", s.uuid),
 		zap.String("from", from),
@@ -45,8 +222,66 @@ func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
 }
 
 // Rcpt is called for RCPT TO command
-func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
+func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) (err error) {
+	defer func() {
+		if err != nil {
+			s.backend.plugin.stats.rejectedRcpt.Add(1)
+		}
+	}()
+
+	s.trace("RCPT", to)
+	if s.backend.plugin.shuttingDown.Load() {
+		return s.shutdownError()
+	}
+
+	// Raw capture matches the address as sent
+	original := to
+	if rewritten := s.backend.plugin.cfg.rewriteRecipient(to); rewritten != to {
+		s.log.Debug("recipient rewritten",
+			zap.String("uuid", s.uuid),
+			zap.String("original", to),
+			zap.String("rewritten", rewritten),
+		)
+		to = rewritten
+	}
+
+	// A duplicate is accepted, but neither added to the envelope twice
+	// nor counted against max_recipients
+	if *s.backend.plugin.cfg.DedupeRecipients && s.hasRecipient(to) {
+		s.duplicateTo = append(s.duplicateTo, to)
+		s.log.Debug("duplicate RCPT TO ignored",
+			zap.String("uuid", s.uuid),
+			zap.String("to", to),
+		)
+		return nil
+	}
+
+	if limit := s.backend.plugin.cfg.MaxRecipients; len(s.to) >= limit {
+		return &smtp.SMTPError{
+			Code:         452,
+			EnhancedCode: smtp.EnhancedCode{4, 5, 3},
+			Message:      fmt.Sprintf("Maximum limit of %d recipients reached", limit),
+		}
+	}
+
+	// Declared SIZE already exceeds what this recipient domain accepts
+	if limit := s.backend.plugin.cfg.messageSizeLimit(to); s.declaredSize > limit {
+		return errMessageTooLarge
+	}
+
+	if s.backend.plugin.cfg.EnableRcptCallback {
+		if err := s.rcptCallback(to); err != nil {
+			return err
+		}
+	}
+
 	s.to = append(s.to, to)
+	if original != to {
+		s.rewrittenTo = append(s.rewrittenTo, RecipientRewrite{Original: original, Rewritten: to})
+	}
+	if gc, ok := s.conn.Conn().(*guardedConn); ok && gc.captureRaw {
+		s.toRaw = append(s.toRaw, gc.rawRcptTo(original))
+	}
 	s.log.Debug("RCPT TO",
 		zap.String("uuid", s.uuid),
 		zap.String("to", to),
@@ -54,15 +289,146 @@ func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 	return nil
 }
 
+// errAttachmentNotStored is returned when attachments could not be durably written to temp_dir
+var errAttachmentNotStored = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Failed to store message, try again later",
+}
+
+// errParserBusy is returned when no parse slot frees up within parse_queue_timeout
+var errParserBusy = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+	Message:      "Server busy, try again later",
+}
+
+// acquireParseSlot waits for a parse slot when parse_concurrency is set,
+// the returned func releases it
+func (s *Session) acquireParseSlot() (func(), error) {
+	sem := s.backend.plugin.parseSem
+	if sem == nil {
+		return func() {}, nil
+	}
+
+	timer := time.NewTimer(s.backend.plugin.cfg.ParseQueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-timer.C:
+		s.log.Warn("no parse slot available", zap.String("uuid", s.uuid))
+		return nil, errParserBusy
+	}
+}
+
+// protocol returns the negotiated protocol: "LMTP", "ESMTP" (EHLO) or "SMTP" (HELO)
+func (s *Session) protocol() string {
+	// Injected messages have no connection
+	if s.conn == nil {
+		return ""
+	}
+
+	if s.conn.Server().LMTP {
+		return "LMTP"
+	}
+
+	if s.esmtp {
+		return "ESMTP"
+	}
+	return "SMTP"
+}
+
+// tlsState returns the TLS state after STARTTLS or on the implicit TLS listener
+func (s *Session) tlsState() (tls.ConnectionState, bool) {
+	if s.conn == nil {
+		return tls.ConnectionState{}, false
+	}
+	if state, ok := s.conn.TLSConnectionState(); ok {
+		return state, true
+	}
+	// go-smtp only sees the wrapper after STARTTLS done by it or on tls_addr
+	for c := s.conn.Conn(); ; {
+		switch conn := c.(type) {
+		case *guardedConn:
+			if state, ok := conn.tlsState(); ok {
+				return state, true
+			}
+			c = conn.Conn
+		case *clientConn:
+			c = conn.Conn
+		case *tls.Conn:
+			return conn.ConnectionState(), true
+		default:
+			return tls.ConnectionState{}, false
+		}
+	}
+}
+
+// shutdownError returns the reply sent to new transactions during shutdown
+func (s *Session) shutdownError() error {
+	return &smtp.SMTPError{
+		Code:    s.backend.plugin.cfg.ShutdownCode,
+		Message: "Service shutting down",
+	}
+}
+
+// hasRecipient reports whether the address was already accepted (case-insensitive)
+func (s *Session) hasRecipient(addr string) bool {
+	for _, rcpt := range s.to {
+		if strings.EqualFold(rcpt, addr) {
+			return true
+		}
+	}
+	return false
+}
+
 // Data is called when DATA command is received
 // Returns error after reading complete email
-func (s *Session) Data(r io.Reader) error {
+func (s *Session) Data(r io.Reader) (err error) {
+	st := &s.backend.plugin.stats
+	st.messages.Add(1)
+	defer func() {
+		if err != nil {
+			st.rejectedData.Add(1)
+			return
+		}
+		st.accepted.Add(1)
+	}()
+
+	s.trace("DATA", "")
 	s.log.Debug("DATA command received", zap.String("uuid", s.uuid))
 
+	if s.remoteIP != "" && !s.backend.plugin.msgLimiter.allow(s.remoteIP, time.Now()) {
+		s.log.Info("message rate limit exceeded",
+			zap.String("uuid", s.uuid),
+			zap.String("remote_ip", s.remoteIP),
+		)
+		return errMessageRateLimited
+	}
+	dataStart := time.Now()
+
+	cfg := s.backend.plugin.cfg
+	limit := cfg.messageSizeLimitFor(s.to)
+
 	// 1. Read email data
 	s.emailData.Reset()
-	n, err := io.Copy(&s.emailData, r)
+	var src io.Reader = r
+	if cfg.OversizePolicy == "truncate" {
+		src = io.LimitReader(r, limit)
+	}
+
+	var dst io.Writer = &s.emailData
+	if cfg.StreamEvents {
+		dst = &headerTap{buf: &s.emailData, onHeaders: s.emitHeaders}
+	}
+
+	n, err := io.Copy(dst, src)
 	if err != nil {
+		if errors.Is(err, smtp.ErrDataTooLarge) {
+			return errMessageTooLarge
+		}
 		s.log.Error("failed to read email data", zap.Error(err))
 		return &smtp.SMTPError{
 			Code:    451,
@@ -70,6 +436,22 @@ func (s *Session) Data(r io.Reader) error {
 		}
 	}
 
+	// Drain and count whatever is left over the limit
+	received := n
+	if cfg.OversizePolicy == "truncate" {
+		rest, err := io.Copy(io.Discard, r)
+		if err != nil {
+			s.log.Error("failed to read email data", zap.Error(err))
+			return &smtp.SMTPError{
+				Code:    451,
+				Message: "Failed to read message",
+			}
+		}
+		received += rest
+	}
+	dataEnd := time.Now()
+	st.bytes.Add(uint64(received))
+
 	s.log.Info("email received",
 		zap.String("uuid", s.uuid),
 		zap.String("from", s.from),
@@ -77,8 +459,111 @@ func (s *Session) Data(r io.Reader) error {
 		zap.Int64("size", n),
 	)
 
+	// Enforce the most restrictive per-domain limit of the envelope
+	if n > limit {
+		s.log.Info("message exceeds size limit",
+			zap.String("uuid", s.uuid),
+			zap.Int64("size", n),
+			zap.Int64("limit", limit),
+		)
+		return errMessageTooLarge
+	}
+
+	// Client sent more than it declared with MAIL FROM SIZE=
+	s.sizeMismatch = s.declaredSize > 0 && received > s.declaredSize+cfg.SizeMismatchTolerance
+	if s.sizeMismatch {
+		s.log.Info("message exceeds declared size",
+			zap.String("uuid", s.uuid),
+			zap.Int64("declared", s.declaredSize),
+			zap.Int64("received", received),
+		)
+		if cfg.SizeMismatchReject {
+			return errSizeMismatch
+		}
+	}
+
+	if cfg.NormalizeBareCR {
+		s.normalizeBareCR()
+	}
+
+	return s.processMessage(received, n, dataStart, dataEnd)
+}
+
+// normalizeBareCR rewrites CRs not followed by LF in the buffered message to
+// CRLF. Leading dots need no handling here, go-smtp already un-stuffs them.
+func (s *Session) normalizeBareCR() {
+	data := s.emailData.Bytes()
+
+	bare := 0
+	for i, c := range data {
+		if c == '\r' && (i+1 == len(data) || data[i+1] != '\n') {
+			bare++
+		}
+	}
+	if bare == 0 {
+		return
+	}
+
+	// Signatures cover the message as sent, bare CRs included
+	if s.backend.plugin.cfg.DKIM.Enabled {
+		s.receivedData = bytes.Clone(data)
+	}
+
+	normalized := make([]byte, 0, len(data)+bare)
+	for i, c := range data {
+		normalized = append(normalized, c)
+		if c == '\r' && (i+1 == len(data) || data[i+1] != '\n') {
+			normalized = append(normalized, '\n')
+		}
+	}
+
+	s.log.Debug("normalized bare CRs", zap.String("uuid", s.uuid), zap.Int("count", bare))
+
+	s.emailData.Reset()
+	s.emailData.Write(normalized)
+}
+
+// processMessage stores, parses and delivers the message buffered in s.emailData
+// and returns the reply for the client. Shared by DATA and the Inject RPC.
+func (s *Session) processMessage(received, n int64, dataStart, dataEnd time.Time) (err error) {
+	cfg := s.backend.plugin.cfg
+	st := &s.backend.plugin.stats
+
+	s.messageCount++
+
+	// Keep the raw message on disk for forensics, independent of include_raw
+	var emlPath string
+	if cfg.StoreEml != "" {
+		emlPath, err = s.storeEml(s.emailData.Bytes())
+		if err != nil {
+			s.log.Error("failed to store eml", zap.String("uuid", s.uuid), zap.Error(err))
+		}
+	}
+
 	// 2. Parse email
+	release, err := s.acquireParseSlot()
+	if err != nil {
+		return err
+	}
+
+	parseStart := time.Now()
 	emailData, err := s.parseEmail(s.emailData.Bytes())
+	release()
+	if errors.Is(err, errAttachmentPersist) {
+		s.log.Error("failed to persist attachment", zap.String("uuid", s.uuid), zap.Error(err))
+		return errAttachmentNotStored
+	}
+	if errors.Is(err, errTooManyAttachments) {
+		s.log.Info("message exceeds max_attachments",
+			zap.String("uuid", s.uuid),
+			zap.Int("limit", cfg.MaxAttachments),
+		)
+		return &smtp.SMTPError{
+			Code:         552,
+			EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+			Message:      "Too many attachments",
+		}
+	}
 	if err != nil {
 		s.log.Error("failed to parse email", zap.Error(err))
 		return &smtp.SMTPError{
@@ -87,18 +572,107 @@ func (s *Session) Data(r io.Reader) error {
 		}
 	}
 
+	parseTime := time.Since(parseStart)
+
+	if threshold := cfg.SlowParseThreshold; threshold > 0 && parseTime > threshold {
+		s.reportSlowParse(parseTime, emailData.partCount)
+	}
+
+	st.attachments.Add(uint64(len(emailData.Attachments)))
+
+	emailData.UUID = s.uuid
+	emailData.Sequence = s.messageCount
+	emailData.Truncated = received > n
+	emailData.DeclaredSize = s.declaredSize
+	emailData.SizeMismatch = s.sizeMismatch
+	emailData.ReceivedSize = received
+	emailData.MailFromRaw = s.fromRaw
+	emailData.RcptToRaw = s.toRaw
+	emailData.DuplicateRecipients = s.duplicateTo
+	emailData.RewrittenRecipients = s.rewrittenTo
+	emailData.EmlPath = emlPath
+	emailData.Labels = cfg.Labels
+	emailData.Helo = s.heloName
+	emailData.LocalAddr = s.localAddr
+	emailData.RemoteHost = s.remoteHost
+	emailData.Connection = s.connectionData()
+	emailData.CommandTrace = s.commandTrace()
+	emailData.DNSBL = s.dnsblListings
+	emailData.SPFResult = s.awaitSPF(cfg.SPF.MaxWait)
+	emailData.Protocol = s.protocol()
+
+	if s.authMechanism != "" {
+		emailData.Auth = &AuthData{
+			Attempted: true,
+			Mechanism: s.authMechanism,
+			Username:  s.authUsername,
+			Password:  s.backend.plugin.protectCredential(s.authPassword),
+		}
+		match := authSenderMatches(s.authUsername, s.from)
+		emailData.AuthSenderMatch = &match
+	}
+
+	if cfg.EmitTiming {
+		emailData.Timing = &PhaseTiming{
+			ConnectToFirstCommandMs: s.helloAt.Sub(s.connectedAt).Milliseconds(),
+			CommandPhaseMs:          dataStart.Sub(s.mailAt).Milliseconds(),
+			DataTransferMs:          dataEnd.Sub(dataStart).Milliseconds(),
+			ParseMs:                 parseTime.Milliseconds(),
+			WorkerMs:                s.workerTime.Milliseconds(),
+		}
+	}
+
+	// Accept but don't forward messages rejected by delivery_filter
+	if filter := &s.backend.plugin.cfg.DeliveryFilter; filter.enabled() && !filter.matches(s, emailData) {
+		s.backend.plugin.filteredCount.Add(1)
+		s.log.Debug("message filtered out", zap.String("uuid", s.uuid))
+		return s.acceptReply()
+	}
+
+	if cfg.StreamEvents {
+		emailData.Event = "EMAIL_RECEIVED"
+		s.waitHeadersEvent()
+	}
+
 	// 3. Send to PHP worker
-	response, err := s.sendToWorker(emailData)
+	var response string
+	workerStart := time.Now()
+	if cfg.MinimalEvent {
+		response, err = s.sendMinimalToWorker(newMinimalEvent(s.uuid, emailData))
+	} else {
+		response, err = s.sendToWorker(emailData)
+	}
+	s.workerTime += time.Since(workerStart)
+	s.lastResponse = response
 	if err != nil {
 		s.log.Error("worker error", zap.Error(err))
+		s.removeUploads(emailData)
 		return &smtp.SMTPError{
 			Code:    451,
 			Message: "Temporary failure",
 		}
 	}
 
+	followUp := cfg.MinimalEvent && cfg.MinimalEventFollowUp
+	if followUp {
+		go s.deliverFullEvent(emailData, s.messageCount)
+	}
+
 	// 4. Handle worker response
-	switch response {
+	action, reply := parseWorkerResponse(response)
+	if reply != nil {
+		s.log.Info("message rejected by worker",
+			zap.String("uuid", s.uuid),
+			zap.Int("code", reply.Code),
+		)
+		// The follow-up event still references the objects
+		if !followUp {
+			s.removeUploads(emailData)
+		}
+		return reply
+	}
+
+	switch action {
 	case "CLOSE":
 		s.log.Debug("worker requested connection close", zap.String("uuid", s.uuid))
 		s.shouldClose = true
@@ -106,6 +680,19 @@ func (s *Session) Data(r io.Reader) error {
 	case "CONTINUE":
 		s.log.Debug("worker accepted, connection continues", zap.String("uuid", s.uuid))
 
+	case "QUARANTINE":
+		// The client sees a plain 250, the message goes to the quarantine sink
+		s.backend.plugin.stats.quarantined.Add(1)
+		s.log.Info("message quarantined by worker", zap.String("uuid", s.uuid))
+		if dir := cfg.QuarantineDir; dir != "" {
+			if path, err := s.writeEml(dir, s.emailData.Bytes()); err != nil {
+				s.log.Error("failed to quarantine message", zap.String("uuid", s.uuid), zap.Error(err))
+			} else {
+				s.log.Debug("quarantined message stored", zap.String("uuid", s.uuid), zap.String("path", path))
+			}
+		}
+		return nil
+
 	default:
 		s.log.Warn("unexpected worker response",
 			zap.String("uuid", s.uuid),
@@ -113,16 +700,41 @@ func (s *Session) Data(r io.Reader) error {
 		)
 	}
 
-	// Always return nil to send 250 OK to client
+	return s.acceptReply()
+}
+
+// acceptReply returns the final DATA reply for a captured message
+func (s *Session) acceptReply() error {
+	// Honeypot mode: message is captured, but the client sees a rejection
+	if hp := s.backend.plugin.cfg.HoneypotReject; hp.Enabled {
+		s.log.Debug("honeypot rejection", zap.String("uuid", s.uuid), zap.Int("code", hp.Code))
+		return &smtp.SMTPError{
+			Code:    hp.Code,
+			Message: hp.Message,
+		}
+	}
+
+	// Return nil to send 250 OK to client
 	// (profiling mode - accept everything)
 	return nil
 }
 
-// Reset is called for RSET command
+// Reset is called for RSET command and by go-smtp after every DATA.
+// It clears the transaction only: captured AUTH data is deliberately kept,
+// since authentication is connection-scoped (RFC 4954) and go-smtp does not
+// allow a second AUTH on the same connection.
 func (s *Session) Reset() {
 	s.from = ""
+	s.fromRaw = ""
+	s.declaredSize = 0
 	s.to = nil
+	s.toRaw = nil
+	s.duplicateTo = nil
+	s.rewrittenTo = nil
+	s.headersSent = nil
+	s.resetSPF()
 	s.emailData.Reset()
+	s.receivedData = nil
 	s.log.Debug("session reset", zap.String("uuid", s.uuid))
 }
 
@@ -133,6 +745,62 @@ func (s *Session) Logout() error {
 	} else {
 		s.log.Debug("connection closed", zap.String("uuid", s.uuid))
 	}
+	if s.backend.plugin.cfg.EmitTiming {
+		s.log.Debug("session timing",
+			zap.String("uuid", s.uuid),
+			zap.Duration("connect_to_first_command", s.helloAt.Sub(s.connectedAt)),
+			zap.Duration("session", time.Since(s.connectedAt)),
+			zap.Duration("worker", s.workerTime),
+			zap.Int("messages", s.messageCount),
+		)
+	}
 	s.backend.plugin.connections.Delete(s.uuid)
+	s.releaseSlot()
 	return nil
 }
+
+// acquireSlot counts the session against max_connections, false when the limit
+// is reached. A repeated HELO/EHLO replaces the previous session of the
+// connection without Logout, so its slot is taken over instead.
+func (s *Session) acquireSlot(prev smtp.Session) bool {
+	limit := s.backend.plugin.cfg.MaxConnections
+	if limit == 0 {
+		return true
+	}
+
+	if prev, ok := prev.(*Session); ok && prev.holdsSlot {
+		prev.holdsSlot = false
+		s.holdsSlot = true
+		return true
+	}
+
+	active := &s.backend.plugin.activeSessions
+	if active.Add(1) > int64(limit) {
+		active.Add(-1)
+		return false
+	}
+	s.holdsSlot = true
+	return true
+}
+
+// returnSlot undoes acquireSlot for a session that was refused, a slot taken
+// over from the previous session goes back to it
+func (s *Session) returnSlot(prev smtp.Session) {
+	if !s.holdsSlot {
+		return
+	}
+	if prev, ok := prev.(*Session); ok {
+		s.holdsSlot = false
+		prev.holdsSlot = true
+		return
+	}
+	s.releaseSlot()
+}
+
+// releaseSlot gives the max_connections slot back, at most once
+func (s *Session) releaseSlot() {
+	if s.holdsSlot {
+		s.holdsSlot = false
+		s.backend.plugin.activeSessions.Add(-1)
+	}
+}
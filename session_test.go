@@ -0,0 +1,265 @@
+package smtp
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxRecipientsCountsUniqueRecipients(t *testing.T) {
+	p, _ := newTestPlugin(t, func(cfg *Config) { cfg.MaxRecipients = 2 })
+	addr := startTestServer(t, p)
+
+	c, _, _ := dialTest(t, addr)
+	c.cmd("EHLO client.example")
+	c.cmd("MAIL FROM:<a@example.com>")
+
+	for _, rcpt := range []string{"b@example.com", "B@example.com", "c@example.com"} {
+		code, msg := c.cmd("RCPT TO:<%s>", rcpt)
+		require.Equal(t, 250, code, "%s: %s", rcpt, msg)
+	}
+
+	code, msg := c.cmd("RCPT TO:<d@example.com>")
+	require.Equal(t, 452, code)
+	require.Contains(t, msg, "4.5.3")
+}
+
+func TestMailBeforeGreetingRefused(t *testing.T) {
+	p, _ := newTestPlugin(t, nil)
+	addr := startTestServer(t, p)
+
+	c, _, _ := dialTest(t, addr)
+	code, _ := c.cmd("MAIL FROM:<a@example.com>")
+	require.Equal(t, 502, code)
+}
+
+func TestMaxRecipientsReply(t *testing.T) {
+	p, _ := newTestPlugin(t, func(cfg *Config) { cfg.MaxRecipients = 5 })
+
+	c, _, _ := dialTest(t, startTestServer(t, p))
+	c.cmd("EHLO client.example")
+	c.cmd("MAIL FROM:<a@example.com>")
+	for i := 1; i <= 5; i++ {
+		code, _ := c.cmd("RCPT TO:<r%d@example.com>", i)
+		require.Equal(t, 250, code)
+	}
+	code, msg := c.cmd("RCPT TO:<r6@example.com>")
+	require.Equal(t, 452, code)
+	require.Equal(t, "4.5.3 Maximum limit of 5 recipients reached", msg)
+}
+
+func TestDotStuffingAndBareCR(t *testing.T) {
+	for _, normalize := range []bool{false, true} {
+		p, w := newTestPlugin(t, func(cfg *Config) { cfg.NormalizeBareCR = normalize })
+
+		c, _, _ := dialTest(t, startTestServer(t, p))
+		c.cmd("EHLO client.example")
+		code, _ := c.send("a@example.com", []string{"b@example.com"}, "Subject: hi\r\n\r\n..leading dot\r\nbare\rcr")
+		require.Equal(t, 250, code)
+
+		body := w.waitEvent(t, "EMAIL_RECEIVED")["textBody"]
+		if normalize {
+			require.Equal(t, ".leading dot\r\nbare\r\ncr\r\n", body)
+		} else {
+			require.Equal(t, ".leading dot\r\nbare\rcr\r\n", body)
+		}
+	}
+}
+
+func TestAttachmentWriteFailureDefers(t *testing.T) {
+	p, w := newTestPlugin(t, func(cfg *Config) { cfg.AttachmentStorage.Mode = "tempfile" })
+	// temp_dir can't be created below a regular file
+	file := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(file, nil, 0o600))
+	p.cfg.AttachmentStorage.TempDir = filepath.Join(file, "attachments")
+
+	c, _, _ := dialTest(t, startTestServer(t, p))
+	c.cmd("EHLO client.example")
+	code, msg := c.send("a@example.com", []string{"b@example.com"},
+		strings.TrimSuffix(mixedMessage(attachmentPart("b1", "a.pdf", []byte("pdf"))), "\r\n"))
+	require.Equal(t, 451, code)
+	require.Equal(t, "4.3.0 Failed to store message, try again later", msg)
+	require.Empty(t, w.eventsOf("EMAIL_RECEIVED"))
+}
+
+func TestTooManyAttachmentsRejected(t *testing.T) {
+	p, w := newTestPlugin(t, func(cfg *Config) { cfg.MaxAttachments = 2 })
+
+	parts := []string{
+		attachmentPart("b1", "1.bin", []byte("1")),
+		attachmentPart("b1", "2.bin", []byte("2")),
+		attachmentPart("b1", "3.bin", []byte("3")),
+	}
+
+	c, _, _ := dialTest(t, startTestServer(t, p))
+	c.cmd("EHLO client.example")
+	code, _ := c.send("a@example.com", []string{"b@example.com"}, strings.TrimSuffix(mixedMessage(parts...), "\r\n"))
+	require.Equal(t, 552, code)
+	require.Empty(t, w.eventsOf("EMAIL_RECEIVED"))
+
+	code, _ = c.send("a@example.com", []string{"b@example.com"}, strings.TrimSuffix(mixedMessage(parts[:2]...), "\r\n"))
+	require.Equal(t, 250, code)
+}
+
+func TestRequireTLS(t *testing.T) {
+	certFile, keyFile := testCertificate(t)
+	p, _ := newTestPlugin(t, func(cfg *Config) {
+		cfg.TLS.CertFile, cfg.TLS.KeyFile = certFile, keyFile
+		cfg.RequireTLS = true
+	})
+
+	c, _, _ := dialTest(t, startTestServer(t, p))
+	c.cmd("EHLO client.example")
+	code, _ := c.cmd("MAIL FROM:<a@example.com>")
+	require.Equal(t, 530, code)
+
+	c.startTLS(&tls.Config{InsecureSkipVerify: true})
+	c.cmd("EHLO client.example")
+	code, _ = c.cmd("MAIL FROM:<a@example.com>")
+	require.Equal(t, 250, code)
+}
+
+func TestAuthKeptAfterReset(t *testing.T) {
+	p, w := newTestPlugin(t, nil)
+
+	c, _, _ := dialTest(t, startTestServer(t, p))
+	c.cmd("EHLO client.example")
+	code, _ := c.cmd("AUTH PLAIN %s", base64.StdEncoding.EncodeToString([]byte("\x00user\x00secret")))
+	require.Equal(t, 235, code)
+
+	c.cmd("MAIL FROM:<a@example.com>")
+	code, _ = c.cmd("RSET")
+	require.Equal(t, 250, code)
+
+	code, _ = c.send("b@other.example", []string{"c@example.com"}, "Subject: hi\r\n\r\nbody")
+	require.Equal(t, 250, code)
+
+	event := w.waitEvent(t, "EMAIL_RECEIVED")
+	require.Equal(t, "other.example", event["envelopeFromDomain"])
+	auth := event["authentication"].(map[string]any)
+	require.Equal(t, "PLAIN", auth["mechanism"])
+	require.Equal(t, "user", auth["username"])
+}
+
+// failingUploader refuses every upload
+type failingUploader struct{}
+
+func (failingUploader) upload(context.Context, string, string, []byte) (string, error) {
+	return "", errors.New("503 Slow Down")
+}
+
+func (failingUploader) remove(context.Context, string) error {
+	return errors.New("503 Slow Down")
+}
+
+func TestAttachmentUploadFailureDefers(t *testing.T) {
+	p, w := newTestPlugin(t, func(cfg *Config) {
+		cfg.AttachmentStorage.Mode = "s3"
+		cfg.AttachmentStorage.S3.Bucket = "attachments"
+	})
+	p.uploader = failingUploader{}
+
+	c, _, _ := dialTest(t, startTestServer(t, p))
+	c.cmd("EHLO client.example")
+	code, _ := c.send("a@example.com", []string{"b@example.com"},
+		strings.TrimSuffix(mixedMessage(attachmentPart("b1", "a.pdf", []byte("pdf"))), "\r\n"))
+	require.Equal(t, 451, code)
+	require.Empty(t, w.eventsOf("EMAIL_RECEIVED"))
+}
+
+func TestStreamedEventsShareUUIDAndSequence(t *testing.T) {
+	p, w := newTestPlugin(t, func(cfg *Config) { cfg.StreamEvents = true })
+	addr := startTestServer(t, p)
+
+	c, _, _ := dialTest(t, addr)
+	c.cmd("EHLO client.example")
+	for _, subject := range []string{"first", "second"} {
+		code, _ := c.send("a@example.com", []string{"b@example.com"}, "Subject: "+subject+"\r\n\r\nbody")
+		require.Equal(t, 250, code)
+	}
+
+	headers := w.eventsOf("EMAIL_HEADERS")
+	received := w.eventsOf("EMAIL_RECEIVED")
+	require.Len(t, headers, 2)
+	require.Len(t, received, 2)
+	for i := range received {
+		require.NotEmpty(t, received[i]["uuid"])
+		require.Equal(t, received[i]["uuid"], headers[i]["uuid"])
+		require.Equal(t, float64(i+1), headers[i]["sequence"])
+		require.Equal(t, float64(i+1), received[i]["sequence"])
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	p, w := newTestPlugin(t, func(cfg *Config) {
+		cfg.MaxConnections = 2
+		cfg.ConnectEvent = true
+	})
+	w.respond = func(event map[string]any) string {
+		if event["helo"] == "refused.example" {
+			return "CLOSE"
+		}
+		return "CONTINUE"
+	}
+	addr := startTestServer(t, p)
+
+	// A session refused at greeting gives its slot back
+	refused, _, _ := dialTest(t, addr)
+	code, _ := refused.cmd("EHLO refused.example")
+	require.Equal(t, 554, code)
+	require.True(t, refused.closed())
+
+	first, _, _ := dialTest(t, addr)
+	code, _ = first.cmd("HELO client.example")
+	require.Equal(t, 250, code)
+	// Greeting again keeps the slot of the connection
+	code, _ = first.cmd("EHLO client.example")
+	require.Equal(t, 250, code)
+
+	second, _, _ := dialTest(t, addr)
+	code, _ = second.cmd("EHLO client.example")
+	require.Equal(t, 250, code)
+
+	third, _, _ := dialTest(t, addr)
+	code, msg := third.cmd("EHLO client.example")
+	require.Equal(t, 421, code)
+	require.Equal(t, "4.7.0 Too many connections", msg)
+	require.True(t, third.closed())
+	require.Len(t, w.eventsOf("CONNECTION_OPENED"), 3)
+
+	code, _ = first.cmd("QUIT")
+	require.Equal(t, 221, code)
+	require.Eventually(t, func() bool { return p.activeSessions.Load() == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	fourth, _, _ := dialTest(t, addr)
+	code, _ = fourth.cmd("EHLO client.example")
+	require.Equal(t, 250, code)
+}
+
+func TestTimingWorkerMs(t *testing.T) {
+	p, w := newTestPlugin(t, func(cfg *Config) { cfg.EmitTiming = true })
+	w.respond = func(map[string]any) string {
+		time.Sleep(50 * time.Millisecond)
+		return "CONTINUE"
+	}
+
+	c, _, _ := dialTest(t, startTestServer(t, p))
+	c.cmd("EHLO client.example")
+	for i := 0; i < 2; i++ {
+		code, _ := c.send("a@example.com", []string{"b@example.com"}, "Subject: hi\r\n\r\nbody")
+		require.Equal(t, 250, code)
+	}
+
+	events := w.eventsOf("EMAIL_RECEIVED")
+	require.Len(t, events, 2)
+	require.Equal(t, float64(0), events[0]["timing"].(map[string]any)["workerMs"])
+	require.GreaterOrEqual(t, events[1]["timing"].(map[string]any)["workerMs"], float64(50))
+}
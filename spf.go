@@ -0,0 +1,489 @@
+package smtp
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"go.uber.org/zap"
+)
+
+// SPF results (RFC 7208 section 2.6)
+const (
+	spfNone      = "none"
+	spfNeutral   = "neutral"
+	spfPass      = "pass"
+	spfFail      = "fail"
+	spfSoftfail  = "softfail"
+	spfTempError = "temperror"
+	spfPermError = "permerror"
+)
+
+// errSPFFail is returned for MAIL FROM when the SPF result is fail (spf.reject)
+var errSPFFail = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 23},
+	Message:      "SPF validation failed",
+}
+
+// Limits per check on DNS querying terms and on lookups returning no
+// records or a name error (RFC 7208 section 4.6.4)
+const (
+	spfMaxLookups     = 10
+	spfMaxVoidLookups = 2
+)
+
+// checkSPF evaluates the SPF policy of the MAIL FROM domain for ip. Bounces
+// (empty MAIL FROM) are checked against the HELO domain. The "ptr" mechanism
+// is not supported and never matches.
+func (p *Plugin) checkSPF(ctx context.Context, ip, sender, helo string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return spfNone
+	}
+	if v4 := addr.To4(); v4 != nil {
+		addr = v4
+	}
+
+	if sender == "" {
+		sender = "postmaster@" + helo
+	}
+	local, domain, ok := strings.Cut(sender, "@")
+	if !ok {
+		local, domain = "postmaster", sender
+	}
+	if local == "" {
+		local = "postmaster"
+	}
+	if domain == "" {
+		return spfNone
+	}
+
+	e := &spfEval{
+		ctx:    ctx,
+		dns:    p.dns,
+		ip:     addr,
+		local:  local,
+		sender: local + "@" + domain,
+		helo:   helo,
+	}
+	return e.check(domain)
+}
+
+// startSPF runs the SPF check for the MAIL FROM address in the background,
+// bounded by spf.timeout
+func (s *Session) startSPF(from string) {
+	result := make(chan string, 1)
+	s.spfResult = result
+
+	p := s.backend.plugin
+	ip, helo := s.remoteIP, s.heloName
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), p.cfg.SPF.Timeout)
+		defer cancel()
+		result <- p.checkSPF(ctx, ip, from, helo)
+	}()
+}
+
+// awaitSPF returns the SPF result of the current transaction, temperror when
+// the check is still running after wait, "" when SPF is disabled
+func (s *Session) awaitSPF(wait time.Duration) string {
+	if s.spfResult == nil || s.spf != "" {
+		return s.spf
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case s.spf = <-s.spfResult:
+		return s.spf
+	case <-timer.C:
+		s.log.Debug("SPF check still running, reporting temperror", zap.String("uuid", s.uuid))
+		return spfTempError
+	}
+}
+
+// resetSPF forgets the SPF check of the transaction
+func (s *Session) resetSPF() {
+	s.spfResult = nil
+	s.spf = ""
+}
+
+// spfEval holds the state of one SPF check
+type spfEval struct {
+	ctx     context.Context
+	dns     *dnsResolver
+	ip      net.IP // 4 bytes for IPv4
+	local   string
+	sender  string
+	helo    string
+	lookups int
+	voids   int
+}
+
+// check evaluates the SPF record of domain
+func (e *spfEval) check(domain string) string {
+	txts, err := e.dns.lookupTXT(e.ctx, domain)
+	if err != nil {
+		return spfTempError
+	}
+
+	var record string
+	for _, txt := range txts {
+		lower := strings.ToLower(txt)
+		if lower != "v=spf1" && !strings.HasPrefix(lower, "v=spf1 ") {
+			continue
+		}
+		if record != "" {
+			return spfPermError
+		}
+		record = txt
+	}
+	if record == "" {
+		return spfNone
+	}
+
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		// Modifiers are name=value, mechanism arguments never contain '=' before ':' or '/'
+		if name, value, ok := strings.Cut(term, "="); ok && !strings.ContainsAny(name, ":/") {
+			if strings.EqualFold(name, "redirect") {
+				redirect = value
+			}
+			continue
+		}
+
+		qualifier := spfPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = spfFail, term[1:]
+		case '~':
+			qualifier, term = spfSoftfail, term[1:]
+		case '?':
+			qualifier, term = spfNeutral, term[1:]
+		}
+
+		match, result := e.mechanism(domain, term)
+		if result != "" {
+			return result
+		}
+		if match {
+			return qualifier
+		}
+	}
+
+	if redirect != "" {
+		target, ok := e.expand(redirect, domain)
+		if !ok || !e.countLookup() {
+			return spfPermError
+		}
+		result := e.check(target)
+		if result == spfNone {
+			return spfPermError
+		}
+		return result
+	}
+
+	return spfNeutral
+}
+
+// mechanism reports whether term matches the client. A non-empty result
+// ends the check with that result (errors and lookup limits).
+func (e *spfEval) mechanism(domain, term string) (bool, string) {
+	name, arg, _ := strings.Cut(term, ":")
+	if i := strings.IndexByte(name, '/'); i >= 0 {
+		// "a/24" and "mx//64" have no ':'
+		name, arg = name[:i], name[i:]
+	}
+
+	switch strings.ToLower(name) {
+	case "all":
+		return true, ""
+
+	case "ip4", "ip6":
+		prefix := arg
+		if !strings.Contains(prefix, "/") {
+			if strings.EqualFold(name, "ip4") {
+				prefix += "/32"
+			} else {
+				prefix += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return false, spfPermError
+		}
+		return network.Contains(e.ip), ""
+
+	case "include":
+		target, ok := e.expand(arg, domain)
+		if !ok || arg == "" {
+			return false, spfPermError
+		}
+		if !e.countLookup() {
+			return false, spfPermError
+		}
+		switch result := e.check(target); result {
+		case spfPass:
+			return true, ""
+		case spfTempError:
+			return false, spfTempError
+		case spfPermError, spfNone:
+			return false, spfPermError
+		default:
+			return false, ""
+		}
+
+	case "a", "mx":
+		spec, v4len, v6len, ok := splitSPFCIDR(arg)
+		if !ok {
+			return false, spfPermError
+		}
+		target := domain
+		if spec != "" {
+			if target, ok = e.expand(spec, domain); !ok {
+				return false, spfPermError
+			}
+		}
+		if !e.countLookup() {
+			return false, spfPermError
+		}
+
+		hosts := []string{target}
+		if strings.EqualFold(name, "mx") {
+			mxs, err := e.dns.lookupMX(e.ctx, target)
+			if err != nil {
+				return false, spfTempError
+			}
+			if len(mxs) > spfMaxLookups {
+				return false, spfPermError
+			}
+			if !e.countVoid(mxs) {
+				return false, spfPermError
+			}
+			hosts = mxs
+		}
+
+		for _, host := range hosts {
+			addrs, err := e.dns.lookupHost(e.ctx, strings.TrimSuffix(host, "."))
+			if err != nil {
+				return false, spfTempError
+			}
+			if !e.countVoid(addrs) {
+				return false, spfPermError
+			}
+			for _, a := range addrs {
+				if ipInPrefix(e.ip, net.ParseIP(a), v4len, v6len) {
+					return true, ""
+				}
+			}
+		}
+		return false, ""
+
+	case "exists":
+		target, ok := e.expand(arg, domain)
+		if !ok || arg == "" {
+			return false, spfPermError
+		}
+		if !e.countLookup() {
+			return false, spfPermError
+		}
+		addrs, err := e.dns.lookupHost(e.ctx, target)
+		if err != nil {
+			return false, spfTempError
+		}
+		if !e.countVoid(addrs) {
+			return false, spfPermError
+		}
+		return len(addrs) > 0, ""
+
+	case "ptr":
+		if !e.countLookup() {
+			return false, spfPermError
+		}
+		return false, ""
+
+	default:
+		return false, spfPermError
+	}
+}
+
+// countLookup accounts a DNS querying term, false once the limit is exceeded
+func (e *spfEval) countLookup() bool {
+	e.lookups++
+	return e.lookups <= spfMaxLookups
+}
+
+// countVoid accounts a lookup without records, false once the limit is exceeded
+func (e *spfEval) countVoid(records []string) bool {
+	if len(records) == 0 {
+		e.voids++
+	}
+	return e.voids <= spfMaxVoidLookups
+}
+
+// expand resolves the macros of a domain-spec (RFC 7208 section 7)
+func (e *spfEval) expand(spec, domain string) (string, bool) {
+	if !strings.Contains(spec, "%") {
+		return spec, true
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			b.WriteByte(spec[i])
+			continue
+		}
+		if i+1 >= len(spec) {
+			return "", false
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			b.WriteByte('%')
+		case '_':
+			b.WriteByte(' ')
+		case '-':
+			b.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(spec[i:], '}')
+			if end < 2 {
+				return "", false
+			}
+			value, ok := e.macro(spec[i+1:i+end], domain)
+			if !ok {
+				return "", false
+			}
+			b.WriteString(value)
+			i += end
+		default:
+			return "", false
+		}
+	}
+	return b.String(), true
+}
+
+// macro expands the body of one %{...} macro: a letter, an optional number
+// of right-hand parts to keep, an optional "r" to reverse and delimiters
+func (e *spfEval) macro(body, domain string) (string, bool) {
+	var value string
+	switch body[0] | 0x20 {
+	case 's':
+		value = e.sender
+	case 'l':
+		value = e.local
+	case 'o':
+		_, value, _ = strings.Cut(e.sender, "@")
+	case 'd':
+		value = domain
+	case 'i':
+		if e.ip.To4() != nil && len(e.ip) == net.IPv4len {
+			value = e.ip.String()
+		} else {
+			value = reverseIP(e.ip.String())
+			parts := strings.Split(value, ".")
+			for l, r := 0, len(parts)-1; l < r; l, r = l+1, r-1 {
+				parts[l], parts[r] = parts[r], parts[l]
+			}
+			value = strings.Join(parts, ".")
+		}
+	case 'v':
+		value = "in-addr"
+		if len(e.ip) != net.IPv4len {
+			value = "ip6"
+		}
+	case 'h':
+		value = e.helo
+	default:
+		return "", false
+	}
+
+	rest := body[1:]
+	digits := 0
+	for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+		digits++
+	}
+	keep := 0
+	if digits > 0 {
+		n, err := strconv.Atoi(rest[:digits])
+		if err != nil || n == 0 {
+			return "", false
+		}
+		keep = n
+	}
+	rest = rest[digits:]
+
+	reverse := false
+	if rest != "" && rest[0]|0x20 == 'r' {
+		reverse, rest = true, rest[1:]
+	}
+
+	delims := "."
+	if rest != "" {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", false
+		}
+		delims = rest
+	}
+
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delims, r)
+	})
+	if reverse {
+		for l, r := 0, len(parts)-1; l < r; l, r = l+1, r-1 {
+			parts[l], parts[r] = parts[r], parts[l]
+		}
+	}
+	if keep > 0 && keep < len(parts) {
+		parts = parts[len(parts)-keep:]
+	}
+	return strings.Join(parts, "."), true
+}
+
+// splitSPFCIDR splits "domain/24//64" into the domain-spec and prefix lengths
+func splitSPFCIDR(arg string) (string, int, int, bool) {
+	v4len, v6len := 32, 128
+
+	if i := strings.Index(arg, "//"); i >= 0 {
+		n, err := strconv.Atoi(arg[i+2:])
+		if err != nil || n < 0 || n > 128 {
+			return "", 0, 0, false
+		}
+		v6len, arg = n, arg[:i]
+	}
+	if i := strings.IndexByte(arg, '/'); i >= 0 {
+		n, err := strconv.Atoi(arg[i+1:])
+		if err != nil || n < 0 || n > 32 {
+			return "", 0, 0, false
+		}
+		v4len, arg = n, arg[:i]
+	}
+	return arg, v4len, v6len, true
+}
+
+// ipInPrefix reports whether client and addr share the prefix length of their family
+func ipInPrefix(client, addr net.IP, v4len, v6len int) bool {
+	if addr == nil {
+		return false
+	}
+
+	if v4 := addr.To4(); v4 != nil {
+		if len(client) != net.IPv4len {
+			return false
+		}
+		mask := net.CIDRMask(v4len, 32)
+		return v4.Mask(mask).Equal(client.Mask(mask))
+	}
+
+	if len(client) == net.IPv4len {
+		return false
+	}
+	mask := net.CIDRMask(v6len, 128)
+	return addr.Mask(mask).Equal(client.Mask(mask))
+}
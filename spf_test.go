@@ -0,0 +1,179 @@
+package smtp
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSPFRejectRefusesHardFail(t *testing.T) {
+	p, w := newTestPlugin(t, func(cfg *Config) {
+		cfg.SPF.Enabled = true
+		cfg.SPF.Reject = true
+	})
+	dns := &fakeDNS{txt: map[string][]string{
+		"fail.example": {"v=spf1 ip4:198.51.100.0/24 -all"},
+		"soft.example": {"v=spf1 ip4:198.51.100.0/24 ~all"},
+		"pass.example": {"v=spf1 ip4:127.0.0.0/8 -all"},
+	}}
+	dns.install(p)
+	addr := startTestServer(t, p)
+
+	c, _, _ := dialTest(t, addr)
+	c.cmd("EHLO client.example")
+
+	code, msg := c.cmd("MAIL FROM:<a@fail.example>")
+	require.Equal(t, 550, code)
+	require.Contains(t, msg, "5.7.23")
+
+	// softfail is only reported
+	code, _ = c.cmd("MAIL FROM:<a@soft.example>")
+	require.Equal(t, 250, code)
+	c.cmd("RCPT TO:<b@example.com>")
+	c.cmd("DATA")
+	code, _ = c.cmd("Subject: hi\r\n\r\nbody\r\n.")
+	require.Equal(t, 250, code)
+	require.Equal(t, spfSoftfail, w.eventsOf("EMAIL_RECEIVED")[0]["spfResult"])
+
+	code, _ = c.cmd("MAIL FROM:<a@pass.example>")
+	require.Equal(t, 250, code)
+}
+
+func TestSPFResults(t *testing.T) {
+	p, _ := newTestPlugin(t, nil)
+	dns := &fakeDNS{
+		txt: map[string][]string{
+			"pass.example":     {"v=spf1 ip4:192.0.2.0/24 -all"},
+			"fail.example":     {"v=spf1 ip4:198.51.100.0/24 -all"},
+			"soft.example":     {"v=spf1 ~all"},
+			"neutral.example":  {"v=spf1 ?all"},
+			"nomatch.example":  {"v=spf1 ip4:198.51.100.1"},
+			"other.example":    {"v=spf1 include:nothing.example -all"},
+			"twice.example":    {"v=spf1 -all", "v=spf1 +all"},
+			"unknown.example":  {"v=spf1 foo:bar -all"},
+			"a.example":        {"v=spf1 a -all"},
+			"mx.example":       {"v=spf1 mx/24 -all"},
+			"include.example":  {"v=spf1 include:pass.example -all"},
+			"includef.example": {"v=spf1 include:fail.example ~all"},
+			"includen.example": {"v=spf1 include:nothing.example ~all"},
+			"includet.example": {"v=spf1 include:broken.example -all"},
+			"redirect.example": {"v=spf1 redirect=pass.example"},
+			"redirn.example":   {"v=spf1 redirect=nothing.example"},
+			"macro.example":    {"v=spf1 exists:%{i}._spf.%{d} -all"},
+			"macrol.example":   {"v=spf1 exists:%{l1r-}.users.%{d} -all"},
+			"macrob.example":   {"v=spf1 exists:%{z}.%{d} -all"},
+			"limit.example": {"v=spf1 a:h1.example a:h2.example a:h3.example a:h4.example a:h5.example " +
+				"a:h6.example a:h7.example a:h8.example a:h9.example a:h10.example a:h11.example ip4:192.0.2.10 -all"},
+			"void.example":  {"v=spf1 a:v1.example a:v2.example a:v3.example ip4:192.0.2.10 -all"},
+			"voids.example": {"v=spf1 a:v1.example exists:v2.example ip4:192.0.2.10 -all"},
+		},
+		a: map[string][]string{
+			"a.example":                     {"192.0.2.10"},
+			"mail.mx.example":               {"192.0.2.200"},
+			"192.0.2.10._spf.macro.example": {"127.0.0.2"},
+			"strong.users.macrol.example":   {"127.0.0.2"},
+			"h1.example":                    {"198.51.100.1"},
+			"h2.example":                    {"198.51.100.2"},
+			"h3.example":                    {"198.51.100.3"},
+			"h4.example":                    {"198.51.100.4"},
+			"h5.example":                    {"198.51.100.5"},
+			"h6.example":                    {"198.51.100.6"},
+			"h7.example":                    {"198.51.100.7"},
+			"h8.example":                    {"198.51.100.8"},
+			"h9.example":                    {"198.51.100.9"},
+			"h10.example":                   {"198.51.100.10"},
+			"h11.example":                   {"198.51.100.11"},
+		},
+		mx:       map[string][]string{"mx.example": {"mail.mx.example"}},
+		servfail: map[string]bool{"temp.example": true, "broken.example": true},
+	}
+	dns.install(p)
+
+	for domain, want := range map[string]string{
+		"pass.example":     spfPass,
+		"fail.example":     spfFail,
+		"soft.example":     spfSoftfail,
+		"neutral.example":  spfNeutral,
+		"nomatch.example":  spfNeutral,
+		"nothing.example":  spfNone,
+		"temp.example":     spfTempError,
+		"twice.example":    spfPermError,
+		"unknown.example":  spfPermError,
+		"other.example":    spfPermError,
+		"a.example":        spfPass,
+		"mx.example":       spfPass,
+		"include.example":  spfPass,
+		"includef.example": spfSoftfail,
+		"includen.example": spfPermError,
+		"includet.example": spfTempError,
+		"redirect.example": spfPass,
+		"redirn.example":   spfPermError,
+		"macro.example":    spfPass,
+		"macrol.example":   spfPass,
+		"macrob.example":   spfPermError,
+		"limit.example":    spfPermError,
+		"void.example":     spfPermError,
+		"voids.example":    spfPass,
+	} {
+		t.Run(domain, func(t *testing.T) {
+			require.Equal(t, want, p.checkSPF(context.Background(), "192.0.2.10", "strong-bad@"+domain, "client.example"))
+		})
+	}
+}
+
+func TestSPFBounceUsesHelo(t *testing.T) {
+	p, _ := newTestPlugin(t, nil)
+	dns := &fakeDNS{txt: map[string][]string{"helo.example": {"v=spf1 exists:%{l}.%{o} -all"}},
+		a: map[string][]string{"postmaster.helo.example": {"127.0.0.2"}}}
+	dns.install(p)
+
+	require.Equal(t, spfPass, p.checkSPF(context.Background(), "192.0.2.10", "", "helo.example"))
+	require.Equal(t, spfNone, p.checkSPF(context.Background(), "not an ip", "", "helo.example"))
+}
+
+func TestSPFMacroExpansion(t *testing.T) {
+	// RFC 7208 section 7.4
+	e := &spfEval{
+		ip:     net.ParseIP("192.0.2.3").To4(),
+		local:  "strong-bad",
+		sender: "strong-bad@email.example.com",
+		helo:   "mx.example.org",
+	}
+	for spec, want := range map[string]string{
+		"%{s}":                            "strong-bad@email.example.com",
+		"%{o}":                            "email.example.com",
+		"%{d}":                            "email.example.com",
+		"%{d4}":                           "email.example.com",
+		"%{d3}":                           "email.example.com",
+		"%{d2}":                           "example.com",
+		"%{d1}":                           "com",
+		"%{dr}":                           "com.example.email",
+		"%{d2r}":                          "example.email",
+		"%{l}":                            "strong-bad",
+		"%{l-}":                           "strong.bad",
+		"%{lr}":                           "strong-bad",
+		"%{lr-}":                          "bad.strong",
+		"%{l1r-}":                         "strong",
+		"%{h}":                            "mx.example.org",
+		"%{ir}.%{v}._spf.%{d2}":           "3.2.0.192.in-addr._spf.example.com",
+		"%{lr-}.lp._spf.%{d2}":            "bad.strong.lp._spf.example.com",
+		"%{lr-}.lp.%{ir}.%{v}._spf.%{d2}": "bad.strong.lp.3.2.0.192.in-addr._spf.example.com",
+		"%%%_%-":                          "% %20",
+	} {
+		got, ok := e.expand(spec, "email.example.com")
+		require.True(t, ok, spec)
+		require.Equal(t, want, got, spec)
+	}
+
+	for _, spec := range []string{"%", "%x", "%{}", "%{d0}", "%{q}", "%{d2r!}"} {
+		_, ok := e.expand(spec, "email.example.com")
+		require.False(t, ok, spec)
+	}
+
+	e.ip = net.ParseIP("2001:db8::cb01")
+	got, ok := e.expand("%{ir}.%{v}._spf.%{d2}", "email.example.com")
+	require.True(t, ok)
+	require.Equal(t, "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com", got)
+}
@@ -0,0 +1,114 @@
+package smtp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// spoolEvent writes an asynchronously delivered event to spool_dir and returns
+// its path, "" when spooling is disabled, the spool is full or the write failed
+func (p *Plugin) spoolEvent(name string, jsonData []byte) string {
+	dir := p.cfg.SpoolDir
+	if dir == "" {
+		return ""
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		p.log.Error("spool mkdir error", zap.Error(err))
+		return ""
+	}
+
+	if limit := p.cfg.SpoolMaxFiles; limit > 0 {
+		if files, _ := filepath.Glob(filepath.Join(dir, "*.json")); len(files) >= limit {
+			p.log.Warn("spool is full, event delivered without spooling",
+				zap.String("name", name),
+				zap.Int("spool_max_files", limit),
+			)
+			return ""
+		}
+	}
+
+	// Write under a temporary name so replay never picks up a partial file
+	path := filepath.Join(dir, name+".json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, jsonData, 0644); err != nil {
+		p.log.Error("spool write error", zap.Error(err))
+		_ = os.Remove(tmp)
+		return ""
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		p.log.Error("spool write error", zap.Error(err))
+		_ = os.Remove(tmp)
+		return ""
+	}
+
+	return path
+}
+
+// unspool removes a delivered event from the spool
+func (p *Plugin) unspool(path string) {
+	if path == "" {
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		p.log.Error("spool remove error", zap.String("path", path), zap.Error(err))
+	}
+}
+
+// replaySpool delivers events left in spool_dir by a previous run
+func (p *Plugin) replaySpool() {
+	dir := p.cfg.SpoolDir
+	if dir == "" {
+		return
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		// Directory might not exist yet, which is fine
+		if !os.IsNotExist(err) {
+			p.log.Error("spool readdir error", zap.Error(err))
+		}
+		return
+	}
+
+	replayed, failed := 0, 0
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(dir, name)
+
+		// Leftover of a write interrupted by a crash
+		if strings.HasSuffix(name, ".json.tmp") {
+			_ = os.Remove(path)
+			continue
+		}
+		if entry.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		jsonData, err := os.ReadFile(path)
+		if err != nil {
+			p.log.Error("spool read error", zap.String("path", path), zap.Error(err))
+			failed++
+			continue
+		}
+
+		if _, err := p.execWorker(jsonData); err != nil {
+			p.log.Error("spool replay failed", zap.String("path", path), zap.Error(err))
+			failed++
+			continue
+		}
+
+		p.unspool(path)
+		replayed++
+	}
+
+	if replayed > 0 || failed > 0 {
+		p.log.Info("spool replayed",
+			zap.Int("replayed", replayed),
+			zap.Int("failed", failed),
+		)
+	}
+}
@@ -0,0 +1,92 @@
+package smtp
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is an aggregate snapshot of plugin activity since startup
+type Stats struct {
+	Connections   uint64            `json:"connections"`
+	Messages      uint64            `json:"messages"`
+	Accepted      uint64            `json:"accepted"`
+	Quarantined   uint64            `json:"quarantined"`
+	Rejected      map[string]uint64 `json:"rejected"` // by stage: mail, rcpt, data
+	Bytes         uint64            `json:"bytes"`
+	Attachments   uint64            `json:"attachments"`
+	UptimeSeconds int64             `json:"uptime_seconds"`
+
+	// Attachment temp file writes in progress
+	AttachmentWrites int64 `json:"attachment_writes"`
+
+	// Attachment temp storage, current usage is resynced on every cleanup run
+	TempFiles            int64  `json:"temp_files"`
+	TempBytes            int64  `json:"temp_bytes"`
+	TempFilesCreated     uint64 `json:"temp_files_created"`
+	TempFilesRemoved     uint64 `json:"temp_files_removed"`
+	TempFilesLastRemoved int64  `json:"temp_files_last_removed"` // by the last cleanup run
+
+	// Shared DNS resolver
+	DNSCacheHits   uint64 `json:"dns_cache_hits"`
+	DNSCacheMisses uint64 `json:"dns_cache_misses"`
+	DNSLookups     int64  `json:"dns_lookups"` // queries in flight
+}
+
+// stats holds plugin counters, updated lock-free from sessions
+type stats struct {
+	startedAt time.Time
+
+	connections  atomic.Uint64
+	messages     atomic.Uint64
+	accepted     atomic.Uint64
+	quarantined  atomic.Uint64
+	rejectedMail atomic.Uint64
+	rejectedRcpt atomic.Uint64
+	rejectedData atomic.Uint64
+	bytes        atomic.Uint64
+	attachments  atomic.Uint64
+
+	// Gauge of in-flight attachment writes
+	attachmentWrites atomic.Int64
+
+	// Attachment temp storage
+	tempFiles            atomic.Int64
+	tempBytes            atomic.Int64
+	tempFilesCreated     atomic.Uint64
+	tempFilesRemoved     atomic.Uint64
+	tempFilesLastRemoved atomic.Int64
+
+	// Shared DNS resolver
+	dnsCacheHits   atomic.Uint64
+	dnsCacheMisses atomic.Uint64
+	dnsLookups     atomic.Int64
+}
+
+// snapshot returns current counter values
+func (st *stats) snapshot() Stats {
+	return Stats{
+		Connections: st.connections.Load(),
+		Messages:    st.messages.Load(),
+		Accepted:    st.accepted.Load(),
+		Quarantined: st.quarantined.Load(),
+		Rejected: map[string]uint64{
+			"mail": st.rejectedMail.Load(),
+			"rcpt": st.rejectedRcpt.Load(),
+			"data": st.rejectedData.Load(),
+		},
+		Bytes:            st.bytes.Load(),
+		Attachments:      st.attachments.Load(),
+		UptimeSeconds:    int64(time.Since(st.startedAt).Seconds()),
+		AttachmentWrites: st.attachmentWrites.Load(),
+
+		TempFiles:            st.tempFiles.Load(),
+		TempBytes:            st.tempBytes.Load(),
+		TempFilesCreated:     st.tempFilesCreated.Load(),
+		TempFilesRemoved:     st.tempFilesRemoved.Load(),
+		TempFilesLastRemoved: st.tempFilesLastRemoved.Load(),
+
+		DNSCacheHits:   st.dnsCacheHits.Load(),
+		DNSCacheMisses: st.dnsCacheMisses.Load(),
+		DNSLookups:     st.dnsLookups.Load(),
+	}
+}
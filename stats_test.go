@@ -0,0 +1,22 @@
+package smtp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsCountConnectionsOnce(t *testing.T) {
+	p, _ := newTestPlugin(t, nil)
+	addr := startTestServer(t, p)
+
+	c, _, _ := dialTest(t, addr)
+	c.cmd("EHLO client.example")
+	c.cmd("EHLO client.example")
+	c.cmd("HELO client.example")
+
+	c2, _, _ := dialTest(t, addr)
+	c2.cmd("EHLO client.example")
+
+	require.Equal(t, uint64(2), p.stats.snapshot().Connections)
+}
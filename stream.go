@@ -0,0 +1,92 @@
+package smtp
+
+import (
+	"bytes"
+	"net/mail"
+
+	"github.com/goccy/go-json"
+	"go.uber.org/zap"
+)
+
+// headerTap buffers DATA like the plain buffer does and calls onHeaders once
+// with the header section as soon as the blank line ending it has arrived
+// (stream_events)
+type headerTap struct {
+	buf       *bytes.Buffer
+	onHeaders func(raw []byte)
+	done      bool
+}
+
+func (t *headerTap) Write(p []byte) (int, error) {
+	// The terminator may straddle two writes
+	from := max(t.buf.Len()-3, 0)
+
+	n, err := t.buf.Write(p)
+	if t.done || err != nil {
+		return n, err
+	}
+
+	data := t.buf.Bytes()
+	if idx := bytes.Index(data[from:], []byte("\r\n\r\n")); idx >= 0 {
+		t.done = true
+		t.onHeaders(data[:from+idx])
+	} else if idx := bytes.Index(data[from:], []byte("\n\n")); idx >= 0 {
+		t.done = true
+		t.onHeaders(data[:from+idx])
+	}
+
+	return n, err
+}
+
+// emitHeaders delivers an EMAIL_HEADERS event while the body is still being
+// received, the worker response is only logged. processMessage waits for the
+// delivery, so the worker always sees it before the EMAIL_RECEIVED event.
+func (s *Session) emitHeaders(raw []byte) {
+	msg, err := mail.ReadMessage(bytes.NewReader(append(bytes.Clone(raw), "\r\n\r\n"...)))
+	if err != nil {
+		s.log.Debug("failed to parse streamed headers", zap.String("uuid", s.uuid), zap.Error(err))
+		return
+	}
+
+	headers, _ := s.headerMap(msg.Header, raw)
+
+	event := &HeadersEvent{
+		Event:      "EMAIL_HEADERS",
+		UUID:       s.uuid,
+		Sequence:   s.messageCount + 1, // counted once the message is processed
+		From:       s.from,
+		To:         s.to,
+		Helo:       s.heloName,
+		RemoteAddr: s.remoteAddr,
+		Subject:    decodeHeaderValue(msg.Header.Get("Subject")),
+		Headers:    headers,
+		Labels:     s.backend.plugin.cfg.Labels,
+	}
+	if id := msg.Header.Get("Message-ID"); id != "" {
+		event.ID = &id
+	}
+
+	jsonData, err := json.Marshal(event)
+	if err != nil {
+		s.log.Error("failed to marshal headers event", zap.Error(err))
+		return
+	}
+
+	done := make(chan struct{})
+	s.headersSent = done
+
+	go func() {
+		defer close(done)
+		if _, err := s.execWorker(jsonData); err != nil {
+			s.log.Error("headers event delivery failed", zap.String("uuid", s.uuid), zap.Error(err))
+		}
+	}()
+}
+
+// waitHeadersEvent blocks until the EMAIL_HEADERS event of the current message was delivered
+func (s *Session) waitHeadersEvent() {
+	if s.headersSent != nil {
+		<-s.headersSent
+		s.headersSent = nil
+	}
+}
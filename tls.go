@@ -0,0 +1,84 @@
+package smtp
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+
+	"github.com/emersion/go-smtp"
+	"github.com/roadrunner-server/errors"
+)
+
+// tlsVersions maps tls.min_version values to crypto/tls constants
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsClientAuth maps tls.client_auth values to crypto/tls policies
+var tlsClientAuth = map[string]tls.ClientAuthType{
+	"none":    tls.NoClientCert,
+	"request": tls.RequestClientCert,
+	"require": tls.RequireAnyClientCert,
+}
+
+// errTLSRequired is returned for MAIL FROM before STARTTLS when require_tls is set
+var errTLSRequired = &smtp.SMTPError{
+	Code:         530,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+	Message:      "Must issue a STARTTLS command first",
+}
+
+// enabled reports whether a certificate is configured
+func (c *TLSConfig) enabled() bool {
+	return c.CertFile != ""
+}
+
+// build loads the certificate and returns the server TLS configuration
+func (c *TLSConfig) build() (*tls.Config, error) {
+	const op = errors.Op("smtp_tls_config")
+
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tlsVersions[c.MinVersion],
+		ClientAuth:   tlsClientAuth[c.ClientAuth],
+	}, nil
+}
+
+// connectionData reports the TLS parameters of the session, TLS false for plaintext
+func (s *Session) connectionData() ConnectionData {
+	state, ok := s.tlsState()
+	if !ok {
+		return ConnectionData{}
+	}
+	return tlsConnectionData(state)
+}
+
+// tlsConnectionData describes an established TLS connection
+func tlsConnectionData(state tls.ConnectionState) ConnectionData {
+	data := ConnectionData{
+		TLS:         true,
+		TLSVersion:  tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		SNI:         state.ServerName,
+	}
+	// The leaf comes first, the rest is the chain the client sent
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		fingerprint := sha256.Sum256(cert.Raw)
+		data.ClientCert = &ClientCertData{
+			Subject:     cert.Subject.String(),
+			Issuer:      cert.Issuer.String(),
+			Fingerprint: hex.EncodeToString(fingerprint[:]),
+			NotAfter:    cert.NotAfter,
+		}
+	}
+	return data
+}
@@ -0,0 +1,120 @@
+package smtp
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// sendOverTLS delivers one message after STARTTLS and returns its connection data
+func sendOverTLS(t *testing.T, clientAuth string, config *tls.Config) map[string]any {
+	certFile, keyFile := testCertificate(t)
+	p, w := newTestPlugin(t, func(cfg *Config) {
+		cfg.TLS.CertFile, cfg.TLS.KeyFile = certFile, keyFile
+		cfg.TLS.ClientAuth = clientAuth
+	})
+	addr := startTestServer(t, p)
+
+	c, _, _ := dialTest(t, addr)
+	c.cmd("EHLO client.example")
+	c.startTLS(config)
+	c.cmd("EHLO client.example")
+	c.cmd("MAIL FROM:<a@example.com>")
+	c.cmd("RCPT TO:<b@example.com>")
+	c.cmd("DATA")
+	code, msg := c.cmd("Subject: hi\r\n\r\nbody\r\n.")
+	require.Equal(t, 250, code, msg)
+
+	return w.waitEvent(t, "EMAIL_RECEIVED")["connection"].(map[string]any)
+}
+
+func TestClientCertificateCaptured(t *testing.T) {
+	certFile, keyFile := testCertificate(t)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+
+	conn := sendOverTLS(t, "require", &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{cert},
+	})
+
+	fingerprint := sha256.Sum256(cert.Certificate[0])
+	clientCert := conn["clientCert"].(map[string]any)
+	require.Equal(t, hex.EncodeToString(fingerprint[:]), clientCert["fingerprint"])
+	require.Equal(t, "CN=localhost", clientCert["subject"])
+	require.Equal(t, "CN=localhost", clientCert["issuer"])
+}
+
+func TestClientCertificateRequested(t *testing.T) {
+	conn := sendOverTLS(t, "request", &tls.Config{InsecureSkipVerify: true})
+	require.Equal(t, true, conn["tls"])
+	require.NotContains(t, conn, "clientCert")
+}
+
+func TestClientCertificateRequired(t *testing.T) {
+	certFile, keyFile := testCertificate(t)
+	p, _ := newTestPlugin(t, func(cfg *Config) {
+		cfg.TLS.CertFile, cfg.TLS.KeyFile = certFile, keyFile
+		cfg.TLS.ClientAuth = "require"
+	})
+	addr := startTestServer(t, p)
+
+	c, _, _ := dialTest(t, addr)
+	c.cmd("EHLO client.example")
+	code, _ := c.cmd("STARTTLS")
+	require.Equal(t, 220, code)
+
+	tc := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true})
+	err := tc.Handshake()
+	if err == nil {
+		// TLS 1.3 reports the missing certificate on the first read
+		_, err = tc.Read(make([]byte, 1))
+	}
+	require.Error(t, err)
+}
+
+// handshakePipe runs a TLS handshake over an in-memory pipe and returns the server side state
+func handshakePipe(t *testing.T, server, client *tls.Config) tls.ConnectionState {
+	t.Helper()
+
+	sc, cc := net.Pipe()
+	defer sc.Close()
+	defer cc.Close()
+
+	srv := tls.Server(sc, server)
+	errCh := make(chan error, 1)
+	go func() { errCh <- tls.Client(cc, client).Handshake() }()
+	require.NoError(t, srv.Handshake())
+	require.NoError(t, <-errCh)
+	return srv.ConnectionState()
+}
+
+func TestTLSConnectionDataNames(t *testing.T) {
+	certFile, keyFile := testCertificate(t)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+	server := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	state := handshakePipe(t, server, &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         "mx.example",
+		MaxVersion:         tls.VersionTLS12,
+		CipherSuites:       []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	})
+	data := tlsConnectionData(state)
+	require.True(t, data.TLS)
+	require.Equal(t, "TLS 1.2", data.TLSVersion)
+	require.Equal(t, "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", data.CipherSuite)
+	require.Equal(t, "mx.example", data.SNI)
+	require.Nil(t, data.ClientCert)
+
+	// TLS 1.3 suites are not configurable, the choice depends on the hardware
+	data = tlsConnectionData(handshakePipe(t, server, &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS13}))
+	require.Equal(t, "TLS 1.3", data.TLSVersion)
+	require.Contains(t, []string{"TLS_AES_128_GCM_SHA256", "TLS_AES_256_GCM_SHA384", "TLS_CHACHA20_POLY1305_SHA256"}, data.CipherSuite)
+	require.Empty(t, data.SNI)
+}
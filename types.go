@@ -21,12 +21,30 @@ type EnvelopeData struct {
 	Helo string   `json:"helo"` // HELO/EHLO domain
 }
 
+// ConnectionData describes the transport of the session
+type ConnectionData struct {
+	TLS         bool   `json:"tls"`                   // STARTTLS or tls_addr
+	TLSVersion  string `json:"tlsVersion,omitempty"`  // e.g. "TLS 1.3"
+	CipherSuite string `json:"cipherSuite,omitempty"` // e.g. "TLS_AES_128_GCM_SHA256"
+	SNI         string `json:"sni,omitempty"`         // server name requested by the client
+
+	ClientCert *ClientCertData `json:"clientCert,omitempty"` // presented client certificate (tls.client_auth)
+}
+
+// ClientCertData describes an unverified client certificate
+type ClientCertData struct {
+	Subject     string    `json:"subject"`     // distinguished name
+	Issuer      string    `json:"issuer"`      // distinguished name
+	Fingerprint string    `json:"fingerprint"` // SHA-256 of the DER certificate, hex
+	NotAfter    time.Time `json:"notAfter"`
+}
+
 // AuthData represents authentication attempt data
 type AuthData struct {
 	Attempted bool   `json:"attempted"` // true if AUTH was used
-	Mechanism string `json:"mechanism"` // "LOGIN" or "PLAIN"
+	Mechanism string `json:"mechanism"` // "PLAIN", "LOGIN", "XOAUTH2" or "OAUTHBEARER"
 	Username  string `json:"username"`  // Captured username
-	Password  string `json:"password"`  // Captured password (plain text)
+	Password  string `json:"password"`  // Captured password, see credential_storage
 }
 
 // MessageData represents parsed email message
@@ -53,23 +71,266 @@ type EmailAddress struct {
 
 // Attachment represents an email attachment for PHP
 type Attachment struct {
-	Filename  string  `json:"filename"`
+	Filename  string  `json:"filename"` // Original (sanitized) name
 	Content   string  `json:"content"`
 	Type      string  `json:"type"`
+	Size      int64   `json:"size"`
 	ContentID *string `json:"contentId"`
+	Inline    bool    `json:"inline"`           // inline disposition, or referenced by Content-ID without one
+	SHA256    string  `json:"sha256,omitempty"` // hex digest of the decoded content
+	Truncated bool    `json:"truncated"`        // content left out, over max_attachment_size
+
+	// Position of the part in the depth-first MIME walk, counting from 0
+	PartIndex int `json:"partIndex"`
+
+	// Basename of the unique file on disk, Content is its path when set
+	StoredFilename string `json:"storedFilename,omitempty"`
+
+	// Object location in s3 mode, e.g. "s3://bucket/key"
+	Path string `json:"path,omitempty"`
+
+	// Content is not delivered, see DropReason
+	Dropped    bool   `json:"dropped,omitempty"`
+	DropReason string `json:"dropReason,omitempty"` // "storage_none" or a skippedParts reason
 }
 
 // ParsedMessage represents the structure expected by PHP Parser
 type ParsedMessage struct {
-	ID            *string        `json:"id"`
-	Raw           string         `json:"raw"`
-	Sender        []EmailAddress `json:"sender"`
-	Recipients    []EmailAddress `json:"recipients"`
-	CCs           []EmailAddress `json:"ccs"`
-	Subject       string         `json:"subject"`
-	HTMLBody      string         `json:"htmlBody"`
-	TextBody      string         `json:"textBody"`
-	ReplyTo       []EmailAddress `json:"replyTo"`
-	AllRecipients []string       `json:"allRecipients"`
-	Attachments   []Attachment   `json:"attachments"`
+	Event             string              `json:"event,omitempty"` // "EMAIL_RECEIVED" with stream_events
+	UUID              string              `json:"uuid"`            // Connection UUID
+	Sequence          int                 `json:"sequence"`        // message number on the connection, from 1
+	ID                *string             `json:"id"`
+	Raw               string              `json:"raw"`
+	RawHeaders        string              `json:"rawHeaders,omitempty"`
+	HeadersEncoded    map[string][]string `json:"headersEncoded,omitempty"` // values before RFC 2047 decoding (include_raw)
+	HeadersRaw        [][2]string         `json:"headersRaw,omitempty"`     // [name, value] in wire order, duplicates kept (ordered_headers)
+	Headers           map[string][]string `json:"headers"`                  // canonical or on-wire casing (canonicalize_headers)
+	EmlPath           string              `json:"emlPath,omitempty"`        // Raw message on disk (store_eml)
+	Sender            []EmailAddress      `json:"sender"`
+	Recipients        []EmailAddress      `json:"recipients"`
+	CCs               []EmailAddress      `json:"ccs"`
+	Subject           string              `json:"subject"`
+	Priority          string              `json:"priority"`               // "high", "normal" or "low"
+	Date              string              `json:"date,omitempty"`         // Date header as RFC 3339
+	DateOriginal      string              `json:"dateOriginal,omitempty"` // Date header before clamp_future_date replaced it
+	DateClamped       bool                `json:"dateClamped"`
+	Language          string              `json:"language,omitempty"` // ISO 639-1 code (detect_language)
+	HTMLBody          string              `json:"htmlBody"`
+	TextBody          string              `json:"textBody"`
+	BodyTextExtracted string              `json:"bodyTextExtracted,omitempty"` // rendered from HTMLBody (html_to_text)
+	BodyEncoding      string              `json:"bodyEncoding,omitempty"`      // "gzip+base64" for textBody/htmlBody (compress_body_over)
+	HasBody           bool                `json:"hasBody"`                     // false for headers-only messages
+	ReplyTo           []EmailAddress      `json:"replyTo"`
+	AllRecipients     []string            `json:"allRecipients"`
+	Attachments       []Attachment        `json:"attachments"`
+
+	// Size limit handling (oversize_policy: truncate)
+	Truncated    bool  `json:"truncated"`
+	DeclaredSize int64 `json:"declaredSize,omitempty"` // SIZE parameter of MAIL FROM
+	SizeMismatch bool  `json:"sizeMismatch"`           // received more than DeclaredSize plus size_mismatch_tolerance
+	ReceivedSize int64 `json:"receivedSize"`           // Bytes sent by the client
+
+	// Event was shrunk to fit max_worker_payload (raw dropped, attachments moved to temp files)
+	PayloadDowngraded bool `json:"payloadDowngraded,omitempty"`
+
+	// Parsing stopped because max_decoded_bytes was exceeded
+	DecodeLimitExceeded bool `json:"decodeLimitExceeded,omitempty"`
+
+	// Decoded size breakdown in bytes
+	BodySize        int64 `json:"bodySize"`        // Text and HTML bodies
+	AttachmentsSize int64 `json:"attachmentsSize"` // Sum of all attachment sizes
+
+	// Envelope commands exactly as sent (capture_raw_commands)
+	MailFromRaw string   `json:"mailFromRaw,omitempty"`
+	RcptToRaw   []string `json:"rcptToRaw,omitempty"`
+
+	// First text/calendar part (parse_calendar)
+	Calendar *Calendar `json:"calendar,omitempty"`
+
+	// MIME parts the parser did not deliver and why
+	SkippedParts []SkippedPart `json:"skippedParts,omitempty"`
+
+	// Envelope MAIL FROM domain compared with the header From domain
+	EnvelopeFromDomain      string `json:"envelopeFromDomain"`
+	HeaderFromDomain        string `json:"headerFromDomain"`
+	EnvelopeHeaderFromMatch bool   `json:"envelopeHeaderFromMatch"`
+
+	// SPF result for the envelope sender and client IP (spf.enabled):
+	// pass, fail, softfail, neutral, none, temperror or permerror
+	SPFResult string `json:"spfResult,omitempty"`
+
+	// One entry per DKIM-Signature header (dkim.enabled)
+	DKIM []DKIMResult `json:"dkim,omitempty"`
+
+	// Envelope recipients that were sent more than once
+	DuplicateRecipients []string `json:"duplicateRecipients,omitempty"`
+
+	// Envelope recipients changed by rewrite_rules, allRecipients holds the rewritten ones
+	RewrittenRecipients []RecipientRewrite `json:"rewrittenRecipients,omitempty"`
+
+	// Decoded bytes accounted against max_decoded_bytes
+	decodedBytes int64
+
+	// MIME leaf parts seen while parsing, in depth-first order
+	partCount int
+
+	// Static labels from server configuration
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Session-level data
+	Helo         string              `json:"helo"`                 // HELO/EHLO domain
+	Protocol     string              `json:"protocol"`             // "SMTP" (HELO), "ESMTP" (EHLO) or "LMTP"
+	LocalAddr    string              `json:"localAddr"`            // Listener address that accepted the connection
+	RemoteHost   string              `json:"remoteHost,omitempty"` // PTR name of the client IP (rdns)
+	Connection   ConnectionData      `json:"connection"`
+	CommandTrace []CommandTraceEntry `json:"commandTrace,omitempty"`
+	DNSBL        []string            `json:"dnsbl,omitempty"`  // DNSBL zones listing the client IP
+	Timing       *PhaseTiming        `json:"timing,omitempty"` // emit_timing
+	Auth         *AuthData           `json:"authentication,omitempty"`
+
+	// Authenticated username matches MAIL FROM, omitted without AUTH
+	AuthSenderMatch *bool `json:"authSenderMatch,omitempty"`
+}
+
+// HeadersEvent is sent with stream_events as soon as the header section of a
+// message has been received, the EMAIL_RECEIVED event with the same uuid and
+// sequence follows
+type HeadersEvent struct {
+	Event      string              `json:"event"` // Always "EMAIL_HEADERS"
+	UUID       string              `json:"uuid"`
+	Sequence   int                 `json:"sequence"` // message number on the connection, from 1
+	ID         *string             `json:"id"`
+	From       string              `json:"from"` // MAIL FROM
+	To         []string            `json:"to"`   // RCPT TO
+	Helo       string              `json:"helo"`
+	RemoteAddr string              `json:"remoteAddr"`
+	Subject    string              `json:"subject"`
+	Headers    map[string][]string `json:"headers"`
+	Labels     map[string]string   `json:"labels,omitempty"`
+}
+
+// MinimalEvent is the stripped event sent in minimal_event mode:
+// envelope and key headers only, no bodies, attachments or raw message
+type MinimalEvent struct {
+	Event           string            `json:"event"` // Always "EMAIL_MINIMAL"
+	UUID            string            `json:"uuid"`
+	ID              *string           `json:"id"`
+	Sender          []EmailAddress    `json:"sender"`
+	Recipients      []EmailAddress    `json:"recipients"`
+	CCs             []EmailAddress    `json:"ccs"`
+	ReplyTo         []EmailAddress    `json:"replyTo"`
+	Subject         string            `json:"subject"`
+	Priority        string            `json:"priority"`
+	AllRecipients   []string          `json:"allRecipients"`
+	AttachmentCount int               `json:"attachmentCount"`
+	Helo            string            `json:"helo"`
+	Labels          map[string]string `json:"labels,omitempty"`
+}
+
+// newMinimalEvent builds a MinimalEvent from a parsed message
+func newMinimalEvent(uuid string, msg *ParsedMessage) *MinimalEvent {
+	return &MinimalEvent{
+		Event:           "EMAIL_MINIMAL",
+		UUID:            uuid,
+		ID:              msg.ID,
+		Sender:          msg.Sender,
+		Recipients:      msg.Recipients,
+		CCs:             msg.CCs,
+		ReplyTo:         msg.ReplyTo,
+		Subject:         msg.Subject,
+		Priority:        msg.Priority,
+		AllRecipients:   msg.AllRecipients,
+		AttachmentCount: len(msg.Attachments),
+		Helo:            msg.Helo,
+		Labels:          msg.Labels,
+	}
+}
+
+// SlowParseEvent is sent when parsing exceeds slow_parse_threshold
+type SlowParseEvent struct {
+	Event      string `json:"event"` // Always "SLOW_PARSE"
+	UUID       string `json:"uuid"`
+	DurationMs int64  `json:"durationMs"`
+	Size       int    `json:"size"`
+	Parts      int    `json:"parts"`
+	RemoteAddr string `json:"remoteAddr"`
+}
+
+// MailFromEvent is sent for every MAIL FROM (enable_mail_callback), REJECT or
+// a custom reply such as "550 5.1.0 Sender rejected" refuses the sender
+type MailFromEvent struct {
+	Event      string `json:"event"` // Always "MAIL_FROM"
+	UUID       string `json:"uuid"`
+	From       string `json:"from"`
+	Size       int64  `json:"size,omitempty"`       // SIZE parameter
+	Body       string `json:"body,omitempty"`       // BODY parameter, e.g. "8BITMIME"
+	UTF8       bool   `json:"smtputf8,omitempty"`   // SMTPUTF8 parameter
+	EnvelopeID string `json:"envelopeId,omitempty"` // ENVID parameter
+	RemoteAddr string `json:"remoteAddr"`
+	Helo       string `json:"helo"`
+}
+
+// RcptToEvent is sent for every RCPT TO (enable_rcpt_callback), REJECT or a
+// custom reply refuses this recipient only
+type RcptToEvent struct {
+	Event      string   `json:"event"` // Always "RCPT_TO"
+	UUID       string   `json:"uuid"`
+	From       string   `json:"from"`     // MAIL FROM of the transaction
+	To         string   `json:"to"`       // after rewrite_rules
+	Accepted   []string `json:"accepted"` // recipients accepted so far
+	RemoteAddr string   `json:"remoteAddr"`
+	Helo       string   `json:"helo"`
+}
+
+// ConnectEvent is sent when a client session starts (connect_event), a CLOSE
+// or REJECT response refuses the client
+type ConnectEvent struct {
+	Event      string `json:"event"` // Always "CONNECTION_OPENED"
+	UUID       string `json:"uuid"`
+	RemoteAddr string `json:"remoteAddr"`
+	RemoteIP   string `json:"remoteIp"`
+	RemoteHost string `json:"remoteHost,omitempty"` // PTR name of the client IP (rdns)
+	LocalAddr  string `json:"localAddr"`
+	Helo       string `json:"helo"`
+	Server     string `json:"server"` // configured hostname
+}
+
+// ConnectionClosedEvent is sent when a connection ends (trace_commands)
+type ConnectionClosedEvent struct {
+	Event        string              `json:"event"` // Always "CONNECTION_CLOSED"
+	UUID         string              `json:"uuid"`
+	RemoteAddr   string              `json:"remoteAddr"`
+	DurationMs   int64               `json:"durationMs"`
+	CommandTrace []CommandTraceEntry `json:"commandTrace"`
+}
+
+// SkippedPart describes a MIME part left out of the event
+type SkippedPart struct {
+	Reason      string `json:"reason"` // "decode_limit", "unsupported", "error", "multipart_error" or "depth_limit"
+	PartIndex   int    `json:"partIndex"`
+	ContentType string `json:"contentType,omitempty"`
+	Filename    string `json:"filename,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// RecipientRewrite records a recipient changed by rewrite_rules
+type RecipientRewrite struct {
+	Original  string `json:"original"`
+	Rewritten string `json:"rewritten"`
+}
+
+// PhaseTiming holds SMTP phase durations of a message in milliseconds
+type PhaseTiming struct {
+	ConnectToFirstCommandMs int64 `json:"connectToFirstCommandMs"` // accept to HELO/EHLO
+	CommandPhaseMs          int64 `json:"commandPhaseMs"`          // MAIL FROM to DATA
+	DataTransferMs          int64 `json:"dataTransferMs"`
+	ParseMs                 int64 `json:"parseMs"`
+	WorkerMs                int64 `json:"workerMs"` // worker processing of the earlier messages of the connection
+}
+
+// CommandTraceEntry represents a single SMTP command issued by the client
+type CommandTraceEntry struct {
+	Command string    `json:"command"`
+	Args    string    `json:"args,omitempty"`
+	Time    time.Time `json:"time"`
 }
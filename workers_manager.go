@@ -2,6 +2,10 @@ package smtp
 
 import (
 	"context"
+	"time"
+
+	"github.com/roadrunner-server/pool/fsm"
+	"go.uber.org/zap"
 )
 
 func (p *Plugin) AddWorker() error {
@@ -15,3 +19,46 @@ func (p *Plugin) RemoveWorker(ctx context.Context) error {
 	defer p.mu.RUnlock()
 	return p.wPool.RemoveWorker(ctx)
 }
+
+// waitForWorkers blocks until pool has at least wait_for_workers ready workers,
+// worker_ready_timeout expires or the plugin stops
+func (p *Plugin) waitForWorkers(pool Pool) {
+	want := p.cfg.WaitForWorkers
+	if want <= 0 {
+		return
+	}
+
+	deadline := time.Now().Add(p.cfg.WorkerReadyTimeout)
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		ready := 0
+		for _, w := range pool.Workers() {
+			if w.State().Compare(fsm.StateReady) {
+				ready++
+			}
+		}
+
+		if ready >= want {
+			p.log.Info("SMTP worker pool ready", zap.Int("ready", ready))
+			return
+		}
+
+		if p.shuttingDown.Load() {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			p.log.Warn("timeout waiting for workers, serving anyway",
+				zap.Int("ready", ready),
+				zap.Int("wanted", want),
+				zap.Duration("timeout", p.cfg.WorkerReadyTimeout),
+			)
+			return
+		}
+
+		p.log.Debug("waiting for workers", zap.Int("ready", ready), zap.Int("wanted", want))
+		<-ticker.C
+	}
+}